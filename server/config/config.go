@@ -0,0 +1,638 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the complete server configuration
+type Config struct {
+	Server    ServerConfig     `yaml:"server"`
+	Resources *SystemResources `yaml:"resources"`
+	CORS      CORSConfig       `yaml:"cors"`
+	TLS       TLSConfig        `yaml:"tls"`
+	Auth      AuthConfig       `yaml:"auth"`
+	Storage   StorageConfig    `yaml:"storage"`
+	Database  DatabaseConfig   `yaml:"database"`
+	Metrics   MetricsConfig    `yaml:"metrics"`
+	Logging   LoggingConfig    `yaml:"logging"`
+	Tracing   TracingConfig    `yaml:"tracing"`
+	History   HistoryConfig    `yaml:"history"`
+	Search    SearchConfig     `yaml:"search"`
+}
+
+// ServerConfig controls the HTTP listener
+type ServerConfig struct {
+	Port            string        `yaml:"port"`
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// CORSConfig controls which browser origins may call the API
+type CORSConfig struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	AllowedHeaders   []string      `yaml:"allowed_headers"`
+	ExposedHeaders   []string      `yaml:"exposed_headers"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+// TLSConfig controls HTTPS serving
+type TLSConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// SelfSigned generates a certificate for SelfSignedHosts when the files do not exist
+	SelfSigned      bool          `yaml:"self_signed"`
+	SelfSignedHosts []string      `yaml:"self_signed_hosts"`
+	ReloadInterval  time.Duration `yaml:"reload_interval"`
+	// RedirectPort, when set, serves plain HTTP on that port redirecting to HTTPS
+	RedirectPort          string        `yaml:"redirect_port"`
+	HSTSMaxAge            time.Duration `yaml:"hsts_max_age"`
+	HSTSIncludeSubdomains bool          `yaml:"hsts_include_subdomains"`
+	// ClientAuth is "none", "request" (verify if presented) or "require"
+	ClientAuth   string `yaml:"client_auth"`
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// AuthConfig controls API authentication
+type AuthConfig struct {
+	Enabled bool         `yaml:"enabled"`
+	Users   []UserConfig `yaml:"users"`
+}
+
+// UserConfig is an API consumer identified by a bearer token
+type UserConfig struct {
+	Name  string `yaml:"name"`
+	Team  string `yaml:"team"`
+	Token string `yaml:"token"`
+}
+
+// StorageConfig holds paths for files the server writes
+type StorageConfig struct {
+	DataDir string `yaml:"data_dir"`
+}
+
+// DatabaseConfig controls connections to the databases users browse
+type DatabaseConfig struct {
+	// SSLProfiles are named certificate sets a connection request can reference
+	// instead of uploading certificates
+	SSLProfiles map[string]SSLProfile `yaml:"ssl_profiles"`
+	// SSHKnownHostsFile verifies bastion host keys when a tunnel request carries none
+	SSHKnownHostsFile string `yaml:"ssh_known_hosts_file"`
+}
+
+// MetricsConfig controls the Prometheus endpoint
+type MetricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Path is served outside /api, so scrapers need no token and never wait for admission
+	Path string `yaml:"path"`
+}
+
+// LoggingConfig controls structured logging
+type LoggingConfig struct {
+	// Level is debug, info, warn or error
+	Level string `yaml:"level"`
+	// Format is text or json
+	Format string `yaml:"format"`
+	// SensitiveColumns are glob patterns of column names whose values are
+	// never logged, on top of the built-in password and token keys
+	SensitiveColumns []string `yaml:"sensitive_columns"`
+}
+
+// TracingConfig controls OpenTelemetry tracing
+type TracingConfig struct {
+	// Exporter is none, stdout or file (OTLP JSON lines), or otlp (OTLP over HTTP)
+	Exporter string `yaml:"exporter"`
+	File     string `yaml:"file"`
+	// Endpoint is the host:port of an OTLP receiver; empty uses OTEL_EXPORTER_OTLP_ENDPOINT
+	Endpoint    string  `yaml:"endpoint"`
+	Insecure    bool    `yaml:"insecure"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+	ServiceName string  `yaml:"service_name"`
+}
+
+// HistoryConfig controls the query history
+type HistoryConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// File defaults to history.jsonl in the data directory
+	File string `yaml:"file"`
+	// Entries older than MaxAge or beyond the newest MaxEntries are dropped; zero keeps them
+	MaxAge     time.Duration `yaml:"max_age"`
+	MaxEntries int           `yaml:"max_entries"`
+}
+
+// SearchConfig bounds searches across all tables
+type SearchConfig struct {
+	// MaxResults stops a search after this many hits
+	MaxResults int           `yaml:"max_results"`
+	Timeout    time.Duration `yaml:"timeout"`
+	// Parallelism is the number of tables searched at once, at most half of max_connections
+	Parallelism int `yaml:"parallelism"`
+}
+
+// SSLProfile points at certificate files readable by the server
+type SSLProfile struct {
+	Mode           string `yaml:"mode"`
+	RootCertFile   string `yaml:"root_cert_file"`
+	ClientCertFile string `yaml:"client_cert_file"`
+	ClientKeyFile  string `yaml:"client_key_file"`
+}
+
+// Default returns the configuration used when nothing is overridden
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:            "8080",
+			ReadTimeout:     15 * time.Second,
+			WriteTimeout:    60 * time.Second,
+			IdleTimeout:     120 * time.Second,
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Resources: defaultResources(),
+		CORS: CORSConfig{
+			// Only the development client; other origins, including "*", must be allowed explicitly
+			AllowedOrigins: []string{"http://localhost:3000"},
+			AllowedHeaders: []string{"Content-Type", "Authorization", "X-Request-ID"},
+			ExposedHeaders: []string{"Retry-After", "X-Request-ID"},
+			MaxAge:         time.Hour,
+		},
+		TLS: TLSConfig{
+			SelfSignedHosts: []string{"localhost", "127.0.0.1", "::1"},
+			ReloadInterval:  30 * time.Second,
+			HSTSMaxAge:      180 * 24 * time.Hour,
+			ClientAuth:      "none",
+		},
+		Storage: StorageConfig{
+			DataDir: "./data",
+		},
+		Metrics: MetricsConfig{
+			Enabled: true,
+			Path:    "/metrics",
+		},
+		Logging: LoggingConfig{
+			Level:            "info",
+			Format:           "text",
+			SensitiveColumns: []string{"*password*", "*secret*", "*token*", "*api_key*", "ssn"},
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			File:        "./data/traces.jsonl",
+			SampleRatio: 1,
+			ServiceName: "dbviewer-server",
+		},
+		History: HistoryConfig{
+			Enabled:    true,
+			MaxAge:     30 * 24 * time.Hour,
+			MaxEntries: 10000,
+		},
+		Search: SearchConfig{
+			MaxResults:  200,
+			Timeout:     30 * time.Second,
+			Parallelism: 4,
+		},
+	}
+}
+
+// Load builds the effective configuration from defaults, the optional YAML file
+// at path and environment variables, in that order of precedence, and validates it
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	// Limits left unset by the file and environment follow the CPU count
+	cfg.Resources.deriveLimits()
+
+	// Self-signed certificates live in the data directory unless paths are given
+	if cfg.TLS.SelfSigned {
+		if cfg.TLS.CertFile == "" {
+			cfg.TLS.CertFile = filepath.Join(cfg.Storage.DataDir, "tls", "server.crt")
+		}
+		if cfg.TLS.KeyFile == "" {
+			cfg.TLS.KeyFile = filepath.Join(cfg.Storage.DataDir, "tls", "server.key")
+		}
+	}
+
+	if cfg.History.File == "" {
+		cfg.History.File = filepath.Join(cfg.Storage.DataDir, "history.jsonl")
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile merges a YAML file over the current values
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	// The decoded values cannot tell an explicit limit from an absent one, so
+	// record which derived limits the file names
+	var keys struct {
+		Resources map[string]yaml.Node `yaml:"resources"`
+	}
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	for key := range keys.Resources {
+		c.Resources.explicit |= derivedLimitKeys[key]
+	}
+	return nil
+}
+
+// applyEnv overrides values from environment variables. Where two names are
+// listed the first one set wins.
+func (c *Config) applyEnv() error {
+	var errs []error
+	str := func(dst *string, names ...string) {
+		if v, ok := lookupEnv(names...); ok {
+			*dst = v
+		}
+	}
+	integer := func(dst *int, names ...string) {
+		if v, ok := lookupEnv(names...); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid integer %q", names[0], v))
+				return
+			}
+			*dst = n
+		}
+	}
+	float := func(dst *float64, names ...string) {
+		if v, ok := lookupEnv(names...); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid number %q", names[0], v))
+				return
+			}
+			*dst = f
+		}
+	}
+	boolean := func(dst *bool, names ...string) {
+		if v, ok := lookupEnv(names...); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid boolean %q", names[0], v))
+				return
+			}
+			*dst = b
+		}
+	}
+	duration := func(dst *time.Duration, names ...string) {
+		if v, ok := lookupEnv(names...); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid duration %q", names[0], v))
+				return
+			}
+			*dst = d
+		}
+	}
+	limit := func(dst *int, bit derivedLimit, names ...string) {
+		if _, ok := lookupEnv(names...); ok {
+			integer(dst, names...)
+			c.Resources.explicit |= bit
+		}
+	}
+	list := func(dst *[]string, names ...string) {
+		if v, ok := lookupEnv(names...); ok {
+			*dst = splitList(v)
+		}
+	}
+
+	str(&c.Server.Port, "PORT", "SERVER_PORT")
+	duration(&c.Server.ReadTimeout, "READ_TIMEOUT")
+	duration(&c.Server.WriteTimeout, "WRITE_TIMEOUT")
+	duration(&c.Server.IdleTimeout, "IDLE_TIMEOUT")
+	duration(&c.Server.ShutdownTimeout, "SHUTDOWN_TIMEOUT")
+
+	r := c.Resources
+	limit(&r.CPUCores, limitCPUCores, "CPU_CORES")
+	limit(&r.MaxConnections, limitMaxConnections, "MAX_CONNECTIONS", "POSTGRES_MAX_CONNECTIONS")
+	limit(&r.MaxIdleConnections, limitMaxIdleConnections, "MAX_IDLE_CONNECTIONS", "POSTGRES_IDLE_CONNECTIONS")
+	duration(&r.ConnMaxLifetime, "CONN_MAX_LIFETIME")
+	duration(&r.ConnectTimeout, "CONNECT_TIMEOUT")
+	limit(&r.MaxConcurrentRequests, limitMaxConcurrentRequests, "MAX_CONCURRENT_REQUESTS")
+	limit(&r.QueryQueueSize, limitQueryQueueSize, "QUERY_QUEUE_SIZE")
+	duration(&r.QueueTimeout, "QUEUE_TIMEOUT")
+	float(&r.RateLimit, "RATE_LIMIT")
+	integer(&r.RateBurst, "RATE_BURST")
+	integer(&r.CacheSize, "CACHE_SIZE_MB")
+	duration(&r.SchemaCacheTTL, "SCHEMA_CACHE_TTL")
+	boolean(&r.CacheQueryResults, "CACHE_QUERY_RESULTS")
+	duration(&r.QueryCacheTTL, "QUERY_CACHE_TTL")
+	duration(&r.HealthCheckInterval, "HEALTH_CHECK_INTERVAL")
+	duration(&r.HealthCheckTimeout, "HEALTH_CHECK_TIMEOUT")
+	duration(&r.HealthDegradedLatency, "HEALTH_DEGRADED_LATENCY")
+	duration(&r.HealthMaxBackoff, "HEALTH_MAX_BACKOFF")
+
+	list(&c.CORS.AllowedOrigins, "ALLOW_ORIGINS", "CORS_ALLOWED_ORIGINS")
+	boolean(&c.CORS.AllowCredentials, "CORS_ALLOW_CREDENTIALS")
+	list(&c.CORS.AllowedHeaders, "CORS_ALLOWED_HEADERS")
+	list(&c.CORS.ExposedHeaders, "CORS_EXPOSED_HEADERS")
+	duration(&c.CORS.MaxAge, "CORS_MAX_AGE")
+
+	boolean(&c.TLS.Enabled, "TLS_ENABLED")
+	str(&c.TLS.CertFile, "TLS_CERT_FILE")
+	str(&c.TLS.KeyFile, "TLS_KEY_FILE")
+	boolean(&c.TLS.SelfSigned, "TLS_SELF_SIGNED")
+	list(&c.TLS.SelfSignedHosts, "TLS_SELF_SIGNED_HOSTS")
+	duration(&c.TLS.ReloadInterval, "TLS_RELOAD_INTERVAL")
+	str(&c.TLS.RedirectPort, "TLS_REDIRECT_PORT")
+	duration(&c.TLS.HSTSMaxAge, "HSTS_MAX_AGE")
+	boolean(&c.TLS.HSTSIncludeSubdomains, "HSTS_INCLUDE_SUBDOMAINS")
+	str(&c.TLS.ClientAuth, "TLS_CLIENT_AUTH")
+	str(&c.TLS.ClientCAFile, "TLS_CLIENT_CA_FILE")
+
+	boolean(&c.Auth.Enabled, "AUTH_ENABLED")
+	if v, ok := lookupEnv("AUTH_TOKENS"); ok {
+		users, err := parseUserTokens(v)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			c.Auth.Users = users
+		}
+	}
+
+	str(&c.Storage.DataDir, "DATA_DIR")
+
+	str(&c.Database.SSHKnownHostsFile, "SSH_KNOWN_HOSTS_FILE")
+
+	boolean(&c.Metrics.Enabled, "METRICS_ENABLED")
+	str(&c.Metrics.Path, "METRICS_PATH")
+
+	str(&c.Logging.Level, "LOG_LEVEL")
+	str(&c.Logging.Format, "LOG_FORMAT")
+	list(&c.Logging.SensitiveColumns, "LOG_SENSITIVE_COLUMNS")
+
+	str(&c.Tracing.Exporter, "TRACING_EXPORTER")
+	str(&c.Tracing.File, "TRACING_FILE")
+	str(&c.Tracing.Endpoint, "TRACING_ENDPOINT")
+	boolean(&c.Tracing.Insecure, "TRACING_INSECURE")
+	float(&c.Tracing.SampleRatio, "TRACING_SAMPLE_RATIO")
+	str(&c.Tracing.ServiceName, "OTEL_SERVICE_NAME")
+
+	boolean(&c.History.Enabled, "HISTORY_ENABLED")
+	str(&c.History.File, "HISTORY_FILE")
+	duration(&c.History.MaxAge, "HISTORY_MAX_AGE")
+	integer(&c.History.MaxEntries, "HISTORY_MAX_ENTRIES")
+
+	integer(&c.Search.MaxResults, "SEARCH_MAX_RESULTS")
+	duration(&c.Search.Timeout, "SEARCH_TIMEOUT")
+	integer(&c.Search.Parallelism, "SEARCH_PARALLELISM")
+
+	return errors.Join(errs...)
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Server.Port)
+	check(err == nil && port > 0 && port < 65536, "server.port: %q is not a valid port", c.Server.Port)
+	check(c.Server.ReadTimeout >= 0, "server.read_timeout: must not be negative")
+	check(c.Server.WriteTimeout >= 0, "server.write_timeout: must not be negative")
+	check(c.Server.IdleTimeout >= 0, "server.idle_timeout: must not be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout: must be positive")
+
+	r := c.Resources
+	check(r.CPUCores > 0, "resources.cpu_cores: must be positive")
+	check(r.MaxConnections > 0, "resources.max_connections: must be positive")
+	check(r.MaxIdleConnections >= 0 && r.MaxIdleConnections <= r.MaxConnections,
+		"resources.max_idle_connections: must be between 0 and max_connections (%d)", r.MaxConnections)
+	check(r.ConnMaxLifetime >= 0, "resources.conn_max_lifetime: must not be negative")
+	check(r.ConnectTimeout > 0, "resources.connect_timeout: must be positive")
+	check(r.MaxConcurrentRequests > 0, "resources.max_concurrent_requests: must be positive")
+	check(r.QueryQueueSize >= 0, "resources.query_queue_size: must not be negative")
+	check(r.QueueTimeout >= 0, "resources.queue_timeout: must not be negative")
+	check(r.RateLimit >= 0, "resources.rate_limit: must not be negative")
+	check(r.RateBurst >= 0, "resources.rate_burst: must not be negative")
+	check(r.CacheSize >= 0, "resources.cache_size: must not be negative")
+	check(r.SchemaCacheTTL >= 0, "resources.schema_cache_ttl: must not be negative")
+	check(r.QueryCacheTTL >= 0, "resources.query_cache_ttl: must not be negative")
+	check(r.HealthCheckInterval > 0, "resources.health_check_interval: must be positive")
+	check(r.HealthCheckTimeout > 0, "resources.health_check_timeout: must be positive")
+	check(r.HealthDegradedLatency >= 0, "resources.health_degraded_latency: must not be negative")
+	check(r.HealthMaxBackoff >= r.HealthCheckInterval, "resources.health_max_backoff: must be at least health_check_interval")
+
+	check(len(c.CORS.AllowedOrigins) > 0, "cors.allowed_origins: at least one origin is required")
+	for i, origin := range c.CORS.AllowedOrigins {
+		if origin == "*" {
+			// Reflecting every origin with credentials would let any site act as the user
+			check(!c.CORS.AllowCredentials, "cors.allowed_origins: \"*\" cannot be combined with allow_credentials")
+			continue
+		}
+		check(validOriginPattern(origin), "cors.allowed_origins[%d]: %q is not an origin like https://app.example.com or https://*.example.com", i, origin)
+	}
+	check(c.CORS.MaxAge >= 0, "cors.max_age: must not be negative")
+
+	if c.TLS.Enabled {
+		check(c.TLS.CertFile != "" && c.TLS.KeyFile != "", "tls: cert_file and key_file are required when TLS is enabled")
+		check(!c.TLS.SelfSigned || len(c.TLS.SelfSignedHosts) > 0, "tls.self_signed_hosts: at least one host is required for a self-signed certificate")
+		check(c.TLS.ReloadInterval > 0, "tls.reload_interval: must be positive")
+		check(c.TLS.HSTSMaxAge >= 0, "tls.hsts_max_age: must not be negative")
+		if c.TLS.RedirectPort != "" {
+			redirectPort, err := strconv.Atoi(c.TLS.RedirectPort)
+			check(err == nil && redirectPort > 0 && redirectPort < 65536 && c.TLS.RedirectPort != c.Server.Port,
+				"tls.redirect_port: %q must be a valid port different from server.port", c.TLS.RedirectPort)
+		}
+		switch c.TLS.ClientAuth {
+		case "none", "":
+		case "request", "require":
+			check(c.TLS.ClientCAFile != "", "tls.client_ca_file: is required when client_auth is %q", c.TLS.ClientAuth)
+		default:
+			check(false, "tls.client_auth: %q must be none, request or require", c.TLS.ClientAuth)
+		}
+	}
+
+	if c.Auth.Enabled {
+		// Verified client certificates can stand in for bearer tokens
+		mTLS := c.TLS.Enabled && (c.TLS.ClientAuth == "request" || c.TLS.ClientAuth == "require")
+		check(len(c.Auth.Users) > 0 || mTLS, "auth.users: at least one user is required when auth is enabled without client certificates")
+	}
+	tokens := make(map[string]bool)
+	for i, u := range c.Auth.Users {
+		check(u.Name != "", "auth.users[%d].name: is required", i)
+		check(u.Token != "", "auth.users[%d].token: is required", i)
+		check(!tokens[u.Token], "auth.users[%d].token: is shared with another user", i)
+		tokens[u.Token] = true
+	}
+
+	check(c.Storage.DataDir != "", "storage.data_dir: is required")
+
+	for name, p := range c.Database.SSLProfiles {
+		switch p.Mode {
+		case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		default:
+			check(false, "database.ssl_profiles.%s.mode: %q must be disable, allow, prefer, require, verify-ca or verify-full", name, p.Mode)
+		}
+		check((p.ClientCertFile == "") == (p.ClientKeyFile == ""),
+			"database.ssl_profiles.%s: client_cert_file and client_key_file must be set together", name)
+		for _, file := range []string{p.RootCertFile, p.ClientCertFile, p.ClientKeyFile} {
+			if file != "" {
+				_, err := os.Stat(file)
+				check(err == nil, "database.ssl_profiles.%s: %v", name, err)
+			}
+		}
+	}
+	if c.Database.SSHKnownHostsFile != "" {
+		_, err := os.Stat(c.Database.SSHKnownHostsFile)
+		check(err == nil, "database.ssh_known_hosts_file: %v", err)
+	}
+
+	if c.Metrics.Enabled {
+		check(strings.HasPrefix(c.Metrics.Path, "/") && c.Metrics.Path != "/health" &&
+			c.Metrics.Path != "/api" && !strings.HasPrefix(c.Metrics.Path, "/api/"),
+			"metrics.path: %q must start with / and lie outside /api", c.Metrics.Path)
+	}
+
+	switch strings.ToLower(c.Logging.Level) {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		check(false, "logging.level: %q must be debug, info, warn or error", c.Logging.Level)
+	}
+	check(c.Logging.Format == "text" || c.Logging.Format == "json", "logging.format: %q must be text or json", c.Logging.Format)
+	for i, pattern := range c.Logging.SensitiveColumns {
+		_, err := filepath.Match(pattern, "")
+		check(err == nil && pattern != "", "logging.sensitive_columns[%d]: %q is not a valid pattern", i, pattern)
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	case "file":
+		check(c.Tracing.File != "", "tracing.file: is required for the file exporter")
+	default:
+		check(false, "tracing.exporter: %q must be none, stdout, file or otlp", c.Tracing.Exporter)
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio: must be between 0 and 1")
+	check(c.Tracing.ServiceName != "", "tracing.service_name: is required")
+
+	if c.History.Enabled {
+		check(c.History.File != "", "history.file: is required")
+		check(c.History.MaxAge >= 0, "history.max_age: must not be negative")
+		check(c.History.MaxEntries >= 0, "history.max_entries: must not be negative")
+	}
+
+	check(c.Search.MaxResults > 0, "search.max_results: must be positive")
+	check(c.Search.Timeout > 0, "search.timeout: must be positive")
+	check(c.Search.Parallelism > 0, "search.parallelism: must be positive")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with secrets masked
+func (c *Config) Redacted() *Config {
+	out := *c
+	resources := *c.Resources
+	out.Resources = &resources
+	out.Auth.Users = make([]UserConfig, len(c.Auth.Users))
+	for i, u := range c.Auth.Users {
+		u.Token = "********"
+		out.Auth.Users[i] = u
+	}
+	return &out
+}
+
+// Print writes the effective configuration as YAML with secrets masked
+func (c *Config) Print(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c.Redacted()); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// validOriginPattern reports whether s is an exact origin or a wildcard subdomain pattern
+func validOriginPattern(s string) bool {
+	scheme, host, found := strings.Cut(s, "://")
+	if !found {
+		// Scheme-less patterns are only meaningful as wildcards
+		if !strings.HasPrefix(s, "*.") {
+			return false
+		}
+		host = s
+	} else if scheme != "http" && scheme != "https" {
+		return false
+	}
+	host = strings.TrimSuffix(host, "/")
+	// A wildcard may only be the whole first host label
+	if strings.HasPrefix(host, "*.") {
+		host = host[2:]
+	}
+	return host != "" && !strings.ContainsAny(host, "/*?#@ ")
+}
+
+// lookupEnv returns the first non-empty variable among names
+func lookupEnv(names ...string) (string, bool) {
+	for _, name := range names {
+		if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// splitList splits a comma or space separated list
+func splitList(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+// parseUserTokens parses "name[@team]:token" entries separated by commas
+func parseUserTokens(v string) ([]UserConfig, error) {
+	var users []UserConfig
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		identity, token, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("AUTH_TOKENS: entry %q must be name[@team]:token", entry)
+		}
+		name, team, _ := strings.Cut(identity, "@")
+		users = append(users, UserConfig{Name: name, Team: team, Token: token})
+	}
+	return users, nil
+}
@@ -1,25 +1,102 @@
 package config
 
+import (
+	"runtime"
+	"time"
+)
+
 // SystemResources defines system-wide resource limits and configurations
 type SystemResources struct {
-	CPUCores              int     `json:"cpu_cores"`
-	MaxConnections        int     `json:"max_connections"`
-	MaxIdleConnections    int     `json:"max_idle_connections"`
-	MaxConcurrentRequests int     `json:"max_concurrent_requests"`
-	QueryQueueSize        int     `json:"query_queue_size"`
-	RateLimit             float64 `json:"rate_limit"`
-	CacheSize             int     `json:"cache_size"`
+	CPUCores              int           `json:"cpu_cores" yaml:"cpu_cores"`
+	MaxConnections        int           `json:"max_connections" yaml:"max_connections"`
+	MaxIdleConnections    int           `json:"max_idle_connections" yaml:"max_idle_connections"`
+	ConnMaxLifetime       time.Duration `json:"conn_max_lifetime" yaml:"conn_max_lifetime"`
+	ConnectTimeout        time.Duration `json:"connect_timeout" yaml:"connect_timeout"`
+	MaxConcurrentRequests int           `json:"max_concurrent_requests" yaml:"max_concurrent_requests"`
+	QueryQueueSize        int           `json:"query_queue_size" yaml:"query_queue_size"`
+	RateLimit             float64       `json:"rate_limit" yaml:"rate_limit"`
+	RateBurst             int           `json:"rate_burst" yaml:"rate_burst"`
+	QueueTimeout          time.Duration `json:"queue_timeout" yaml:"queue_timeout"`
+	CacheSize             int           `json:"cache_size" yaml:"cache_size"`
+	SchemaCacheTTL        time.Duration `json:"schema_cache_ttl" yaml:"schema_cache_ttl"`
+	CacheQueryResults     bool          `json:"cache_query_results" yaml:"cache_query_results"`
+	QueryCacheTTL         time.Duration `json:"query_cache_ttl" yaml:"query_cache_ttl"`
+	HealthCheckInterval   time.Duration `json:"health_check_interval" yaml:"health_check_interval"`
+	HealthCheckTimeout    time.Duration `json:"health_check_timeout" yaml:"health_check_timeout"`
+	HealthDegradedLatency time.Duration `json:"health_degraded_latency" yaml:"health_degraded_latency"`
+	HealthMaxBackoff      time.Duration `json:"health_max_backoff" yaml:"health_max_backoff"`
+
+	// explicit records which CPU-derived limits the file or environment set
+	explicit derivedLimit
+}
+
+// derivedLimit is a bit set of the limits deriveLimits fills from the CPU count
+type derivedLimit uint8
+
+const (
+	limitCPUCores derivedLimit = 1 << iota
+	limitMaxConnections
+	limitMaxIdleConnections
+	limitMaxConcurrentRequests
+	limitQueryQueueSize
+)
+
+// derivedLimitKeys maps the YAML keys of the CPU-derived limits to their bits
+var derivedLimitKeys = map[string]derivedLimit{
+	"cpu_cores":               limitCPUCores,
+	"max_connections":         limitMaxConnections,
+	"max_idle_connections":    limitMaxIdleConnections,
+	"max_concurrent_requests": limitMaxConcurrentRequests,
+	"query_queue_size":        limitQueryQueueSize,
 }
 
-// NewSystemResources creates a new SystemResources instance with default values
+// NewSystemResources creates a new SystemResources instance sized for the host's CPUs
 func NewSystemResources() *SystemResources {
+	resources := defaultResources()
+	resources.deriveLimits()
+	return resources
+}
+
+// defaultResources returns the fixed defaults, leaving the CPU-derived limits to deriveLimits
+func defaultResources() *SystemResources {
 	return &SystemResources{
-		CPUCores:              2,
-		MaxConnections:        7, // ((2 cores * 2) + 1) / (1 - 0.3)
-		MaxIdleConnections:    3,
-		MaxConcurrentRequests: 14,   // 2 * MaxConnections
-		QueryQueueSize:        21,   // 3 * MaxConnections
-		RateLimit:             10.0, // requests per second
-		CacheSize:             512,  // MB
+		ConnMaxLifetime: 15 * time.Minute,
+		ConnectTimeout:  15 * time.Second,
+		RateLimit:       10.0, // requests per second
+		RateBurst:       20,   // requests allowed in a burst per client
+		QueueTimeout:    10 * time.Second,
+		CacheSize:       512, // MB
+		SchemaCacheTTL:  5 * time.Minute,
+		QueryCacheTTL:   30 * time.Second,
+
+		HealthCheckInterval:   10 * time.Second,
+		HealthCheckTimeout:    5 * time.Second,
+		HealthDegradedLatency: 500 * time.Millisecond,
+		HealthMaxBackoff:      time.Minute,
+	}
+}
+
+// deriveLimits fills every limit the file and environment left out from the CPU
+// count. With 2 cores this gives 7 connections, 3 idle, 14 concurrent requests
+// and a queue of 21.
+func (r *SystemResources) deriveLimits() {
+	if r.explicit&limitCPUCores == 0 {
+		r.CPUCores = runtime.NumCPU()
+	}
+	if r.explicit&limitMaxConnections == 0 {
+		// ((cores * 2) + 1) / (1 - 0.3)
+		r.MaxConnections = int(float64(r.CPUCores*2+1) / (1 - 0.3))
+	}
+	if r.explicit&limitMaxIdleConnections == 0 {
+		r.MaxIdleConnections = r.MaxConnections / 2
+		if r.MaxIdleConnections < 1 {
+			r.MaxIdleConnections = 1
+		}
+	}
+	if r.explicit&limitMaxConcurrentRequests == 0 {
+		r.MaxConcurrentRequests = 2 * r.MaxConnections
+	}
+	if r.explicit&limitQueryQueueSize == 0 {
+		r.QueryQueueSize = 3 * r.MaxConnections
 	}
 }
@@ -1,93 +1,345 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"dbviewer-saas/config"
+	"dbviewer-saas/pkg/admission"
+	"dbviewer-saas/pkg/apierror"
+	"dbviewer-saas/pkg/auth"
+	"dbviewer-saas/pkg/cors"
 	"dbviewer-saas/pkg/database"
 	"dbviewer-saas/pkg/handlers"
+	"dbviewer-saas/pkg/history"
+	"dbviewer-saas/pkg/logging"
+	"dbviewer-saas/pkg/metrics"
+	"dbviewer-saas/pkg/savedquery"
+	"dbviewer-saas/pkg/tableview"
+	"dbviewer-saas/pkg/tlsserver"
+	"dbviewer-saas/pkg/tracing"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 )
 
 func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML configuration file")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration and exit")
+	flag.Parse()
+
 	// Load environment variables
 	if err := godotenv.Load(); err != nil {
 		log.Printf("Warning: .env file not found")
 	}
 
+	// Merge defaults, the config file and the environment
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Switch to structured logging; from here on the log package goes through it too
+	if _, err := logging.Setup(cfg.Logging, os.Stderr); err != nil {
+		log.Fatalf("Failed to configure logging: %v", err)
+	}
+
+	if *printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			log.Fatalf("Failed to print configuration: %v", err)
+		}
+		return
+	}
+
+	// Trace requests and database calls, continuing W3C traceparent headers
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		log.Fatalf("Failed to configure tracing: %v", err)
+	}
+
 	// Initialize system resources
-	resources := config.NewSystemResources()
+	resources := cfg.Resources
 
 	// Initialize router with CORS middleware
 	r := mux.NewRouter()
+	// Tag every request with an ID that its log records and the response carry
+	r.Use(logging.Middleware)
+	r.Use(tracing.Middleware)
+	r.NotFoundHandler = apierror.NotFoundHandler()
+	r.MethodNotAllowedHandler = apierror.MethodNotAllowedHandler()
 
-	// Enable CORS middleware
-	corsMiddleware := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Set CORS headers
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-			w.Header().Set("Access-Control-Max-Age", "3600")
-
-			// Handle preflight requests
-			if r.Method == "OPTIONS" {
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-
-			// Call the next handler
-			next.ServeHTTP(w, r)
-		})
+	// Apply the configured CORS policy
+	corsPolicy, err := cors.New(cors.Options{
+		AllowedOrigins:   cfg.CORS.AllowedOrigins,
+		AllowCredentials: cfg.CORS.AllowCredentials,
+		AllowedHeaders:   cfg.CORS.AllowedHeaders,
+		ExposedHeaders:   cfg.CORS.ExposedHeaders,
+		MaxAge:           cfg.CORS.MaxAge,
+	}, r)
+	if err != nil {
+		log.Fatalf("Failed to configure CORS: %v", err)
 	}
-
-	// Apply CORS middleware
-	r.Use(corsMiddleware)
+	r.Use(corsPolicy.Middleware)
 
 	// Initialize database manager
 	dbManager, err := database.NewDatabaseManager("", resources)
 	if err != nil {
 		log.Fatalf("Failed to initialize database manager: %v", err)
 	}
-	defer dbManager.Close()
+	dbManager.SetSSLProfiles(cfg.Database.SSLProfiles)
+	dbManager.SetSSHKnownHostsFile(cfg.Database.SSHKnownHostsFile)
+
+	// Initialize authentication, admission control and per-client rate limiting
+	authenticator := auth.New(cfg.Auth)
+	admissionController := admission.NewController(resources)
+	rateLimiter := admission.NewRateLimiter(resources.RateLimit, resources.RateBurst)
+
+	// Open the query history
+	var historyStore *history.Store
+	if cfg.History.Enabled {
+		historyStore, err = history.Open(cfg.History)
+		if err != nil {
+			log.Fatalf("Failed to open query history: %v", err)
+		}
+		slog.Info("Recording query history", "file", cfg.History.File, "max_age", cfg.History.MaxAge, "max_entries", cfg.History.MaxEntries)
+	}
+
+	savedQueries, err := savedquery.Open(filepath.Join(cfg.Storage.DataDir, "saved_queries.json"))
+	if err != nil {
+		log.Fatalf("Failed to load saved queries: %v", err)
+	}
+	tableViews, err := tableview.Open(filepath.Join(cfg.Storage.DataDir, "table_views.json"))
+	if err != nil {
+		log.Fatalf("Failed to load table views: %v", err)
+	}
 
 	// Initialize handlers
-	dbHandler := handlers.NewDatabaseHandler(dbManager)
+	dbHandler := handlers.NewDatabaseHandler(dbManager, historyStore, savedQueries, tableViews, cfg.Search)
+	statusHandler := handlers.NewStatusHandler(admissionController, rateLimiter, dbManager)
 
 	// Register routes
-	registerRoutes(r, dbHandler)
+	registerRoutes(r, dbHandler, statusHandler, authenticator, admissionController, rateLimiter)
+
+	// Expose Prometheus metrics
+	if cfg.Metrics.Enabled {
+		registry := metrics.NewRegistry()
+		httpMetrics := metrics.NewHTTPMetrics(registry)
+		metrics.RegisterDatabase(registry, dbManager)
+		metrics.RegisterAdmission(registry, admissionController, rateLimiter)
+
+		r.Use(httpMetrics.Middleware)
+		r.NotFoundHandler = httpMetrics.Middleware(r.NotFoundHandler)
+		r.MethodNotAllowedHandler = httpMetrics.Middleware(r.MethodNotAllowedHandler)
+		r.Handle(cfg.Metrics.Path, registry.Handler()).Methods("GET")
+		slog.Info("Serving metrics", "path", cfg.Metrics.Path)
+	}
+
+	// Requests derive their context from baseCtx, so canceling it aborts the
+	// queries still running when the shutdown deadline passes
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
 
 	// Start server
-	port := os.Getenv("SERVER_PORT")
-	if port == "" {
-		port = "8080"
+	port := cfg.Server.Port
+	server := &http.Server{
+		Addr:         ":" + port,
+		Handler:      r,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
+		BaseContext:  func(net.Listener) context.Context { return baseCtx },
+	}
+
+	// End health event streams when shutdown begins so they do not hold it open
+	server.RegisterOnShutdown(dbManager.CloseHealthSubscribers)
+
+	var redirect *http.Server
+	if cfg.TLS.Enabled {
+		tlsConfig, err := setupTLS(baseCtx, cfg)
+		if err != nil {
+			log.Fatalf("Failed to configure TLS: %v", err)
+		}
+		server.TLSConfig = tlsConfig
+
+		// Send HSTS on every TLS response
+		r.Use(tlsserver.HSTS(cfg.TLS.HSTSMaxAge, cfg.TLS.HSTSIncludeSubdomains))
+
+		if cfg.TLS.RedirectPort != "" {
+			redirect = &http.Server{
+				Addr:         ":" + cfg.TLS.RedirectPort,
+				Handler:      tlsserver.RedirectHandler(port),
+				ReadTimeout:  cfg.Server.ReadTimeout,
+				WriteTimeout: cfg.Server.WriteTimeout,
+				IdleTimeout:  cfg.Server.IdleTimeout,
+			}
+		}
 	}
 
-	log.Printf("Server starting on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	serveErr := serve(server, redirect, cfg.TLS.Enabled, cfg.Server.ShutdownTimeout, cancelRequests)
+
+	// Close the database connections only once no handler can use them anymore
+	if err := dbManager.Close(); err != nil {
+		slog.Warn("Failed to close database connections", "error", err)
+	}
+	if historyStore != nil {
+		if err := historyStore.Close(); err != nil {
+			slog.Warn("Failed to close query history", "error", err)
+		}
+	}
+
+	// Flush the spans still queued for export
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Warn("Failed to flush traces", "error", err)
+	}
+	cancelFlush()
+	if serveErr != nil {
+		log.Fatalf("Server failed: %v", serveErr)
+	}
+	slog.Info("Server stopped")
 }
 
-func registerRoutes(r *mux.Router, h *handlers.DatabaseHandler) {
+// serve runs the listeners until SIGINT or SIGTERM, then stops accepting
+// connections and waits up to shutdownTimeout for in-flight requests. Requests
+// still running at the deadline have their queries canceled and are cut off.
+func serve(server, redirect *http.Server, useTLS bool, shutdownTimeout time.Duration, cancelRequests context.CancelFunc) error {
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 2)
+	go func() {
+		if useTLS {
+			slog.Info("Server starting with TLS", "port", strings.TrimPrefix(server.Addr, ":"))
+			serverErr <- server.ListenAndServeTLS("", "")
+		} else {
+			slog.Info("Server starting", "port", strings.TrimPrefix(server.Addr, ":"))
+			serverErr <- server.ListenAndServe()
+		}
+	}()
+	if redirect != nil {
+		go func() {
+			slog.Info("Redirecting HTTP to HTTPS", "port", strings.TrimPrefix(redirect.Addr, ":"))
+			serverErr <- redirect.ListenAndServe()
+		}()
+	}
+
+	var runErr error
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			runErr = err
+		}
+	case <-signalCtx.Done():
+		slog.Info("Shutdown signal received, draining in-flight requests", "timeout", shutdownTimeout)
+	}
+	// A second signal terminates immediately
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if redirect != nil {
+		if err := redirect.Shutdown(shutdownCtx); err != nil {
+			redirect.Close()
+		}
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Shutdown deadline exceeded, canceling running queries", "error", err)
+		cancelRequests()
+		server.Close()
+	}
+	return runErr
+}
+
+// setupTLS loads (or generates) the server certificate, starts watching it for
+// changes until ctx is done and builds the listener configuration
+func setupTLS(ctx context.Context, cfg *config.Config) (*tls.Config, error) {
+	if cfg.TLS.SelfSigned {
+		created, err := tlsserver.EnsureSelfSigned(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.SelfSignedHosts)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			slog.Info("Generated self-signed certificate for local use only", "file", cfg.TLS.CertFile, "hosts", cfg.TLS.SelfSignedHosts)
+		}
+	}
+
+	reloader, err := tlsserver.NewCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.Watch(ctx, cfg.TLS.ReloadInterval)
+
+	return tlsserver.ServerTLSConfig(reloader, cfg.TLS.ClientCAFile, cfg.TLS.ClientAuth)
+}
+
+func registerRoutes(r *mux.Router, h *handlers.DatabaseHandler, s *handlers.StatusHandler, a *auth.Authenticator, ac *admission.Controller, rl *admission.RateLimiter) {
 	// Health check
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	}).Methods("GET", "OPTIONS")
 
+	// Server status is registered ahead of the API subrouter so it bypasses
+	// admission control, but it names the bastion and tunnel errors so it is
+	// rate limited and authenticated like the rest of the API
+	status := r.PathPrefix("/api/status").Subrouter()
+	status.Use(rl.Middleware)
+	status.Use(a.Middleware)
+	status.HandleFunc("", s.HandleStatus).Methods("GET", "OPTIONS")
+
+	// The health event stream stays open indefinitely, so it is rate limited and
+	// authenticated but must not hold an admission slot
+	events := r.PathPrefix("/api/connection/events").Subrouter()
+	events.Use(rl.Middleware)
+	events.Use(a.Middleware)
+	events.HandleFunc("", h.HandleConnectionEvents).Methods("GET", "OPTIONS")
+
 	// API routes with versioning
 	api := r.PathPrefix("/api").Subrouter()
 
+	// Rate limit each client, authenticate it, then bound the database work in flight
+	api.Use(rl.Middleware)
+	api.Use(a.Middleware)
+	api.Use(ac.Middleware)
+
 	// Database connection endpoints
 	api.HandleFunc("/connect", h.HandleConnect).Methods("POST", "OPTIONS")
 	api.HandleFunc("/connect/direct", h.HandleDirectConnect).Methods("POST", "OPTIONS")
+	api.HandleFunc("/connection/status", h.HandleConnectionStatus).Methods("GET", "OPTIONS")
 
 	// Table operations
 	api.HandleFunc("/tables", h.HandleListTables).Methods("GET", "OPTIONS")
 	api.HandleFunc("/tables/{table}/schema", h.HandleTableSchema).Methods("GET", "OPTIONS")
 	api.HandleFunc("/tables/{table}", h.HandleTableData).Methods("GET", "OPTIONS")
+	api.HandleFunc("/tables/{table}/columns/{column}/profile", h.HandleColumnProfile).Methods("GET", "OPTIONS")
+	api.HandleFunc("/tables/{table}/aggregate", h.HandleAggregate).Methods("POST", "OPTIONS")
+	api.HandleFunc("/tables/{table}/pivot", h.HandlePivot).Methods("POST", "OPTIONS")
+
+	// Size, bloat and activity statistics
+	api.HandleFunc("/stats/tables", h.HandleTableStats).Methods("GET", "OPTIONS")
+	api.HandleFunc("/stats/database", h.HandleDatabaseStats).Methods("GET", "OPTIONS")
+
+	// Search across all tables
+	api.HandleFunc("/search", h.HandleSearch).Methods("GET", "OPTIONS")
+
+	// Saved views of a table
+	api.HandleFunc("/tables/{table}/views", h.HandleListViews).Methods("GET", "OPTIONS")
+	api.HandleFunc("/tables/{table}/views", h.HandleCreateView).Methods("POST", "OPTIONS")
+	api.HandleFunc("/tables/{table}/views/{id}", h.HandleGetView).Methods("GET", "OPTIONS")
+	api.HandleFunc("/tables/{table}/views/{id}", h.HandleUpdateView).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/tables/{table}/views/{id}", h.HandleDeleteView).Methods("DELETE", "OPTIONS")
 
 	// Add new CRUD endpoints
 	api.HandleFunc("/tables/{table}/rows", h.HandleCreateRow).Methods("POST", "OPTIONS")
@@ -96,4 +348,22 @@ func registerRoutes(r *mux.Router, h *handlers.DatabaseHandler) {
 
 	// Add cell update endpoint
 	api.HandleFunc("/tables/{table}/rows/{id}/cells/{column}", h.HandleUpdateCell).Methods("PUT", "OPTIONS")
+
+	// Cache management
+	api.HandleFunc("/cache/invalidate", h.HandleInvalidateCache).Methods("POST", "OPTIONS")
+
+	// Query plans
+	api.HandleFunc("/explain", h.HandleExplain).Methods("POST", "OPTIONS")
+
+	// Query history
+	api.HandleFunc("/history", h.HandleHistory).Methods("GET", "OPTIONS")
+	api.HandleFunc("/history/{id}/rerun", h.HandleRerunHistory).Methods("POST", "OPTIONS")
+
+	// Saved queries
+	api.HandleFunc("/saved-queries", h.HandleListSavedQueries).Methods("GET", "OPTIONS")
+	api.HandleFunc("/saved-queries", h.HandleCreateSavedQuery).Methods("POST", "OPTIONS")
+	api.HandleFunc("/saved-queries/{id}", h.HandleGetSavedQuery).Methods("GET", "OPTIONS")
+	api.HandleFunc("/saved-queries/{id}", h.HandleUpdateSavedQuery).Methods("PUT", "OPTIONS")
+	api.HandleFunc("/saved-queries/{id}", h.HandleDeleteSavedQuery).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/saved-queries/{id}/run", h.HandleRunSavedQuery).Methods("POST", "OPTIONS")
 }
@@ -0,0 +1,156 @@
+// Package admission bounds the amount of database work the server accepts at once
+package admission
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"dbviewer-saas/config"
+	"dbviewer-saas/pkg/apierror"
+)
+
+var (
+	// ErrQueueFull is returned when the wait queue has no room for another request
+	ErrQueueFull = errors.New("request queue is full")
+	// ErrQueueTimeout is returned when a queued request waited too long for a slot
+	ErrQueueTimeout = errors.New("timed out waiting for a free request slot")
+)
+
+// Controller limits in-flight requests and queues the excess up to a fixed depth
+type Controller struct {
+	slots     chan struct{}
+	queueSize int64
+	timeout   time.Duration
+
+	queued   int64
+	inFlight int64
+	admitted uint64
+	rejected uint64
+	timedOut uint64
+}
+
+// Stats is a snapshot of the controller state
+type Stats struct {
+	InFlight      int64  `json:"inFlight"`
+	Queued        int64  `json:"queued"`
+	MaxConcurrent int    `json:"maxConcurrent"`
+	QueueSize     int64  `json:"queueSize"`
+	Admitted      uint64 `json:"admitted"`
+	Rejected      uint64 `json:"rejected"`
+	TimedOut      uint64 `json:"timedOut"`
+}
+
+// NewController creates a controller sized from the system resources
+func NewController(resources *config.SystemResources) *Controller {
+	concurrent := resources.MaxConcurrentRequests
+	if concurrent < 1 {
+		concurrent = 1
+	}
+
+	return &Controller{
+		slots:     make(chan struct{}, concurrent),
+		queueSize: int64(resources.QueryQueueSize),
+		timeout:   resources.QueueTimeout,
+	}
+}
+
+// Acquire waits for a free slot. The returned function must be called to release it.
+func (c *Controller) Acquire(ctx context.Context) (func(), error) {
+	// Fast path: a slot is free right away
+	select {
+	case c.slots <- struct{}{}:
+		return c.admit(), nil
+	default:
+	}
+
+	// Join the queue unless it is already full
+	if atomic.AddInt64(&c.queued, 1) > c.queueSize {
+		atomic.AddInt64(&c.queued, -1)
+		atomic.AddUint64(&c.rejected, 1)
+		return nil, ErrQueueFull
+	}
+	defer atomic.AddInt64(&c.queued, -1)
+
+	var timeout <-chan time.Time
+	if c.timeout > 0 {
+		timer := time.NewTimer(c.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case c.slots <- struct{}{}:
+		return c.admit(), nil
+	case <-timeout:
+		atomic.AddUint64(&c.timedOut, 1)
+		return nil, ErrQueueTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// admit records a newly admitted request and returns its release function
+func (c *Controller) admit() func() {
+	atomic.AddInt64(&c.inFlight, 1)
+	atomic.AddUint64(&c.admitted, 1)
+
+	var once int32
+	return func() {
+		if atomic.CompareAndSwapInt32(&once, 0, 1) {
+			atomic.AddInt64(&c.inFlight, -1)
+			<-c.slots
+		}
+	}
+}
+
+// Stats returns the current controller state
+func (c *Controller) Stats() Stats {
+	return Stats{
+		InFlight:      atomic.LoadInt64(&c.inFlight),
+		Queued:        atomic.LoadInt64(&c.queued),
+		MaxConcurrent: cap(c.slots),
+		QueueSize:     c.queueSize,
+		Admitted:      atomic.LoadUint64(&c.admitted),
+		Rejected:      atomic.LoadUint64(&c.rejected),
+		TimedOut:      atomic.LoadUint64(&c.timedOut),
+	}
+}
+
+// Middleware admits each request before passing it on and sheds load with 503 responses
+func (c *Controller) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Preflight requests never reach the database
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		release, err := c.Acquire(r.Context())
+		if err != nil {
+			if errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQueueTimeout) {
+				w.Header().Set("Retry-After", strconv.Itoa(c.retryAfter()))
+				apierror.Write(w, apierror.Wrap(err, apierror.CodeOverloaded, "Server is busy, please retry later"))
+				return
+			}
+			apierror.Write(w, err)
+			return
+		}
+		defer release()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// retryAfter suggests how many seconds a shed client should wait
+func (c *Controller) retryAfter() int {
+	seconds := int(math.Ceil(c.timeout.Seconds() / 2))
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
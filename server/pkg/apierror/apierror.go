@@ -0,0 +1,188 @@
+// Package apierror defines the typed errors returned by the API and the
+// JSON envelope they are rendered into:
+//
+//	{"error": {"code": "table_not_found", "message": "...", "details": {...}}}
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Code is a stable, machine-readable error identifier
+type Code string
+
+const (
+	CodeInvalidRequest      Code = "invalid_request"
+	CodeValidationFailed    Code = "validation_failed"
+	CodeNotConnected        Code = "not_connected"
+	CodeAuthFailed          Code = "auth_failed"
+	CodeUnauthenticated     Code = "unauthenticated"
+	CodeHostUnreachable     Code = "host_unreachable"
+	CodeTLSError            Code = "tls_error"
+	CodeTunnelFailed        Code = "tunnel_failed"
+	CodeDatabaseNotFound    Code = "database_not_found"
+	CodeDatabaseUnavailable Code = "database_unavailable"
+	CodeTableNotFound       Code = "table_not_found"
+	CodeColumnNotFound      Code = "column_not_found"
+	CodeRowNotFound         Code = "row_not_found"
+	CodeConstraintViolation Code = "constraint_violation"
+	CodeInvalidValue        Code = "invalid_value"
+	CodeInvalidQuery        Code = "invalid_query"
+	CodePermissionDenied    Code = "permission_denied"
+	CodeTimeout             Code = "timeout"
+	CodeCanceled            Code = "canceled"
+	CodeNotFound            Code = "not_found"
+	CodeMethodNotAllowed    Code = "method_not_allowed"
+	CodeOriginNotAllowed    Code = "origin_not_allowed"
+	CodeQueryFailed         Code = "query_failed"
+	CodeOverloaded          Code = "overloaded"
+	CodeRateLimited         Code = "rate_limited"
+	CodeInternal            Code = "internal_error"
+)
+
+// defaultStatus is the HTTP status used for each code unless overridden
+var defaultStatus = map[Code]int{
+	CodeInvalidRequest:      http.StatusBadRequest,
+	CodeValidationFailed:    http.StatusUnprocessableEntity,
+	CodeNotConnected:        http.StatusConflict,
+	CodeAuthFailed:          http.StatusUnauthorized,
+	CodeUnauthenticated:     http.StatusUnauthorized,
+	CodeHostUnreachable:     http.StatusBadGateway,
+	CodeTLSError:            http.StatusBadGateway,
+	CodeTunnelFailed:        http.StatusBadGateway,
+	CodeDatabaseNotFound:    http.StatusNotFound,
+	CodeDatabaseUnavailable: http.StatusServiceUnavailable,
+	CodeTableNotFound:       http.StatusNotFound,
+	CodeColumnNotFound:      http.StatusBadRequest,
+	CodeRowNotFound:         http.StatusNotFound,
+	CodeConstraintViolation: http.StatusConflict,
+	CodeInvalidValue:        http.StatusUnprocessableEntity,
+	CodeInvalidQuery:        http.StatusBadRequest,
+	CodePermissionDenied:    http.StatusForbidden,
+	CodeTimeout:             http.StatusGatewayTimeout,
+	CodeCanceled:            http.StatusRequestTimeout,
+	CodeNotFound:            http.StatusNotFound,
+	CodeMethodNotAllowed:    http.StatusMethodNotAllowed,
+	CodeOriginNotAllowed:    http.StatusForbidden,
+	CodeQueryFailed:         http.StatusInternalServerError,
+	CodeOverloaded:          http.StatusServiceUnavailable,
+	CodeRateLimited:         http.StatusTooManyRequests,
+	CodeInternal:            http.StatusInternalServerError,
+}
+
+// Error is an API error with a code, a human-readable message and optional details
+type Error struct {
+	Code    Code
+	Message string
+	Details map[string]interface{}
+	Status  int
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New creates an error with the default status for its code
+func New(code Code, message string) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+		Status:  StatusFor(code),
+	}
+}
+
+// Wrap creates an error that keeps err as its cause
+func Wrap(err error, code Code, message string) *Error {
+	e := New(code, message)
+	e.Err = err
+	return e
+}
+
+// InvalidField is a shorthand for a bad request caused by a single field
+func InvalidField(field, message string) *Error {
+	return New(CodeInvalidRequest, message).WithDetail("field", field)
+}
+
+// WithDetail attaches a detail entry to the error
+func (e *Error) WithDetail(key string, value interface{}) *Error {
+	if e.Details == nil {
+		e.Details = make(map[string]interface{})
+	}
+	e.Details[key] = value
+	return e
+}
+
+// WithStatus overrides the HTTP status of the error
+func (e *Error) WithStatus(status int) *Error {
+	e.Status = status
+	return e
+}
+
+// StatusFor returns the default HTTP status for a code
+func StatusFor(code Code) int {
+	if status, ok := defaultStatus[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// body is the JSON envelope for error responses
+type body struct {
+	Error payload `json:"error"`
+}
+
+type payload struct {
+	Code    Code                   `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Write classifies err and renders it as a JSON error response
+func Write(w http.ResponseWriter, err error) {
+	apiErr := From(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(body{
+		Error: payload{
+			Code:    apiErr.Code,
+			Message: apiErr.Message,
+			Details: apiErr.Details,
+		},
+	})
+}
+
+// From returns err as an *Error, classifying it if it is not one already
+func From(err error) *Error {
+	if err == nil {
+		return New(CodeInternal, "unknown error")
+	}
+
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	return classify(err)
+}
+
+// NotFoundHandler renders unmatched routes as JSON errors
+func NotFoundHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Write(w, New(CodeNotFound, "route not found").WithDetail("path", r.URL.Path))
+	})
+}
+
+// MethodNotAllowedHandler renders method mismatches as JSON errors
+func MethodNotAllowedHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Write(w, New(CodeMethodNotAllowed, "method not allowed").WithDetail("method", r.Method))
+	})
+}
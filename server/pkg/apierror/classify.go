@@ -0,0 +1,148 @@
+package apierror
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+
+	"dbviewer-saas/pkg/database"
+
+	"github.com/lib/pq"
+)
+
+// pqCodes maps specific PostgreSQL SQLSTATE codes to API codes
+var pqCodes = map[pq.ErrorCode]Code{
+	"28000": CodeAuthFailed,       // invalid_authorization_specification
+	"28P01": CodeAuthFailed,       // invalid_password
+	"3D000": CodeDatabaseNotFound, // invalid_catalog_name
+	"42P01": CodeTableNotFound,    // undefined_table
+	"42703": CodeColumnNotFound,   // undefined_column
+	"42501": CodePermissionDenied, // insufficient_privilege
+	"42601": CodeInvalidQuery,     // syntax_error
+	"57014": CodeTimeout,          // query_canceled
+	"53300": CodeDatabaseUnavailable,
+	"57P01": CodeDatabaseUnavailable, // admin_shutdown
+	"57P02": CodeDatabaseUnavailable, // crash_shutdown
+	"57P03": CodeDatabaseUnavailable, // cannot_connect_now
+}
+
+// pqClasses maps SQLSTATE classes to API codes when no specific code matches
+var pqClasses = map[pq.ErrorClass]Code{
+	"08": CodeDatabaseUnavailable, // connection_exception
+	"22": CodeInvalidValue,        // data_exception
+	"23": CodeConstraintViolation, // integrity_constraint_violation
+	"28": CodeAuthFailed,          // invalid_authorization_specification
+	"42": CodeInvalidQuery,        // syntax_error_or_access_rule_violation
+	"53": CodeDatabaseUnavailable, // insufficient_resources
+	"57": CodeDatabaseUnavailable, // operator_intervention
+}
+
+// classify maps errors from the database layer, lib/pq and the network to API errors
+func classify(err error) *Error {
+	message := err.Error()
+
+	var validationErr *database.ValidationError
+	if errors.As(err, &validationErr) {
+		return Wrap(err, CodeValidationFailed, message).
+			WithDetail("fields", validationErr.Fields)
+	}
+
+	var constraintErr *database.ConstraintError
+	if errors.As(err, &constraintErr) {
+		apiErr := Wrap(err, CodeConstraintViolation, message).
+			WithDetail("kind", constraintErr.Kind).
+			WithDetail("pgCode", constraintErr.PGCode)
+		if !constraintErr.Conflict() {
+			apiErr.Status = http.StatusUnprocessableEntity
+		}
+		if constraintErr.Constraint != "" {
+			apiErr.WithDetail("constraint", constraintErr.Constraint)
+		}
+		if constraintErr.Field != "" {
+			apiErr.WithDetail("fields", []database.FieldError{{
+				Field:   constraintErr.Field,
+				Code:    constraintErr.Kind,
+				Message: constraintErr.Message,
+			}})
+		}
+		return apiErr
+	}
+
+	var tunnelErr *database.TunnelError
+	if errors.As(err, &tunnelErr) {
+		return Wrap(err, CodeTunnelFailed, message).
+			WithDetail("stage", tunnelErr.Stage)
+	}
+
+	switch {
+	case errors.Is(err, database.ErrNotConnected):
+		return Wrap(err, CodeNotConnected, message)
+	case errors.Is(err, database.ErrTableNotFound):
+		return Wrap(err, CodeTableNotFound, message)
+	case errors.Is(err, database.ErrRowNotFound):
+		return Wrap(err, CodeRowNotFound, message)
+	case errors.Is(err, database.ErrTargetSessionAttrs):
+		return Wrap(err, CodeDatabaseUnavailable, message)
+	case errors.Is(err, pq.ErrSSLNotSupported),
+		errors.Is(err, pq.ErrSSLKeyHasWorldPermissions),
+		errors.Is(err, pq.ErrSSLKeyUnknownOwnership):
+		return Wrap(err, CodeTLSError, message)
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		code, ok := pqCodes[pqErr.Code]
+		if !ok {
+			code, ok = pqClasses[pqErr.Code.Class()]
+		}
+		if !ok {
+			code = CodeQueryFailed
+		}
+		apiErr := Wrap(err, code, message).
+			WithDetail("pgCode", string(pqErr.Code))
+		if pqErr.Column != "" {
+			apiErr.WithDetail("field", pqErr.Column)
+		}
+		if pqErr.Table != "" {
+			apiErr.WithDetail("table", pqErr.Table)
+		}
+		return apiErr
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return Wrap(err, CodeTimeout, message)
+	}
+	if errors.Is(err, context.Canceled) {
+		return Wrap(err, CodeCanceled, message)
+	}
+
+	var certErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCertErr x509.CertificateInvalidError
+	if errors.As(err, &certErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidCertErr) {
+		return Wrap(err, CodeTLSError, message)
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return Wrap(err, CodeHostUnreachable, message).WithDetail("host", dnsErr.Name)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return Wrap(err, CodeTimeout, message)
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		apiErr := Wrap(err, CodeHostUnreachable, message).WithDetail("op", opErr.Op)
+		if opErr.Addr != nil {
+			apiErr.WithDetail("address", opErr.Addr.String())
+		}
+		return apiErr
+	}
+
+	return Wrap(err, CodeInternal, message)
+}
@@ -0,0 +1,133 @@
+// Package auth identifies API consumers
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"dbviewer-saas/config"
+	"dbviewer-saas/pkg/apierror"
+)
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	User string `json:"user"`
+	Team string `json:"team,omitempty"`
+}
+
+// Anonymous is the identity used when authentication is disabled
+var Anonymous = Identity{User: "anonymous"}
+
+type contextKey struct{}
+
+// WithIdentity returns a context carrying the identity
+func WithIdentity(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the identity of the request, or Anonymous
+func FromContext(ctx context.Context) Identity {
+	if id, ok := ctx.Value(contextKey{}).(Identity); ok {
+		return id
+	}
+	return Anonymous
+}
+
+// Authenticator checks bearer tokens against the configured users
+type Authenticator struct {
+	enabled bool
+	users   []config.UserConfig
+}
+
+// New creates an authenticator from the auth configuration
+func New(cfg config.AuthConfig) *Authenticator {
+	return &Authenticator{
+		enabled: cfg.Enabled,
+		users:   cfg.Users,
+	}
+}
+
+// Authenticate resolves the identity presenting token
+func (a *Authenticator) Authenticate(token string) (Identity, bool) {
+	var match *config.UserConfig
+	// Compare against every user so timing does not reveal which token matched
+	for i := range a.users {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.users[i].Token)) == 1 {
+			match = &a.users[i]
+		}
+	}
+	if match == nil {
+		return Identity{}, false
+	}
+	return Identity{User: match.Name, Team: match.Team}, true
+}
+
+// Middleware attaches the caller identity to the request and rejects unknown callers
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.enabled {
+			next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), Anonymous)))
+			return
+		}
+
+		// Preflight requests carry no credentials
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// A client certificate verified against the configured CA identifies the caller
+		if id, ok := certificateIdentity(r); ok {
+			next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+			return
+		}
+
+		token, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dbviewer"`)
+			apierror.Write(w, apierror.New(apierror.CodeUnauthenticated, "Missing bearer token"))
+			return
+		}
+
+		id, ok := a.Authenticate(token)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dbviewer", error="invalid_token"`)
+			apierror.Write(w, apierror.New(apierror.CodeUnauthenticated, "Invalid bearer token"))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+	})
+}
+
+// bearerToken extracts the token from the Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// certificateIdentity derives the identity from a verified client certificate:
+// the common name is the user and the first organizational unit the team
+func certificateIdentity(r *http.Request) (Identity, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Identity{}, false
+	}
+
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if subject.CommonName == "" {
+		return Identity{}, false
+	}
+
+	id := Identity{User: subject.CommonName}
+	if len(subject.OrganizationalUnit) > 0 {
+		id.Team = subject.OrganizationalUnit[0]
+	}
+	return id, true
+}
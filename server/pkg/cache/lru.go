@@ -0,0 +1,188 @@
+// Package cache provides a memory-bounded LRU cache for query metadata and results
+package cache
+
+import (
+	"container/list"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fixed per-entry bookkeeping cost added to every size estimate
+const entryOverhead = 128
+
+// Cache is a thread-safe LRU cache bounded by the estimated size of its entries
+type Cache struct {
+	mu        sync.Mutex
+	maxBytes  int64
+	usedBytes int64
+	ll        *list.List
+	items     map[string]*list.Element
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type entry struct {
+	key     string
+	value   interface{}
+	size    int64
+	expires time.Time
+}
+
+// Stats is a snapshot of cache usage
+type Stats struct {
+	Entries   int     `json:"entries"`
+	UsedBytes int64   `json:"usedBytes"`
+	MaxBytes  int64   `json:"maxBytes"`
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	Evictions uint64  `json:"evictions"`
+	HitRatio  float64 `json:"hitRatio"`
+}
+
+// New creates a cache holding at most maxBytes of estimated entry size
+func New(maxBytes int64) *Cache {
+	return &Cache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value stored under key and marks it as recently used
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		c.removeElement(el)
+		c.misses++
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	c.hits++
+	return e.value, true
+}
+
+// Set stores value under key. A zero ttl keeps the entry until it is evicted or invalidated.
+// Values larger than the whole cache are not stored.
+func (c *Cache) Set(key string, value interface{}, ttl time.Duration) {
+	size := EstimateSize(key, value)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if size > c.maxBytes {
+		return
+	}
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry)
+		c.usedBytes += size - e.size
+		e.value, e.size, e.expires = value, size, expires
+		c.ll.MoveToFront(el)
+	} else {
+		el := c.ll.PushFront(&entry{key: key, value: value, size: size, expires: expires})
+		c.items[key] = el
+		c.usedBytes += size
+	}
+
+	// Evict least recently used entries until we fit again
+	for c.usedBytes > c.maxBytes {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.removeElement(oldest)
+		c.evictions++
+	}
+}
+
+// Delete removes a single key and reports whether it was present
+func (c *Cache) Delete(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if ok {
+		c.removeElement(el)
+	}
+	return ok
+}
+
+// DeletePrefix removes every key starting with prefix and returns how many were removed
+func (c *Cache) DeletePrefix(prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for key, el := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			c.removeElement(el)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Purge removes every entry
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.usedBytes = 0
+}
+
+// Stats returns current usage counters
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := Stats{
+		Entries:   len(c.items),
+		UsedBytes: c.usedBytes,
+		MaxBytes:  c.maxBytes,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+	if total := c.hits + c.misses; total > 0 {
+		stats.HitRatio = float64(c.hits) / float64(total)
+	}
+	return stats
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	e := el.Value.(*entry)
+	c.ll.Remove(el)
+	delete(c.items, e.key)
+	c.usedBytes -= e.size
+}
+
+// EstimateSize approximates the memory held by an entry from its JSON encoding.
+// Decoded Go maps and interfaces take roughly twice their JSON size.
+func EstimateSize(key string, value interface{}) int64 {
+	size := int64(len(key) + entryOverhead)
+	if b, err := json.Marshal(value); err == nil {
+		size += int64(len(b)) * 2
+	}
+	return size
+}
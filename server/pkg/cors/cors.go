@@ -0,0 +1,269 @@
+// Package cors implements an allow-list based CORS policy for the API
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"dbviewer-saas/pkg/apierror"
+
+	"github.com/gorilla/mux"
+)
+
+// Methods probed against the router to answer preflight requests
+var candidateMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+// Options configures the CORS policy
+type Options struct {
+	// AllowedOrigins holds exact origins ("https://app.example.com"),
+	// wildcard subdomains ("https://*.example.com" or "*.example.com") or "*"
+	AllowedOrigins   []string
+	AllowCredentials bool
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	MaxAge           time.Duration
+}
+
+// Policy answers preflight requests and decorates responses for allowed origins
+type Policy struct {
+	opts      Options
+	router    *mux.Router
+	allowAll  bool
+	exact     map[string]bool
+	wildcards []wildcard
+	headers   map[string]bool
+}
+
+// wildcard matches any subdomain of suffix, optionally restricted to a scheme
+type wildcard struct {
+	scheme string
+	suffix string
+}
+
+// New creates a policy. The router is used to work out which methods each
+// route accepts when answering preflight requests. Origins that are not exact
+// origins, "*" or a wildcard in the first host label are rejected, as is "*"
+// combined with credentials.
+func New(opts Options, router *mux.Router) (*Policy, error) {
+	p := &Policy{
+		opts:    opts,
+		router:  router,
+		exact:   make(map[string]bool),
+		headers: make(map[string]bool),
+	}
+
+	for _, origin := range opts.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+		if origin == "*" {
+			if opts.AllowCredentials {
+				return nil, fmt.Errorf("origin \"*\" cannot be combined with credentials")
+			}
+			p.allowAll = true
+			continue
+		}
+
+		scheme, host, found := strings.Cut(origin, "://")
+		if !found {
+			scheme, host = "", origin
+		}
+		if !strings.Contains(host, "*") {
+			if !found {
+				return nil, fmt.Errorf("origin %q has no scheme", origin)
+			}
+			p.exact[origin] = true
+			continue
+		}
+		// Only the whole first host label may be a wildcard
+		suffix := strings.TrimPrefix(host, "*")
+		if !strings.HasPrefix(host, "*.") || len(suffix) < 2 || strings.Contains(suffix, "*") {
+			return nil, fmt.Errorf("origin %q: a wildcard must be the whole first host label, as in https://*.example.com", origin)
+		}
+		p.wildcards = append(p.wildcards, wildcard{scheme: scheme, suffix: suffix})
+	}
+
+	for _, header := range opts.AllowedHeaders {
+		p.headers[http.CanonicalHeaderKey(header)] = true
+	}
+
+	return p, nil
+}
+
+// Middleware applies the policy to every matched route
+func (p *Policy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+
+		// Responses differ per origin unless every origin gets the same answer
+		if !p.allowAll || p.opts.AllowCredentials {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed := p.originAllowed(origin)
+
+		if isPreflight(r) {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			if !allowed {
+				apierror.Write(w, apierror.New(apierror.CodeOriginNotAllowed, "Origin not allowed").
+					WithDetail("origin", origin))
+				return
+			}
+			p.handlePreflight(w, r, origin)
+			return
+		}
+
+		if !allowed {
+			// Browsers still send simple cross-site requests, so refuse anything
+			// that could change state instead of relying on the response being unreadable
+			if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+				apierror.Write(w, apierror.New(apierror.CodeOriginNotAllowed, "Origin not allowed").
+					WithDetail("origin", origin))
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p.setOriginHeaders(w, origin)
+		if len(p.opts.ExposedHeaders) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.opts.ExposedHeaders, ", "))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handlePreflight answers an OPTIONS preflight for an allowed origin
+func (p *Policy) handlePreflight(w http.ResponseWriter, r *http.Request, origin string) {
+	methods := p.routeMethods(r)
+	requested := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+
+	methodAllowed := false
+	for _, m := range methods {
+		if m == requested {
+			methodAllowed = true
+			break
+		}
+	}
+	if !methodAllowed {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		apierror.Write(w, apierror.New(apierror.CodeMethodNotAllowed, "Method not allowed for this route").
+			WithDetail("method", requested).
+			WithDetail("allowed", methods))
+		return
+	}
+
+	headers, ok := p.requestedHeaders(r)
+	if !ok {
+		apierror.Write(w, apierror.New(apierror.CodeOriginNotAllowed, "Request headers not allowed").
+			WithDetail("headers", r.Header.Get("Access-Control-Request-Headers")))
+		return
+	}
+
+	p.setOriginHeaders(w, origin)
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(headers) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	}
+	if p.opts.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(p.opts.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setOriginHeaders writes the allow-origin and credentials headers
+func (p *Policy) setOriginHeaders(w http.ResponseWriter, origin string) {
+	if p.allowAll && !p.opts.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.opts.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// originAllowed reports whether origin matches the allow-list
+func (p *Policy) originAllowed(origin string) bool {
+	if p.allowAll {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	if p.exact[origin] {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := u.Hostname()
+	for _, wc := range p.wildcards {
+		if wc.scheme != "" && wc.scheme != u.Scheme {
+			continue
+		}
+		// The wildcard covers subdomains only, not the bare domain
+		if strings.HasSuffix(host, wc.suffix) && len(host) > len(wc.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeMethods returns the methods the route under the request path accepts
+func (p *Policy) routeMethods(r *http.Request) []string {
+	var methods []string
+	for _, method := range candidateMethods {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+
+		var match mux.RouteMatch
+		if p.router.Match(probe, &match) && match.MatchErr == nil {
+			methods = append(methods, method)
+		}
+	}
+	return append(methods, http.MethodOptions)
+}
+
+// requestedHeaders checks the preflight's requested headers against the allow-list
+func (p *Policy) requestedHeaders(r *http.Request) ([]string, bool) {
+	raw := r.Header.Get("Access-Control-Request-Headers")
+	if raw == "" {
+		return nil, true
+	}
+
+	var headers []string
+	for _, h := range strings.Split(raw, ",") {
+		h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+		if h == "" {
+			continue
+		}
+		if len(p.headers) > 0 && !p.headers[h] {
+			return nil, false
+		}
+		headers = append(headers, h)
+	}
+	return headers, true
+}
+
+// isPreflight reports whether r is a CORS preflight request
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+}
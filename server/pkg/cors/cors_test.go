@@ -0,0 +1,267 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"dbviewer-saas/pkg/apierror"
+
+	"github.com/gorilla/mux"
+)
+
+// newRouter builds a router with the policy applied the way main does
+func newRouter(t *testing.T, opts Options) *mux.Router {
+	t.Helper()
+	r := mux.NewRouter()
+	r.NotFoundHandler = apierror.NotFoundHandler()
+	r.MethodNotAllowedHandler = apierror.MethodNotAllowedHandler()
+
+	policy, err := New(opts, r)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	r.Use(policy.Middleware)
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	r.HandleFunc("/api/tables", ok).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/tables/{table}", ok).Methods("GET", "POST", "OPTIONS")
+	return r
+}
+
+func TestMiddleware(t *testing.T) {
+	allowList := Options{
+		AllowedOrigins: []string{"https://app.example.com", "https://*.example.org"},
+		AllowedHeaders: []string{"Content-Type", "Authorization"},
+	}
+	credentials := Options{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowCredentials: true,
+	}
+
+	tests := []struct {
+		name    string
+		opts    Options
+		method  string
+		path    string
+		headers map[string]string
+		// wantStatus is the response status
+		wantStatus int
+		// wantHeaders maps response headers to their value; "" means absent
+		wantHeaders map[string]string
+		// wantVary lists values the Vary header must contain
+		wantVary []string
+	}{
+		{
+			name:        "exact origin",
+			opts:        allowList,
+			method:      "GET",
+			path:        "/api/tables",
+			headers:     map[string]string{"Origin": "https://app.example.com"},
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "https://app.example.com", "Access-Control-Allow-Credentials": ""},
+			wantVary:    []string{"Origin"},
+		},
+		{
+			name:        "wildcard origin",
+			opts:        allowList,
+			method:      "GET",
+			path:        "/api/tables",
+			headers:     map[string]string{"Origin": "https://eu.example.org"},
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "https://eu.example.org"},
+			wantVary:    []string{"Origin"},
+		},
+		{
+			name:        "wildcard does not cover the bare domain",
+			opts:        allowList,
+			method:      "GET",
+			path:        "/api/tables",
+			headers:     map[string]string{"Origin": "https://example.org"},
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": ""},
+			wantVary:    []string{"Origin"},
+		},
+		{
+			name:        "rejected origin reading",
+			opts:        allowList,
+			method:      "GET",
+			path:        "/api/tables",
+			headers:     map[string]string{"Origin": "https://evil.example.com"},
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": ""},
+			wantVary:    []string{"Origin"},
+		},
+		{
+			name:        "rejected origin writing",
+			opts:        allowList,
+			method:      "POST",
+			path:        "/api/tables/users",
+			headers:     map[string]string{"Origin": "https://evil.example.com"},
+			wantStatus:  http.StatusForbidden,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:   "preflight for an allowed origin",
+			opts:   allowList,
+			method: "OPTIONS",
+			path:   "/api/tables/users",
+			headers: map[string]string{
+				"Origin":                         "https://app.example.com",
+				"Access-Control-Request-Method":  "POST",
+				"Access-Control-Request-Headers": "content-type",
+			},
+			wantStatus: http.StatusNoContent,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":  "https://app.example.com",
+				"Access-Control-Allow-Methods": "GET, POST, OPTIONS",
+				"Access-Control-Allow-Headers": "Content-Type",
+			},
+			wantVary: []string{"Origin", "Access-Control-Request-Method"},
+		},
+		{
+			name:   "preflight from a rejected origin",
+			opts:   allowList,
+			method: "OPTIONS",
+			path:   "/api/tables/users",
+			headers: map[string]string{
+				"Origin":                        "https://evil.example.com",
+				"Access-Control-Request-Method": "POST",
+			},
+			wantStatus:  http.StatusForbidden,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": ""},
+			wantVary:    []string{"Origin"},
+		},
+		{
+			name:   "preflight for a method the route does not accept",
+			opts:   allowList,
+			method: "OPTIONS",
+			path:   "/api/tables",
+			headers: map[string]string{
+				"Origin":                        "https://app.example.com",
+				"Access-Control-Request-Method": "DELETE",
+			},
+			wantStatus:  http.StatusMethodNotAllowed,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "", "Allow": "GET, OPTIONS"},
+		},
+		{
+			name:   "preflight for a route that is not registered",
+			opts:   allowList,
+			method: "OPTIONS",
+			path:   "/api/nowhere",
+			headers: map[string]string{
+				"Origin":                        "https://app.example.com",
+				"Access-Control-Request-Method": "GET",
+			},
+			wantStatus:  http.StatusNotFound,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:   "preflight with a header that is not allowed",
+			opts:   allowList,
+			method: "OPTIONS",
+			path:   "/api/tables",
+			headers: map[string]string{
+				"Origin":                         "https://app.example.com",
+				"Access-Control-Request-Method":  "GET",
+				"Access-Control-Request-Headers": "X-Secret",
+			},
+			wantStatus:  http.StatusForbidden,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:       "credentials echo the origin",
+			opts:       credentials,
+			method:     "GET",
+			path:       "/api/tables",
+			headers:    map[string]string{"Origin": "https://app.example.com"},
+			wantStatus: http.StatusOK,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+			},
+			wantVary: []string{"Origin"},
+		},
+		{
+			name:       "credentials on preflight",
+			opts:       credentials,
+			method:     "OPTIONS",
+			path:       "/api/tables",
+			headers:    map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "GET"},
+			wantStatus: http.StatusNoContent,
+			wantHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+			},
+			wantVary: []string{"Origin"},
+		},
+		{
+			name:        "any origin",
+			opts:        Options{AllowedOrigins: []string{"*"}},
+			method:      "GET",
+			path:        "/api/tables",
+			headers:     map[string]string{"Origin": "https://anywhere.test"},
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": "*", "Vary": ""},
+		},
+		{
+			name:        "no origin",
+			opts:        allowList,
+			method:      "GET",
+			path:        "/api/tables",
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Access-Control-Allow-Origin": ""},
+			wantVary:    []string{"Origin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			newRouter(t, tt.opts).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (body %s)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			for header, want := range tt.wantHeaders {
+				if got := rec.Header().Get(header); got != want {
+					t.Errorf("%s = %q, want %q", header, got, want)
+				}
+			}
+			vary := strings.Join(rec.Header().Values("Vary"), ", ")
+			for _, want := range tt.wantVary {
+				if !strings.Contains(vary, want) {
+					t.Errorf("Vary = %q, want it to contain %s", vary, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewRejectsInvalidOrigins(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"wildcard inside a label", Options{AllowedOrigins: []string{"https://api-*.example.com"}}},
+		{"wildcard past the first label", Options{AllowedOrigins: []string{"https://api.*.example.com"}}},
+		{"second wildcard", Options{AllowedOrigins: []string{"*.example.*"}}},
+		{"bare wildcard label", Options{AllowedOrigins: []string{"https://*."}}},
+		{"exact origin without scheme", Options{AllowedOrigins: []string{"app.example.com"}}},
+		{"any origin with credentials", Options{AllowedOrigins: []string{"*"}, AllowCredentials: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.opts, mux.NewRouter()); err == nil {
+				t.Errorf("New(%v) succeeded, want an error", tt.opts.AllowedOrigins)
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Limits of an aggregation
+const (
+	maxGroupKeys         = 10
+	maxAggregates        = 20
+	defaultAggregateRows = 1000
+	maxAggregateRows     = 10000
+)
+
+// Time buckets a date or timestamp dimension can be truncated to
+var timeBuckets = map[string]bool{"hour": true, "day": true, "week": true, "month": true}
+
+// Aggregate functions and the column kinds they accept; count takes any
+// column or none
+var aggregateFuncs = map[string]func(kind string) bool{
+	"count":         func(string) bool { return true },
+	"countDistinct": func(string) bool { return true },
+	"sum":           func(kind string) bool { return kind == "number" },
+	"avg":           func(kind string) bool { return kind == "number" },
+	"min":           func(kind string) bool { return kind != "" },
+	"max":           func(kind string) bool { return kind != "" },
+}
+
+// GroupKey is a dimension of an aggregation, a column optionally truncated to a time bucket
+type GroupKey struct {
+	Column string `json:"column"`
+	Bucket string `json:"bucket,omitempty"`
+	Alias  string `json:"alias,omitempty"`
+}
+
+// Aggregate is a measure of an aggregation
+type Aggregate struct {
+	Func   string `json:"func"`
+	Column string `json:"column,omitempty"`
+	Alias  string `json:"alias,omitempty"`
+}
+
+// AggregateQuery groups the rows of a table matching Filter by GroupBy and
+// computes Aggregates for each group
+type AggregateQuery struct {
+	Table      string      `json:"table"`
+	GroupBy    []GroupKey  `json:"groupBy"`
+	Aggregates []Aggregate `json:"aggregates"`
+	Filter     *Filter     `json:"filter,omitempty"`
+	Limit      int         `json:"limit,omitempty"`
+}
+
+// ResultColumn describes a column of an aggregation result
+type ResultColumn struct {
+	Name string `json:"name"`
+	// Role is dimension or measure
+	Role   string `json:"role"`
+	Column string `json:"column,omitempty"`
+	Bucket string `json:"bucket,omitempty"`
+	Func   string `json:"func,omitempty"`
+}
+
+// AggregateResult is a tidy table: one row per group, one column per dimension and measure
+type AggregateResult struct {
+	Columns   []ResultColumn           `json:"columns"`
+	Rows      []map[string]interface{} `json:"rows"`
+	Truncated bool                     `json:"truncated"`
+}
+
+// Name returns the result column name of k
+func (k GroupKey) Name() string {
+	switch {
+	case k.Alias != "":
+		return k.Alias
+	case k.Bucket != "":
+		return k.Column + "_" + k.Bucket
+	default:
+		return k.Column
+	}
+}
+
+// Name returns the result column name of a
+func (a Aggregate) Name() string {
+	switch {
+	case a.Alias != "":
+		return a.Alias
+	case a.Column == "":
+		return a.Func
+	default:
+		return a.Func + "_" + a.Column
+	}
+}
+
+// groupExpr validates k against columns and returns its SQL expression
+func groupExpr(k GroupKey, field string, columns map[string]ColumnSchema, verr *ValidationError) string {
+	col, ok := columns[k.Column]
+	if !ok {
+		verr.add(field+".column", "unknown_column", "column %q does not exist", k.Column)
+		return ""
+	}
+	ident := pq.QuoteIdentifier(col.Name)
+	if k.Bucket == "" {
+		return ident
+	}
+	if !timeBuckets[k.Bucket] {
+		verr.add(field+".bucket", "invalid_value", "bucket must be hour, day, week or month")
+		return ""
+	}
+	if columnKind(col.DataType) != "date" {
+		verr.add(field+".bucket", "invalid_value", "only date and timestamp columns can be bucketed")
+		return ""
+	}
+	return fmt.Sprintf("date_trunc('%s', %s)", k.Bucket, ident)
+}
+
+// aggregateExpr validates a against columns and returns its SQL expression
+func aggregateExpr(a Aggregate, field string, columns map[string]ColumnSchema, verr *ValidationError) string {
+	accepts, ok := aggregateFuncs[a.Func]
+	if !ok {
+		verr.add(field+".func", "invalid_value", "func must be count, countDistinct, sum, avg, min or max")
+		return ""
+	}
+	if a.Column == "" {
+		if a.Func != "count" {
+			verr.add(field+".column", "required", "%s needs a column", a.Func)
+			return ""
+		}
+		return "count(*)"
+	}
+
+	col, ok := columns[a.Column]
+	if !ok {
+		verr.add(field+".column", "unknown_column", "column %q does not exist", a.Column)
+		return ""
+	}
+	if !accepts(columnKind(col.DataType)) {
+		verr.add(field+".column", "invalid_type", "%s does not apply to %s columns", a.Func, col.DataType)
+		return ""
+	}
+
+	ident := pq.QuoteIdentifier(col.Name)
+	if a.Func == "countDistinct" {
+		return "count(DISTINCT " + ident + ")"
+	}
+	return a.Func + "(" + ident + ")"
+}
+
+// Build returns the SQL of the aggregation and its arguments, checking every
+// identifier against schema. One row more than the limit is read to detect truncation.
+func (q AggregateQuery) Build(schema *TableSchema) (string, []interface{}, []ResultColumn, error) {
+	columns := columnsByName(schema)
+	verr := &ValidationError{}
+
+	if len(q.Aggregates) == 0 {
+		verr.add("aggregates", "required", "at least one aggregate is required")
+	}
+	if len(q.GroupBy) > maxGroupKeys {
+		verr.add("groupBy", "too_many", "at most %d group keys are allowed", maxGroupKeys)
+	}
+	if len(q.Aggregates) > maxAggregates {
+		verr.add("aggregates", "too_many", "at most %d aggregates are allowed", maxAggregates)
+	}
+	if q.Limit < 0 || q.Limit > maxAggregateRows {
+		verr.add("limit", "out_of_range", "limit must be between 1 and %d", maxAggregateRows)
+	}
+
+	names := make(map[string]bool)
+	unique := func(field, name string) {
+		if names[name] {
+			verr.add(field, "duplicate", "result column %q is defined twice; set an alias", name)
+		}
+		names[name] = true
+	}
+
+	var selected, groups []string
+	var result []ResultColumn
+	for i, k := range q.GroupBy {
+		field := fmt.Sprintf("groupBy[%d]", i)
+		expr := groupExpr(k, field, columns, verr)
+		unique(field, k.Name())
+		selected = append(selected, expr+" AS "+pq.QuoteIdentifier(k.Name()))
+		groups = append(groups, fmt.Sprint(i+1))
+		result = append(result, ResultColumn{Name: k.Name(), Role: "dimension", Column: k.Column, Bucket: k.Bucket})
+	}
+	for i, a := range q.Aggregates {
+		field := fmt.Sprintf("aggregates[%d]", i)
+		expr := aggregateExpr(a, field, columns, verr)
+		unique(field, a.Name())
+		selected = append(selected, expr+" AS "+pq.QuoteIdentifier(a.Name()))
+		result = append(result, ResultColumn{Name: a.Name(), Role: "measure", Column: a.Column, Func: a.Func})
+	}
+
+	where, _, args, _, whereErr := TableQuery{Table: q.Table, Filter: q.Filter}.where(schema)
+	if err := joinValidation(verr.errOrNil(), whereErr); err != nil {
+		return "", nil, nil, err
+	}
+
+	limit := q.Limit
+	if limit == 0 {
+		limit = defaultAggregateRows
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s%s", strings.Join(selected, ", "), pq.QuoteIdentifier(q.Table), where)
+	if len(groups) > 0 {
+		query += " GROUP BY " + strings.Join(groups, ", ") + " ORDER BY " + strings.Join(groups, ", ")
+	}
+	query += fmt.Sprintf(" LIMIT %d", limit+1)
+	return query, args, result, nil
+}
+
+// BuildAggregateQuery returns the SQL and arguments of an aggregation against the cached schema
+func (dm *DatabaseManager) BuildAggregateQuery(ctx context.Context, q AggregateQuery) (string, []interface{}, error) {
+	schema, err := dm.GetTableSchema(ctx, q.Table)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get schema: %w", err)
+	}
+	query, args, _, err := q.Build(schema)
+	return query, args, err
+}
+
+// Aggregate runs an aggregation of a table. Numeric measures keep their exact
+// value; bucketed dimensions are the start of their bucket.
+func (dm *DatabaseManager) Aggregate(ctx context.Context, q AggregateQuery) (_ *AggregateResult, err error) {
+	ctx, op := dm.startOp(ctx, "Aggregate", q.Table)
+	defer op.end(&err)
+	db, err := dm.db()
+	if err != nil {
+		return nil, err
+	}
+
+	schema, err := dm.GetTableSchema(ctx, q.Table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schema: %w", err)
+	}
+	query, args, columns, err := q.Build(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	op.statement(query)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate: %w", err)
+	}
+	defer rows.Close()
+
+	limit := q.Limit
+	if limit == 0 {
+		limit = defaultAggregateRows
+	}
+	numeric, err := numericColumns(rows)
+	if err != nil {
+		return nil, err
+	}
+	result := &AggregateResult{Columns: columns, Rows: make([]map[string]interface{}, 0)}
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if len(result.Rows) == limit {
+			result.Truncated = true
+			break
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, col := range columns {
+			row[col.Name] = resultValue(values[i], col.Role == "measure" && numeric[i])
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rows: %w", err)
+	}
+
+	op.returned(len(result.Rows))
+	return result, nil
+}
+
+// numericColumns reports which result columns are of type numeric, which the
+// driver returns as text
+func numericColumns(rows *sql.Rows) ([]bool, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read column types: %w", err)
+	}
+	numeric := make([]bool, len(types))
+	for i, t := range types {
+		numeric[i] = t.DatabaseTypeName() == "NUMERIC"
+	}
+	return numeric, nil
+}
+
+// resultValue converts a scanned value for JSON. Numeric measures arrive as
+// text and are kept exact as JSON numbers; other text, and numeric values
+// JSON cannot represent such as NaN, stay strings.
+func resultValue(v interface{}, numeric bool) interface{} {
+	b, ok := v.([]byte)
+	if !ok {
+		return v
+	}
+	if numeric && json.Valid(b) {
+		if _, err := strconv.ParseFloat(string(b), 64); err == nil || errors.Is(err, strconv.ErrRange) {
+			return json.Number(b)
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"dbviewer-saas/pkg/cache"
+)
+
+// Cache keys are namespaced by connection so a reconnect never serves another database's entries:
+//
+//	<conn>/tables
+//	<conn>/schema/<table>
+//	<conn>/count/<table>[/<filter digest>]
+//	<conn>/data/<table>/<page>/<pageSize>[/<filter and sort digest>]
+
+// cacheKey builds a key inside the current connection's namespace
+func (dm *DatabaseManager) cacheKey(parts ...string) string {
+	return dm.currentConnID() + "/" + strings.Join(parts, "/")
+}
+
+// currentConnID returns the cache namespace of the current connection
+func (dm *DatabaseManager) currentConnID() string {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.connID
+}
+
+// invalidateTableData drops cached reads of a table after it was written through the API
+func (dm *DatabaseManager) invalidateTableData(tableName string) {
+	dm.cache.Delete(dm.cacheKey("count", tableName))
+	dm.cache.DeletePrefix(dm.cacheKey("count", tableName) + "/")
+	dm.cache.DeletePrefix(dm.cacheKey("data", tableName) + "/")
+}
+
+// InvalidateCache drops cached metadata and results for a table, or for the
+// whole connection when tableName is empty. It returns the number of entries removed.
+func (dm *DatabaseManager) InvalidateCache(tableName string) int {
+	connID := dm.currentConnID()
+	if connID == "" {
+		return 0
+	}
+
+	if tableName == "" {
+		return dm.cache.DeletePrefix(connID + "/")
+	}
+
+	removed := 0
+	for _, key := range []string{
+		dm.cacheKey("tables"),
+		dm.cacheKey("schema", tableName),
+		dm.cacheKey("count", tableName),
+	} {
+		if dm.cache.Delete(key) {
+			removed++
+		}
+	}
+	removed += dm.cache.DeletePrefix(dm.cacheKey("count", tableName) + "/")
+	removed += dm.cache.DeletePrefix(dm.cacheKey("data", tableName) + "/")
+	return removed
+}
+
+// CacheStats returns usage counters of the metadata and result cache
+func (dm *DatabaseManager) CacheStats() cache.Stats {
+	return dm.cache.Stats()
+}
+
+// nextConnID returns a fresh cache namespace for a new connection. Callers hold dm.mu.
+func (dm *DatabaseManager) nextConnID() string {
+	dm.connGeneration++
+	return fmt.Sprintf("conn%d", dm.connGeneration)
+}
@@ -0,0 +1,521 @@
+package database
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ConnSpec is a parsed PostgreSQL connection specification. It is built from
+// a postgres:// URI, a libpq key=value string or the fields of a connection config.
+type ConnSpec struct {
+	Hosts    []HostPort `json:"hosts"`
+	User     string     `json:"user,omitempty"`
+	Password string     `json:"-"`
+	DBName   string     `json:"dbname,omitempty"`
+	// Params holds every other parameter, such as sslmode, application_name,
+	// options, connect_timeout or server settings like search_path
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// HostPort is one entry of a multi-host list
+type HostPort struct {
+	Host string `json:"host"`
+	Port string `json:"port"`
+}
+
+// Address returns host:port for dialing
+func (hp HostPort) Address() string {
+	return net.JoinHostPort(hp.Host, hp.Port)
+}
+
+// Target session attributes accepted in target_session_attrs
+var targetSessionAttrs = map[string]bool{
+	"any":            true,
+	"read-write":     true,
+	"read-only":      true,
+	"primary":        true,
+	"standby":        true,
+	"prefer-standby": true,
+}
+
+// Placeholder for withheld values in logs
+const redacted = "[REDACTED]"
+
+// Parameters naming files on the server. Certificates are uploaded or taken
+// from a profile instead, so clients cannot make the server read arbitrary paths.
+var fileParams = map[string]bool{
+	"sslcert":     true,
+	"sslkey":      true,
+	"sslrootcert": true,
+	"sslcrl":      true,
+	"sslcrldir":   true,
+	"passfile":    true,
+	"service":     true,
+	"sslinline":   true,
+}
+
+// libpq client options lib/pq does not implement. Passing them through would
+// send them to the server as unknown settings.
+var unsupportedParams = map[string]bool{
+	"hostaddr":                 true,
+	"channel_binding":          true,
+	"gssencmode":               true,
+	"gsslib":                   true,
+	"krbsrvname":               true,
+	"keepalives":               true,
+	"keepalives_idle":          true,
+	"keepalives_interval":      true,
+	"keepalives_count":         true,
+	"load_balance_hosts":       true,
+	"replication":              true,
+	"require_auth":             true,
+	"requiressl":               true,
+	"sslcompression":           true,
+	"sslpassword":              true,
+	"ssl_min_protocol_version": true,
+	"ssl_max_protocol_version": true,
+	"tcp_user_timeout":         true,
+}
+
+// ParseConnSpec parses a postgres:// (or postgresql://) URI or a libpq
+// key=value string. Syntax errors are reported against field; problems with
+// individual parameters are reported against the parameter name.
+func ParseConnSpec(field, s string) (*ConnSpec, error) {
+	s = strings.TrimSpace(s)
+	verr := &ValidationError{}
+
+	if s == "" {
+		verr.add(field, "required", "Connection string is required")
+		return nil, verr
+	}
+
+	var params map[string]string
+	var err error
+	lower := strings.ToLower(s)
+	switch {
+	case strings.HasPrefix(lower, "postgres://"), strings.HasPrefix(lower, "postgresql://"):
+		params, err = parseConnURI(s)
+	case strings.Contains(s, "="):
+		params, err = parseConnKeywords(s)
+	default:
+		err = fmt.Errorf("must be a postgres:// URI or a key=value connection string")
+	}
+	if err != nil {
+		verr.add(field, "invalid_format", "%v", err)
+		return nil, verr
+	}
+
+	return specFromParams(params)
+}
+
+// parseConnURI splits a connection URI into libpq parameters. net/url is not
+// used because it rejects multi-host lists and decodes '+' in the query.
+func parseConnURI(s string) (map[string]string, error) {
+	params := make(map[string]string)
+
+	rest := s[strings.Index(s, "://")+3:]
+	if i := strings.IndexByte(rest, '#'); i >= 0 {
+		rest = rest[:i]
+	}
+
+	query := ""
+	if i := strings.IndexByte(rest, '?'); i >= 0 {
+		rest, query = rest[:i], rest[i+1:]
+	}
+
+	authority, path := rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		authority, path = rest[:i], rest[i+1:]
+	}
+
+	// The password may itself contain '@' when not percent-encoded, so split at the last one
+	if i := strings.LastIndexByte(authority, '@'); i >= 0 {
+		userinfo := authority[:i]
+		authority = authority[i+1:]
+
+		user, password, hasPassword := strings.Cut(userinfo, ":")
+		decoded, err := url.PathUnescape(user)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user: %w", err)
+		}
+		params["user"] = decoded
+		if hasPassword {
+			decoded, err := url.PathUnescape(password)
+			if err != nil {
+				return nil, fmt.Errorf("invalid password encoding")
+			}
+			params["password"] = decoded
+		}
+	}
+
+	if authority != "" {
+		var hosts, ports []string
+		for _, entry := range strings.Split(authority, ",") {
+			host, port, err := splitURIHost(entry)
+			if err != nil {
+				return nil, err
+			}
+			hosts = append(hosts, host)
+			ports = append(ports, port)
+		}
+		params["host"] = strings.Join(hosts, ",")
+		if strings.Join(ports, "") != "" {
+			params["port"] = strings.Join(ports, ",")
+		}
+	}
+
+	if path != "" {
+		dbname, err := url.PathUnescape(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid database name: %w", err)
+		}
+		params["dbname"] = dbname
+	}
+
+	if query != "" {
+		for _, pair := range strings.Split(query, "&") {
+			if pair == "" {
+				continue
+			}
+			key, value, found := strings.Cut(pair, "=")
+			if !found {
+				return nil, fmt.Errorf("query parameter %q has no value", key)
+			}
+			key, err := url.PathUnescape(key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid query parameter %q", pair)
+			}
+			value, err = url.PathUnescape(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for query parameter %q", key)
+			}
+			params[key] = value
+		}
+	}
+
+	return params, nil
+}
+
+// splitURIHost splits one host[:port] entry of a URI, allowing [ipv6] literals
+// and percent-encoded socket paths
+func splitURIHost(entry string) (string, string, error) {
+	host, port := entry, ""
+	if strings.HasPrefix(entry, "[") {
+		end := strings.IndexByte(entry, ']')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated IPv6 address in %q", entry)
+		}
+		host = entry[1:end]
+		if rest := entry[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return "", "", fmt.Errorf("invalid host %q", entry)
+			}
+			port = rest[1:]
+		}
+	} else if i := strings.LastIndexByte(entry, ':'); i >= 0 {
+		host, port = entry[:i], entry[i+1:]
+	}
+
+	host, err := url.PathUnescape(host)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid host %q", entry)
+	}
+	return host, port, nil
+}
+
+// parseConnKeywords parses a libpq key=value string. Values may be single-quoted,
+// and a backslash escapes the next character inside or outside quotes.
+func parseConnKeywords(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	runes := []rune(s)
+	i := 0
+
+	skipSpace := func() {
+		for i < len(runes) && unicode.IsSpace(runes[i]) {
+			i++
+		}
+	}
+
+	for {
+		skipSpace()
+		if i >= len(runes) {
+			return params, nil
+		}
+
+		start := i
+		for i < len(runes) && runes[i] != '=' && !unicode.IsSpace(runes[i]) {
+			i++
+		}
+		key := string(runes[start:i])
+
+		skipSpace()
+		if i >= len(runes) || runes[i] != '=' {
+			return nil, fmt.Errorf("missing \"=\" after %q", key)
+		}
+		i++
+		skipSpace()
+
+		var value strings.Builder
+		if i < len(runes) && runes[i] == '\'' {
+			i++
+			closed := false
+			for i < len(runes) {
+				r := runes[i]
+				if r == '\\' && i+1 < len(runes) {
+					value.WriteRune(runes[i+1])
+					i += 2
+					continue
+				}
+				if r == '\'' {
+					closed = true
+					i++
+					break
+				}
+				value.WriteRune(r)
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated quoted value for %q", key)
+			}
+		} else {
+			for i < len(runes) && !unicode.IsSpace(runes[i]) {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value.WriteRune(runes[i])
+				i++
+			}
+		}
+
+		params[key] = value.String()
+	}
+}
+
+// requireLogin reports a missing user or database name against userField and
+// dbField, the request fields that could have supplied them
+func (s *ConnSpec) requireLogin(userField, dbField string) error {
+	verr := &ValidationError{}
+	if s.User == "" {
+		verr.add(userField, "required", "Username is required when the URL does not contain one")
+	}
+	if s.DBName == "" {
+		verr.add(dbField, "required", "Database name is required when the URL does not contain one")
+	}
+	return verr.errOrNil()
+}
+
+// specFromParams builds a spec from libpq parameters, checking each one
+func specFromParams(params map[string]string) (*ConnSpec, error) {
+	verr := &ValidationError{}
+	spec := &ConnSpec{
+		User:     params["user"],
+		Password: params["password"],
+		DBName:   params["dbname"],
+		Params:   make(map[string]string),
+	}
+
+	var hosts []string
+	if params["host"] != "" {
+		hosts = strings.Split(params["host"], ",")
+	}
+	var ports []string
+	if params["port"] != "" {
+		ports = strings.Split(params["port"], ",")
+	}
+
+	switch {
+	case len(hosts) == 0:
+		verr.add("host", "required", "Host is required")
+	case len(ports) > 1 && len(ports) != len(hosts):
+		verr.add("port", "invalid_value", "must list one port or one port per host (%d hosts, %d ports)", len(hosts), len(ports))
+	}
+	for i, host := range hosts {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			verr.add("host", "invalid_value", "host %d of the list is empty", i+1)
+			continue
+		}
+		port := "5432"
+		if len(ports) == 1 {
+			port = strings.TrimSpace(ports[0])
+		} else if i < len(ports) {
+			port = strings.TrimSpace(ports[i])
+		}
+		if port == "" {
+			port = "5432"
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			verr.add("port", "invalid_value", "%q is not a valid port", port)
+			continue
+		}
+		spec.Hosts = append(spec.Hosts, HostPort{Host: host, Port: port})
+	}
+
+	for key, value := range params {
+		switch {
+		case key == "host" || key == "port" || key == "user" || key == "password" || key == "dbname":
+			continue
+		case key == "":
+			verr.add("params", "invalid_format", "parameter names must not be empty")
+		case fileParams[key]:
+			verr.add(key, "not_allowed", "file parameters are not accepted; upload certificates in the ssl object or use an SSL profile")
+		case unsupportedParams[key]:
+			verr.add(key, "unsupported", "%s is not supported by this server", key)
+		case key == "sslmode":
+			switch value {
+			case SSLModeDisable, SSLModeAllow, SSLModePrefer, SSLModeRequire, SSLModeVerifyCA, SSLModeVerifyFull:
+			default:
+				verr.add(key, "invalid_value", "must be one of disable, allow, prefer, require, verify-ca or verify-full")
+			}
+		case key == "target_session_attrs":
+			if !targetSessionAttrs[value] {
+				verr.add(key, "invalid_value", "must be one of any, read-write, read-only, primary, standby or prefer-standby")
+			}
+		case key == "connect_timeout":
+			if n, err := strconv.Atoi(value); err != nil || n < 0 {
+				verr.add(key, "invalid_value", "must be a whole number of seconds")
+			}
+		}
+		spec.Params[key] = value
+	}
+
+	if err := verr.errOrNil(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// connParams returns the lib/pq parameters for one host of the spec. extra
+// parameters, such as the resolved SSL settings, override the spec's own.
+func (s *ConnSpec) connParams(hp HostPort, extra map[string]string) map[string]string {
+	params := map[string]string{
+		"host": hp.Host,
+		"port": hp.Port,
+	}
+	if s.User != "" {
+		params["user"] = s.User
+	}
+	if s.Password != "" {
+		params["password"] = s.Password
+	}
+	if s.DBName != "" {
+		params["dbname"] = s.DBName
+	}
+	for key, value := range s.Params {
+		// Handled by the manager rather than lib/pq
+		if key == "sslmode" || key == "target_session_attrs" {
+			continue
+		}
+		params[key] = value
+	}
+	for key, value := range extra {
+		params[key] = value
+	}
+	return params
+}
+
+// dsn returns a lib/pq key=value string for one host of the spec
+func (s *ConnSpec) dsn(hp HostPort, extra map[string]string) string {
+	return formatConnParams(s.connParams(hp, extra))
+}
+
+// redactedDSN is dsn with the password withheld, for logs. Both are built
+// from the same parameters, so the logged string is exactly what is sent.
+func (s *ConnSpec) redactedDSN(hp HostPort, extra map[string]string) string {
+	params := s.connParams(hp, extra)
+	if _, ok := params["password"]; ok {
+		params["password"] = redacted
+	}
+	return formatConnParams(params)
+}
+
+// LogValue renders the spec for structured logs without the password
+func (s *ConnSpec) LogValue() slog.Value {
+	hosts := make([]string, 0, len(s.Hosts))
+	for _, hp := range s.Hosts {
+		hosts = append(hosts, hp.Address())
+	}
+	attrs := []slog.Attr{
+		slog.String("hosts", strings.Join(hosts, ",")),
+		slog.String("user", s.User),
+		slog.String("dbname", s.DBName),
+	}
+	for _, key := range sortedParamKeys(s.Params) {
+		attrs = append(attrs, slog.String(key, s.Params[key]))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// formatConnParams joins parameters into a key=value string in key order
+func formatConnParams(params map[string]string) string {
+	parts := make([]string, 0, len(params))
+	for _, key := range sortedParamKeys(params) {
+		parts = append(parts, key+"="+connValue(params[key]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func sortedParamKeys(params map[string]string) []string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// connValue quotes a value for a key=value connection string
+func connValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \\'\t\n") {
+		return v
+	}
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
+
+// parseHostURL reads a host and optional port from a tunnel address such as
+// "0.tcp.ngrok.io:12345" or "tcp://0.tcp.ngrok.io:12345"
+func parseHostURL(field, raw string) (HostPort, error) {
+	verr := &ValidationError{}
+	raw = strings.TrimSpace(raw)
+
+	if strings.Contains(raw, "://") {
+		u, err := url.Parse(raw)
+		if err != nil {
+			verr.add(field, "invalid_format", "%v", err)
+			return HostPort{}, verr
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "tcp", "http", "https", "postgres", "postgresql":
+		default:
+			verr.add(field, "invalid_format", "unsupported scheme %q", u.Scheme)
+			return HostPort{}, verr
+		}
+		raw = u.Host
+	}
+
+	host, port, err := splitURIHost(raw)
+	if err != nil {
+		verr.add(field, "invalid_format", "%v", err)
+		return HostPort{}, verr
+	}
+	if host == "" {
+		verr.add(field, "required", "Host is required")
+		return HostPort{}, verr
+	}
+	if port == "" {
+		port = "5432"
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		verr.add(field, "invalid_value", "%q is not a valid port", port)
+		return HostPort{}, verr
+	}
+	return HostPort{Host: host, Port: port}, nil
+}
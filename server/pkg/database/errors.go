@@ -0,0 +1,142 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrNotConnected is returned when an operation needs a database connection and none is open
+	ErrNotConnected = errors.New("no database connection")
+	// ErrTableNotFound is returned when the requested table does not exist
+	ErrTableNotFound = errors.New("table not found")
+	// ErrRowNotFound is returned when a write matched no rows
+	ErrRowNotFound = errors.New("row not found")
+	// ErrTargetSessionAttrs is returned when no host satisfies target_session_attrs
+	ErrTargetSessionAttrs = errors.New("no server matches target_session_attrs")
+)
+
+// FieldError describes a problem with a single column of a write payload
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when a write payload does not match the table schema
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		messages = append(messages, fmt.Sprintf("%s: %s", f.Field, f.Message))
+	}
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+// add records a field error
+func (e *ValidationError) add(field, code, format string, args ...interface{}) {
+	e.Fields = append(e.Fields, FieldError{
+		Field:   field,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// errOrNil returns the validation error only if at least one field failed
+func (e *ValidationError) errOrNil() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// ConstraintError is returned when PostgreSQL rejects a write because of the data it contained
+type ConstraintError struct {
+	Kind       string `json:"kind"`
+	Field      string `json:"field,omitempty"`
+	Constraint string `json:"constraint,omitempty"`
+	Message    string `json:"message"`
+	PGCode     string `json:"pgCode"`
+	err        error
+}
+
+func (e *ConstraintError) Error() string {
+	return e.Message
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.err
+}
+
+// Conflict reports whether the error was caused by the state of other rows
+// (duplicate keys or dangling references) rather than the payload itself
+func (e *ConstraintError) Conflict() bool {
+	return e.Kind == "unique_violation" || e.Kind == "foreign_key_violation"
+}
+
+// constraintKinds maps the PostgreSQL error codes we translate to their kinds
+var constraintKinds = map[pq.ErrorCode]string{
+	"23502": "not_null_violation",
+	"23503": "foreign_key_violation",
+	"23505": "unique_violation",
+	"23514": "check_violation",
+	"22001": "string_data_right_truncation",
+	"22003": "numeric_value_out_of_range",
+	"22007": "invalid_datetime_format",
+	"22008": "datetime_field_overflow",
+	"22P02": "invalid_text_representation",
+	"42703": "undefined_column",
+}
+
+var (
+	// Matches the "Key (column)=(value)" detail of unique and foreign key violations
+	keyDetailPattern = regexp.MustCompile(`^Key \(([^)]+)\)=`)
+	// Matches the quoted column name of undefined column errors
+	columnMessagePattern = regexp.MustCompile(`column "([^"]+)"`)
+)
+
+// mapWriteError translates data-related PostgreSQL errors into a ConstraintError
+// carrying the offending field. Other errors are returned unchanged.
+func mapWriteError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	kind, ok := constraintKinds[pqErr.Code]
+	if !ok {
+		return err
+	}
+
+	field := pqErr.Column
+	if field == "" {
+		if m := keyDetailPattern.FindStringSubmatch(pqErr.Detail); m != nil {
+			field = m[1]
+		} else if pqErr.Code == "42703" {
+			if m := columnMessagePattern.FindStringSubmatch(pqErr.Message); m != nil {
+				field = m[1]
+			}
+		}
+	}
+
+	message := pqErr.Message
+	if pqErr.Detail != "" {
+		message = fmt.Sprintf("%s: %s", pqErr.Message, pqErr.Detail)
+	}
+
+	return &ConstraintError{
+		Kind:       kind,
+		Field:      field,
+		Constraint: pqErr.Constraint,
+		Message:    message,
+		PGCode:     string(pqErr.Code),
+		err:        err,
+	}
+}
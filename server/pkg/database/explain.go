@@ -0,0 +1,390 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Thresholds above which plan nodes are flagged as hotspots
+const (
+	// Sequential scans of tables with at least this many rows are flagged
+	largeTableRows = 10000
+	// Nodes whose actual rows differ from the estimate by this factor are flagged
+	misestimateFactor = 10
+)
+
+// Hotspot kinds reported in plans
+const (
+	HotspotSeqScan     = "seq_scan"
+	HotspotMisestimate = "misestimate"
+	HotspotSortSpill   = "sort_spill"
+)
+
+// ExplainOptions selects the EXPLAIN options besides FORMAT JSON
+type ExplainOptions struct {
+	Analyze bool `json:"analyze"`
+	Buffers bool `json:"buffers"`
+	Verbose bool `json:"verbose"`
+}
+
+// ExplainResult is a normalized query plan
+type ExplainResult struct {
+	Query         string         `json:"query"`
+	Options       ExplainOptions `json:"options"`
+	Plan          *PlanNode      `json:"plan"`
+	PlanningTime  *float64       `json:"planningTime,omitempty"`
+	ExecutionTime *float64       `json:"executionTime,omitempty"`
+	Hotspots      []Hotspot      `json:"hotspots"`
+}
+
+// PlanNode is one node of a plan tree. Times are in milliseconds and, like
+// row counts, are per loop as PostgreSQL reports them; actual values are only
+// set with ANALYZE.
+type PlanNode struct {
+	ID                 int                    `json:"id"`
+	NodeType           string                 `json:"nodeType"`
+	Relation           string                 `json:"relation,omitempty"`
+	Schema             string                 `json:"schema,omitempty"`
+	Alias              string                 `json:"alias,omitempty"`
+	Index              string                 `json:"index,omitempty"`
+	ParentRelationship string                 `json:"parentRelationship,omitempty"`
+	StartupCost        float64                `json:"startupCost"`
+	TotalCost          float64                `json:"totalCost"`
+	PlanRows           float64                `json:"planRows"`
+	PlanWidth          int                    `json:"planWidth"`
+	ActualStartupTime  *float64               `json:"actualStartupTime,omitempty"`
+	ActualTotalTime    *float64               `json:"actualTotalTime,omitempty"`
+	ActualRows         *float64               `json:"actualRows,omitempty"`
+	ActualLoops        *float64               `json:"actualLoops,omitempty"`
+	RowsRatio          *float64               `json:"rowsRatio,omitempty"`
+	SelfTime           *float64               `json:"selfTime,omitempty"`
+	Buffers            *PlanBuffers           `json:"buffers,omitempty"`
+	Hotspots           []Hotspot              `json:"hotspots,omitempty"`
+	Details            map[string]interface{} `json:"details,omitempty"`
+	Children           []*PlanNode            `json:"children,omitempty"`
+}
+
+// PlanBuffers counts the blocks a node touched, as reported with BUFFERS
+type PlanBuffers struct {
+	SharedHit     int64 `json:"sharedHit"`
+	SharedRead    int64 `json:"sharedRead"`
+	SharedDirtied int64 `json:"sharedDirtied"`
+	SharedWritten int64 `json:"sharedWritten"`
+	TempRead      int64 `json:"tempRead"`
+	TempWritten   int64 `json:"tempWritten"`
+}
+
+// Hotspot flags a plan node worth a closer look
+type Hotspot struct {
+	NodeID  int    `json:"nodeId"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// Explain returns the plan of a single SQL statement
+func (dm *DatabaseManager) Explain(ctx context.Context, statement string, opts ExplainOptions) (_ *ExplainResult, err error) {
+	ctx, op := dm.startOp(ctx, "Explain", "")
+	defer op.end(&err)
+
+	statement = strings.TrimRight(strings.TrimSpace(statement), "; \t\r\n")
+	if statement == "" {
+		verr := &ValidationError{}
+		verr.add("statement", "required", "a statement is required")
+		return nil, verr
+	}
+	return dm.explain(ctx, op, statement, nil, opts)
+}
+
+// ExplainTable returns the plan of the query GetTableDataPaginated runs for q
+func (dm *DatabaseManager) ExplainTable(ctx context.Context, q TableQuery, opts ExplainOptions) (_ *ExplainResult, err error) {
+	ctx, op := dm.startOp(ctx, "ExplainTable", q.Table)
+	defer op.end(&err)
+
+	query, args, err := dm.BuildTableQuery(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return dm.explain(ctx, op, query, args, opts)
+}
+
+// explain runs EXPLAIN in a transaction that is always rolled back, so
+// ANALYZE of INSERT, UPDATE or DELETE leaves the data untouched. The statement
+// is prepared, which makes PostgreSQL reject input holding several commands.
+func (dm *DatabaseManager) explain(ctx context.Context, op *operation, query string, args []interface{}, opts ExplainOptions) (*ExplainResult, error) {
+	db, err := dm.db()
+	if err != nil {
+		return nil, err
+	}
+
+	options := []string{"FORMAT JSON"}
+	if opts.Analyze {
+		options = append(options, "ANALYZE")
+	}
+	if opts.Buffers {
+		options = append(options, "BUFFERS")
+	}
+	if opts.Verbose {
+		options = append(options, "VERBOSE")
+	}
+	explainQuery := fmt.Sprintf("EXPLAIN (%s) %s", strings.Join(options, ", "), query)
+	op.statement(explainQuery)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, explainQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	var raw []byte
+	if err := stmt.QueryRowContext(ctx, args...).Scan(&raw); err != nil {
+		return nil, fmt.Errorf("failed to explain statement: %w", err)
+	}
+
+	var plans []map[string]interface{}
+	if err := json.Unmarshal(raw, &plans); err != nil {
+		return nil, fmt.Errorf("failed to parse plan: %w", err)
+	}
+	if len(plans) == 0 {
+		return nil, fmt.Errorf("failed to parse plan: empty output")
+	}
+
+	result := &ExplainResult{
+		Query:         query,
+		Options:       opts,
+		PlanningTime:  floatField(plans[0], "Planning Time"),
+		ExecutionTime: floatField(plans[0], "Execution Time"),
+		Hotspots:      []Hotspot{},
+	}
+	planJSON, ok := plans[0]["Plan"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("failed to parse plan: no plan in output")
+	}
+
+	nextID := 0
+	result.Plan = normalizePlan(planJSON, &nextID)
+
+	sizes, err := relationSizes(ctx, tx, result.Plan)
+	if err != nil {
+		return nil, err
+	}
+	result.Hotspots = flagHotspots(result.Plan, sizes, result.Hotspots)
+	return result, nil
+}
+
+// Plan keys copied into PlanNode fields rather than its details
+var normalizedPlanKeys = map[string]bool{
+	"Node Type": true, "Relation Name": true, "Schema": true, "Alias": true,
+	"Index Name": true, "Parent Relationship": true, "Startup Cost": true,
+	"Total Cost": true, "Plan Rows": true, "Plan Width": true,
+	"Actual Startup Time": true, "Actual Total Time": true, "Actual Rows": true,
+	"Actual Loops": true, "Plans": true,
+	"Shared Hit Blocks": true, "Shared Read Blocks": true, "Shared Dirtied Blocks": true,
+	"Shared Written Blocks": true, "Temp Read Blocks": true, "Temp Written Blocks": true,
+}
+
+// normalizePlan converts a node of PostgreSQL's JSON plan, numbering nodes depth first
+func normalizePlan(raw map[string]interface{}, nextID *int) *PlanNode {
+	node := &PlanNode{
+		ID:                 *nextID,
+		NodeType:           stringField(raw, "Node Type"),
+		Relation:           stringField(raw, "Relation Name"),
+		Schema:             stringField(raw, "Schema"),
+		Alias:              stringField(raw, "Alias"),
+		Index:              stringField(raw, "Index Name"),
+		ParentRelationship: stringField(raw, "Parent Relationship"),
+		ActualStartupTime:  floatField(raw, "Actual Startup Time"),
+		ActualTotalTime:    floatField(raw, "Actual Total Time"),
+		ActualRows:         floatField(raw, "Actual Rows"),
+		ActualLoops:        floatField(raw, "Actual Loops"),
+	}
+	*nextID++
+
+	if v := floatField(raw, "Startup Cost"); v != nil {
+		node.StartupCost = *v
+	}
+	if v := floatField(raw, "Total Cost"); v != nil {
+		node.TotalCost = *v
+	}
+	if v := floatField(raw, "Plan Rows"); v != nil {
+		node.PlanRows = *v
+	}
+	if v := floatField(raw, "Plan Width"); v != nil {
+		node.PlanWidth = int(*v)
+	}
+
+	if hit := floatField(raw, "Shared Hit Blocks"); hit != nil {
+		node.Buffers = &PlanBuffers{
+			SharedHit:     intField(raw, "Shared Hit Blocks"),
+			SharedRead:    intField(raw, "Shared Read Blocks"),
+			SharedDirtied: intField(raw, "Shared Dirtied Blocks"),
+			SharedWritten: intField(raw, "Shared Written Blocks"),
+			TempRead:      intField(raw, "Temp Read Blocks"),
+			TempWritten:   intField(raw, "Temp Written Blocks"),
+		}
+	}
+
+	for key, value := range raw {
+		if normalizedPlanKeys[key] {
+			continue
+		}
+		if node.Details == nil {
+			node.Details = make(map[string]interface{})
+		}
+		node.Details[key] = value
+	}
+
+	children, _ := raw["Plans"].([]interface{})
+	for _, c := range children {
+		if child, ok := c.(map[string]interface{}); ok {
+			node.Children = append(node.Children, normalizePlan(child, nextID))
+		}
+	}
+
+	if node.ActualRows != nil && node.ActualLoops != nil && *node.ActualLoops > 0 {
+		// Estimates of zero rows are clamped to one, as the planner does internally
+		ratio := *node.ActualRows / maxFloat(node.PlanRows, 1)
+		node.RowsRatio = &ratio
+
+		// Time spent in the node itself, excluding its children
+		self := *node.ActualTotalTime * *node.ActualLoops
+		for _, child := range node.Children {
+			if child.ActualTotalTime != nil && child.ActualLoops != nil {
+				self -= *child.ActualTotalTime * *child.ActualLoops
+			}
+		}
+		self = maxFloat(self, 0)
+		node.SelfTime = &self
+	}
+	return node
+}
+
+// relationSizes returns the estimated row counts of the tables scanned
+// sequentially in plan, keyed by schema-qualified name and, for tables on the
+// search path, by bare name
+func relationSizes(ctx context.Context, tx *sql.Tx, plan *PlanNode) (map[string]float64, error) {
+	var names []string
+	walkPlan(plan, func(n *PlanNode) {
+		if n.NodeType == "Seq Scan" && n.Relation != "" {
+			names = append(names, n.Relation)
+		}
+	})
+	sizes := make(map[string]float64)
+	if len(names) == 0 {
+		return sizes, nil
+	}
+
+	query := `
+		SELECT n.nspname, c.relname, c.reltuples, pg_catalog.pg_table_is_visible(c.oid)
+		FROM pg_catalog.pg_class c
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relname = ANY($1)
+	`
+	rows, err := tx.QueryContext(ctx, query, pq.Array(names))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get table sizes: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schema, name string
+		var tuples float64
+		var visible bool
+		if err := rows.Scan(&schema, &name, &tuples, &visible); err != nil {
+			return nil, fmt.Errorf("failed to scan table size: %w", err)
+		}
+		sizes[schema+"."+name] = tuples
+		if visible {
+			sizes[name] = tuples
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read table sizes: %w", err)
+	}
+	return sizes, nil
+}
+
+// flagHotspots marks sequential scans of large tables, row estimates off by
+// misestimateFactor or more and sorts that spilled to disk, appending each to all
+func flagHotspots(plan *PlanNode, sizes map[string]float64, all []Hotspot) []Hotspot {
+	walkPlan(plan, func(n *PlanNode) {
+		flag := func(kind, format string, args ...interface{}) {
+			h := Hotspot{NodeID: n.ID, Kind: kind, Message: fmt.Sprintf(format, args...)}
+			n.Hotspots = append(n.Hotspots, h)
+			all = append(all, h)
+		}
+
+		if n.NodeType == "Seq Scan" && n.Relation != "" {
+			key := n.Relation
+			if n.Schema != "" {
+				key = n.Schema + "." + n.Relation
+			}
+			// reltuples is -1 for tables never analyzed, so fall back to what the scan saw
+			tableRows := maxFloat(sizes[key], n.PlanRows)
+			if n.ActualRows != nil && n.ActualLoops != nil {
+				tableRows = maxFloat(tableRows, *n.ActualRows**n.ActualLoops)
+			}
+			if tableRows >= largeTableRows {
+				flag(HotspotSeqScan, "sequential scan of %s (about %.0f rows)", n.Relation, tableRows)
+			}
+		}
+
+		if n.RowsRatio != nil && *n.ActualLoops > 0 {
+			ratio := *n.RowsRatio
+			if ratio >= misestimateFactor || (ratio > 0 && ratio <= 1.0/misestimateFactor) || (ratio == 0 && n.PlanRows >= misestimateFactor) {
+				flag(HotspotMisestimate, "estimated %.0f rows, got %.0f", n.PlanRows, *n.ActualRows)
+			}
+		}
+
+		method, _ := n.Details["Sort Method"].(string)
+		spaceType, _ := n.Details["Sort Space Type"].(string)
+		if spaceType == "Disk" || strings.HasPrefix(method, "external") {
+			used, _ := n.Details["Sort Space Used"].(float64)
+			flag(HotspotSortSpill, "sort spilled to disk (%s, %.0f kB)", method, used)
+		}
+	})
+	return all
+}
+
+// walkPlan calls fn for every node, parents before children
+func walkPlan(n *PlanNode, fn func(*PlanNode)) {
+	fn(n)
+	for _, child := range n.Children {
+		walkPlan(child, fn)
+	}
+}
+
+func stringField(raw map[string]interface{}, key string) string {
+	s, _ := raw[key].(string)
+	return s
+}
+
+func floatField(raw map[string]interface{}, key string) *float64 {
+	f, ok := raw[key].(float64)
+	if !ok {
+		return nil
+	}
+	return &f
+}
+
+func intField(raw map[string]interface{}, key string) int64 {
+	f, _ := raw[key].(float64)
+	return int64(f)
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,270 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync"
+	"time"
+
+	"dbviewer-saas/config"
+)
+
+// ConnectionState is the health of the current database connection
+type ConnectionState string
+
+const (
+	StateDisconnected ConnectionState = "disconnected"
+	StateHealthy      ConnectionState = "healthy"
+	StateDegraded     ConnectionState = "degraded"
+	StateDown         ConnectionState = "down"
+)
+
+// Consecutive failed checks after which a connection counts as down
+const downAfterFailures = 3
+
+// First retry delay after a failed check; it doubles up to HealthMaxBackoff
+const minHealthBackoff = time.Second
+
+// HealthStatus is a snapshot of the connection health
+type HealthStatus struct {
+	State               ConnectionState `json:"state"`
+	Host                string          `json:"host,omitempty"`
+	LatencyMs           float64         `json:"latencyMs"`
+	LastCheck           *time.Time      `json:"lastCheck,omitempty"`
+	LastSuccess         *time.Time      `json:"lastSuccess,omitempty"`
+	LastError           string          `json:"lastError,omitempty"`
+	ConsecutiveFailures int             `json:"consecutiveFailures"`
+	Reconnects          int             `json:"reconnects"`
+	NextCheck           *time.Time      `json:"nextCheck,omitempty"`
+	Tunnel              *TunnelStatus   `json:"tunnel,omitempty"`
+}
+
+// healthMonitor pings one connection on an interval, backing off while it fails
+type healthMonitor struct {
+	db        *sql.DB
+	tunnel    *sshTunnel
+	resources *config.SystemResources
+	hub       *healthHub
+
+	mu     sync.Mutex
+	status HealthStatus
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newHealthMonitor prepares monitoring of db, which was just verified by a ping
+func newHealthMonitor(db *sql.DB, tunnel *sshTunnel, host string, resources *config.SystemResources, hub *healthHub) *healthMonitor {
+	now := time.Now()
+	return &healthMonitor{
+		db:        db,
+		tunnel:    tunnel,
+		resources: resources,
+		hub:       hub,
+		status: HealthStatus{
+			State:       StateHealthy,
+			Host:        host,
+			LastCheck:   &now,
+			LastSuccess: &now,
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// start begins the checks and announces the new connection
+func (m *healthMonitor) start() {
+	go m.run()
+	m.hub.publish(m.Status())
+}
+
+// run schedules checks until the monitor is stopped
+func (m *healthMonitor) run() {
+	defer close(m.done)
+
+	delay := m.resources.HealthCheckInterval
+	for {
+		next := time.Now().Add(delay)
+		m.mu.Lock()
+		m.status.NextCheck = &next
+		m.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-m.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		delay = m.check()
+	}
+}
+
+// check pings the database once, records the result and returns the delay before the next check
+func (m *healthMonitor) check() time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), m.resources.HealthCheckTimeout)
+	start := time.Now()
+	err := m.db.PingContext(ctx)
+	latency := time.Since(start)
+	cancel()
+
+	now := time.Now()
+	m.mu.Lock()
+	previous := m.status.State
+	m.status.LastCheck = &now
+
+	if err == nil {
+		if m.status.ConsecutiveFailures > 0 {
+			m.status.Reconnects++
+		}
+		m.status.ConsecutiveFailures = 0
+		m.status.LastError = ""
+		m.status.LastSuccess = &now
+		m.status.LatencyMs = float64(latency.Microseconds()) / 1000
+		m.status.State = StateHealthy
+		if m.resources.HealthDegradedLatency > 0 && latency > m.resources.HealthDegradedLatency {
+			m.status.State = StateDegraded
+		}
+	} else {
+		m.status.ConsecutiveFailures++
+		m.status.LastError = err.Error()
+		m.status.State = StateDegraded
+		if m.status.ConsecutiveFailures >= downAfterFailures {
+			m.status.State = StateDown
+		}
+	}
+	state := m.status.State
+	failures := m.status.ConsecutiveFailures
+	m.mu.Unlock()
+
+	if state != previous {
+		if err != nil {
+			slog.Warn("Database connection state changed", "state", state, "error", err)
+		} else {
+			slog.Info("Database connection state changed", "state", state, "latency", latency)
+		}
+	}
+	m.hub.publish(m.Status())
+
+	if err == nil {
+		return m.resources.HealthCheckInterval
+	}
+
+	// Pooled connections to a restarted server or a dead tunnel are all broken;
+	// dropping the idle ones makes the next ping dial a fresh connection
+	m.db.SetMaxIdleConns(0)
+	m.db.SetMaxIdleConns(m.resources.MaxIdleConnections)
+
+	delay := minHealthBackoff << (failures - 1)
+	if delay > m.resources.HealthMaxBackoff || delay <= 0 {
+		delay = m.resources.HealthMaxBackoff
+	}
+	return delay
+}
+
+// Status returns a snapshot including the tunnel health
+func (m *healthMonitor) Status() HealthStatus {
+	m.mu.Lock()
+	status := m.status
+	m.mu.Unlock()
+
+	if m.tunnel != nil {
+		tunnel := m.tunnel.Status()
+		status.Tunnel = &tunnel
+	}
+	return status
+}
+
+// Stop ends monitoring and waits for an in-flight check to finish
+func (m *healthMonitor) Stop() {
+	if m == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+}
+
+// healthHub fans health updates out to stream subscribers. It outlives
+// individual connections so streams keep working across reconnects.
+type healthHub struct {
+	mu     sync.Mutex
+	subs   map[chan HealthStatus]struct{}
+	closed bool
+}
+
+func newHealthHub() *healthHub {
+	return &healthHub{subs: make(map[chan HealthStatus]struct{})}
+}
+
+// subscribe returns a channel of updates and a function to unsubscribe. The
+// channel holds only the latest update and is closed when the hub shuts down.
+func (h *healthHub) subscribe() (<-chan HealthStatus, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan HealthStatus, 1)
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	h.subs[ch] = struct{}{}
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish delivers status to every subscriber, replacing an unread older update
+func (h *healthHub) publish(status HealthStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- status
+	}
+}
+
+// close ends every subscription
+func (h *healthHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// HealthStatus returns the health of the current connection
+func (dm *DatabaseManager) HealthStatus() HealthStatus {
+	dm.mu.RLock()
+	monitor := dm.monitor
+	dm.mu.RUnlock()
+
+	if monitor == nil {
+		return HealthStatus{State: StateDisconnected}
+	}
+	return monitor.Status()
+}
+
+// SubscribeHealth streams health updates of whichever connection is current
+func (dm *DatabaseManager) SubscribeHealth() (<-chan HealthStatus, func()) {
+	return dm.health.subscribe()
+}
+
+// CloseHealthSubscribers ends every health stream so shutdown does not wait on them
+func (dm *DatabaseManager) CloseHealthSubscribers() {
+	dm.health.close()
+}
@@ -0,0 +1,244 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// QueryObserver receives the duration and outcome of a database operation
+type QueryObserver func(operation string, duration time.Duration, err error)
+
+// SetQueryObserver registers fn to be told about every operation. It must be
+// called before the manager is used.
+func (dm *DatabaseManager) SetQueryObserver(fn QueryObserver) {
+	dm.observer = fn
+}
+
+var tracer = otel.Tracer("dbviewer-saas/pkg/database")
+
+// operation is one traced and timed DatabaseManager call
+type operation struct {
+	dm    *DatabaseManager
+	name  string
+	start time.Time
+	span  trace.Span
+}
+
+// startOp opens a client span for a manager call; table, when set, names the
+// table it works on. Queries must use the returned context so they run inside the span.
+func (dm *DatabaseManager) startOp(ctx context.Context, name, table string) (context.Context, *operation) {
+	spanName := name
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system.name", "postgresql"),
+		attribute.String("db.operation.name", name),
+	}
+	if table != "" {
+		spanName += " " + table
+		attrs = append(attrs, attribute.String("db.collection.name", table))
+	}
+
+	ctx, span := tracer.Start(ctx, spanName, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	return ctx, &operation{dm: dm, name: name, start: time.Now(), span: span}
+}
+
+// statement records the SQL the operation runs, with literals replaced by ?
+func (op *operation) statement(query string) {
+	op.span.SetAttributes(attribute.String("db.query.text", sanitizeSQL(query)))
+}
+
+// returned records how many rows a read produced
+func (op *operation) returned(n int) {
+	op.span.SetAttributes(attribute.Int("db.response.returned_rows", n))
+}
+
+// affected records how many rows a write changed
+func (op *operation) affected(n int64) {
+	op.span.SetAttributes(attribute.Int64("db.response.affected_rows", n))
+}
+
+// cacheHit marks an operation answered from the cache without a query
+func (op *operation) cacheHit() {
+	op.span.SetAttributes(attribute.Bool("dbviewer.cache.hit", true))
+}
+
+// end reports the outcome to the observer and closes the span; err points at
+// the named error result of the call
+func (op *operation) end(err *error) {
+	if op.dm.observer != nil {
+		op.dm.observer(op.name, time.Since(op.start), *err)
+	}
+	if *err != nil {
+		// Error messages can quote row values, e.g. the key of a unique
+		// violation, so only the kind of error is recorded
+		kind := errorKind(*err)
+		op.span.SetAttributes(attribute.String("error.type", kind))
+		op.span.SetStatus(codes.Error, kind)
+	}
+	op.span.End()
+}
+
+// errorKind names the class of err without its message: the SQLSTATE of
+// server errors, the sentinel or type of the others
+func errorKind(err error) string {
+	var pqErr *pq.Error
+	var constraintErr *ConstraintError
+	var validationErr *ValidationError
+	var tunnelErr *TunnelError
+	switch {
+	case errors.As(err, &constraintErr):
+		return constraintErr.PGCode
+	case errors.As(err, &pqErr):
+		return string(pqErr.Code)
+	case errors.As(err, &validationErr):
+		return "validation_failed"
+	case errors.As(err, &tunnelErr):
+		return "tunnel_" + tunnelErr.Stage
+	case errors.Is(err, ErrNotConnected):
+		return "not_connected"
+	case errors.Is(err, ErrTableNotFound):
+		return "table_not_found"
+	case errors.Is(err, ErrRowNotFound):
+		return "row_not_found"
+	case errors.Is(err, ErrTargetSessionAttrs):
+		return "target_session_attrs"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	// The type of the innermost error, e.g. *net.OpError
+	for next := errors.Unwrap(err); next != nil; next = errors.Unwrap(err) {
+		err = next
+	}
+	return fmt.Sprintf("%T", err)
+}
+
+// sanitizeSQL replaces string and numeric literals with ? and collapses
+// whitespace, so statements can be recorded without the data they carry.
+// Escape strings (E'...'), bit strings and dollar-quoted bodies count as
+// literals and comments are dropped; quoted identifiers and $n placeholders
+// are kept. Literals are found the way scanNamed finds them.
+func sanitizeSQL(query string) string {
+	var b strings.Builder
+	b.Grow(len(query))
+	space := false
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = b.Len() > 0
+			continue
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			for i+1 < len(query) && query[i+1] != '\n' {
+				i++
+			}
+			space = b.Len() > 0
+			continue
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			i = blockCommentEnd(query, i) - 1
+			space = b.Len() > 0
+			continue
+		case c == '\'':
+			i = quotedEnd(query, i, c, false) - 1
+			c = '?'
+		case strings.IndexByte("EeBbXx", c) >= 0 && i+1 < len(query) && query[i+1] == '\'' && !identChar(query, i-1):
+			// E'...' takes backslash escapes; B'...' and X'...' are bit strings
+			i = quotedEnd(query, i+1, '\'', c == 'E' || c == 'e') - 1
+			c = '?'
+		case c == '$' && !identChar(query, i-1) && !(i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9'):
+			tag, ok := dollarTag(query, i)
+			if !ok {
+				break
+			}
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				i = len(query) - 1
+			} else {
+				i += end + 2*len(tag) - 1
+			}
+			c = '?'
+		case c == '"':
+			// Quoted identifiers are copied unchanged
+			end := quotedEnd(query, i, c, false)
+			if space {
+				b.WriteByte(' ')
+				space = false
+			}
+			b.WriteString(query[i:end])
+			i = end - 1
+			continue
+		case c >= '0' && c <= '9' && !identChar(query, i-1):
+			for i+1 < len(query) && (query[i+1] >= '0' && query[i+1] <= '9' || query[i+1] == '.') {
+				i++
+			}
+			c = '?'
+		}
+
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// identChar reports whether query[i] continues an identifier or a $n placeholder
+func identChar(query string, i int) bool {
+	if i < 0 {
+		return false
+	}
+	c := query[i]
+	return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// PoolStats returns the statistics of each connection pool: "default" is the
+// pool created with the manager and "current" the connection users browse
+func (dm *DatabaseManager) PoolStats() map[string]sql.DBStats {
+	stats := map[string]sql.DBStats{"default": dm.pool.Stats()}
+	if db, err := dm.db(); err == nil {
+		stats["current"] = db.Stats()
+	}
+	return stats
+}
+
+// SessionCounts returns the number of server sessions on the current database by state
+func (dm *DatabaseManager) SessionCounts(ctx context.Context) (map[string]int, error) {
+	db, err := dm.db()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT COALESCE(state, 'unknown'), COUNT(*)
+		FROM pg_stat_activity
+		WHERE datname = current_database()
+		GROUP BY 1
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var state string
+		var count int
+		if err := rows.Scan(&state, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan sessions: %w", err)
+		}
+		counts[state] = count
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,85 @@
+package database
+
+import "testing"
+
+func TestSanitizeSQL(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{
+			name:  "numbers",
+			query: "SELECT * FROM users WHERE id = 42 AND score > 1.5",
+			want:  "SELECT * FROM users WHERE id = ? AND score > ?",
+		},
+		{
+			name:  "whitespace collapsed",
+			query: "  SELECT  a,\n\tb\r\nFROM t  ",
+			want:  "SELECT a, b FROM t",
+		},
+		{
+			name:  "digits in identifiers",
+			query: "SELECT col2 FROM t1 JOIN t_2 ON t1.id = t_2.id",
+			want:  "SELECT col2 FROM t1 JOIN t_2 ON t1.id = t_2.id",
+		},
+		{
+			name:  "string with doubled quote",
+			query: "SELECT * FROM t WHERE name = 'O''Brien'",
+			want:  "SELECT * FROM t WHERE name = ?",
+		},
+		{
+			name:  "escape strings",
+			query: `SELECT E'it\'s', e'\\', 'x'`,
+			want:  "SELECT ?, ?, ?",
+		},
+		{
+			name:  "bit strings",
+			query: "SELECT B'1010', b'1', X'1F', x'ff'",
+			want:  "SELECT ?, ?, ?, ?",
+		},
+		{
+			name:  "identifier ending in a string prefix",
+			query: "SELECT type FROM t WHERE code = 'x'",
+			want:  "SELECT type FROM t WHERE code = ?",
+		},
+		{
+			name:  "quoted identifiers kept",
+			query: `SELECT "secret 'x' 42", "a""b" FROM "T1"`,
+			want:  `SELECT "secret 'x' 42", "a""b" FROM "T1"`,
+		},
+		{
+			name:  "dollar quotes",
+			query: "SELECT $$it's 42$$, $tag$ a $$ b $tag$",
+			want:  "SELECT ?, ?",
+		},
+		{
+			name:  "placeholders kept",
+			query: "SELECT * FROM t WHERE a = $1 AND b = $12",
+			want:  "SELECT * FROM t WHERE a = $1 AND b = $12",
+		},
+		{
+			name:  "line comment",
+			query: "SELECT 1 -- secret 'x'\nFROM t",
+			want:  "SELECT ? FROM t",
+		},
+		{
+			name:  "nested block comment",
+			query: "/* lead */ SELECT a /* outer /* inner */ 'c' */ FROM t",
+			want:  "SELECT a FROM t",
+		},
+		{
+			name:  "unterminated literal",
+			query: "SELECT 'abc",
+			want:  "SELECT ?",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeSQL(tt.query); got != tt.want {
+				t.Errorf("sanitizeSQL(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
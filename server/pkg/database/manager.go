@@ -3,52 +3,87 @@ package database
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	"dbviewer-saas/config"
+	"dbviewer-saas/pkg/cache"
 
 	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // ConnectionConfig represents database connection parameters for ngrok connections
 type ConnectionConfig struct {
-	URL      string `json:"url"`
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Database string `json:"database"`
-}
-
-// DirectConnectionConfig represents direct database connection parameters
-type DirectConnectionConfig struct {
-	Host     string `json:"host"`
-	Port     string `json:"port"`
-	User     string `json:"user"`
-	Password string `json:"password"`
-	DBName   string `json:"dbname"`
-	SSLMode  string `json:"sslmode"`
+	URL      string           `json:"url"`
+	Username string           `json:"username"`
+	Password string           `json:"password"`
+	Database string           `json:"database"`
+	SSL      SSLConfig        `json:"ssl"`
+	SSH      *SSHTunnelConfig `json:"ssh,omitempty"`
 }
 
 // DatabaseManager handles all database operations
 type DatabaseManager struct {
 	pool      *sql.DB
 	resources *config.SystemResources
+
+	// mu guards currentDB and connID, which change on reconnect while requests are in flight
+	mu        sync.RWMutex
 	currentDB *sql.DB
+	profile   ConnectionProfile
+	ssl       *sslSettings
+	tunnel    *sshTunnel
+	monitor   *healthMonitor
+
+	// health fans connection health out to status streams across reconnects
+	health *healthHub
+
+	// Certificate sets from the server configuration, referenced by name
+	sslProfiles map[string]config.SSLProfile
+	// Fallback host keys for bastions when a tunnel config carries none
+	sshKnownHostsFile string
+
+	// observer receives the latency of every operation, e.g. for metrics
+	observer QueryObserver
+
+	// Metadata and result cache, namespaced by connID
+	cache          *cache.Cache
+	connID         string
+	connGeneration uint64
+}
+
+// ConnectionProfile identifies the database a connection points at, without credentials
+type ConnectionProfile struct {
+	Host     string `json:"host"`
+	Database string `json:"database"`
+	User     string `json:"user"`
+}
+
+func (p ConnectionProfile) String() string {
+	return fmt.Sprintf("%s@%s/%s", p.User, p.Host, p.Database)
 }
 
 // TableSchema represents the structure of a database table
 type TableSchema struct {
 	Columns []ColumnSchema `json:"columns"`
+	// TrigramColumns have a pg_trgm index that quick search can use
+	TrigramColumns []string `json:"trigramColumns,omitempty"`
 }
 
 type ColumnSchema struct {
-	Name       string `json:"name"`
-	DataType   string `json:"dataType"`
-	IsNullable bool   `json:"isNullable"`
-	IsPrimary  bool   `json:"isPrimary"`
+	Name        string   `json:"name"`
+	DataType    string   `json:"dataType"`
+	IsNullable  bool     `json:"isNullable"`
+	IsPrimary   bool     `json:"isPrimary"`
+	MaxLength   *int     `json:"maxLength,omitempty"`
+	HasDefault  bool     `json:"hasDefault"`
+	IsGenerated bool     `json:"isGenerated"`
+	EnumValues  []string `json:"enumValues,omitempty"`
 }
 
 // NewDatabaseManager creates a new database manager instance
@@ -62,131 +97,285 @@ func NewDatabaseManager(connStr string, resources *config.SystemResources) (*Dat
 	// Configure pool based on CPU cores
 	db.SetMaxOpenConns(resources.MaxConnections)
 	db.SetMaxIdleConns(resources.MaxIdleConnections)
-	db.SetConnMaxLifetime(15 * time.Minute)
+	db.SetConnMaxLifetime(resources.ConnMaxLifetime)
 
 	return &DatabaseManager{
 		pool:      db,
 		resources: resources,
+		cache:     cache.New(int64(resources.CacheSize) * 1024 * 1024),
+		health:    newHealthHub(),
 	}, nil
 }
 
-// Close closes all connections
+// Close closes the current database connection and the pool
 func (dm *DatabaseManager) Close() error {
-	return dm.pool.Close()
+	dm.mu.Lock()
+	db, ssl, tunnel, monitor := dm.currentDB, dm.ssl, dm.tunnel, dm.monitor
+	dm.currentDB, dm.ssl, dm.tunnel, dm.monitor = nil, nil, nil, nil
+	dm.mu.Unlock()
+
+	monitor.Stop()
+	var errs []error
+	if db != nil {
+		errs = append(errs, db.Close())
+	}
+	ssl.remove()
+	tunnel.Close()
+	dm.health.publish(HealthStatus{State: StateDisconnected})
+
+	errs = append(errs, dm.pool.Close())
+	return errors.Join(errs...)
 }
 
-// sanitizeHostURL removes any protocol prefixes and ensures the URL is suitable for PostgreSQL connections
-func sanitizeHostURL(inputURL string) string {
-	// Remove common protocol prefixes
-	prefixes := []string{"http://", "https://", "tcp://", "postgres://", "postgresql://"}
-	url := inputURL
+// db returns the current connection, or ErrNotConnected
+func (dm *DatabaseManager) db() (*sql.DB, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
 
-	for _, prefix := range prefixes {
-		if strings.HasPrefix(strings.ToLower(url), prefix) {
-			url = strings.TrimPrefix(url, prefix)
-			break // Only remove one prefix
-		}
+	if dm.currentDB == nil {
+		return nil, ErrNotConnected
 	}
-
-	return url
+	return dm.currentDB, nil
 }
 
 // Connect establishes a connection to the specified database
-func (dm *DatabaseManager) Connect(connConfig ConnectionConfig) error {
+func (dm *DatabaseManager) Connect(ctx context.Context, connConfig ConnectionConfig) (*TLSInfo, error) {
 	// For ngrok connections, we want to use the ngrok URL directly,
-	// as it's already configured to forward to the user's local PostgreSQL instance
-
-	// Clean the URL by removing any protocol prefixes
-	url := sanitizeHostURL(connConfig.URL)
-
-	// Log connection details (without password)
-	log.Printf("Connection attempt details:")
-	log.Printf("- Database Name: %s", connConfig.Database)
-	log.Printf("- Username: %s", connConfig.Username)
-	log.Printf("- Ngrok URL: %s", connConfig.URL)
-	log.Printf("- Sanitized host: %s", url)
-
-	// Build connection string using the ngrok URL as the host
-	// No need to specify port as it's included in the ngrok URL
-	connStr := fmt.Sprintf(
-		"postgres://%s:%s@%s/%s?sslmode=disable",
-		connConfig.Username,
-		connConfig.Password,
-		url,
-		connConfig.Database,
-	)
+	// as it's already configured to forward to the user's local PostgreSQL instance.
+	// A full postgres:// URI or key=value string is accepted as well.
+	var spec *ConnSpec
+	raw := strings.TrimSpace(connConfig.URL)
+	lower := strings.ToLower(raw)
+	if strings.HasPrefix(lower, "postgres://") || strings.HasPrefix(lower, "postgresql://") ||
+		(!strings.Contains(raw, "://") && strings.Contains(raw, "=")) {
+		parsed, err := ParseConnSpec("url", connConfig.URL)
+		if err != nil {
+			return nil, err
+		}
+		spec = parsed
+	} else {
+		hp, err := parseHostURL("url", connConfig.URL)
+		if err != nil {
+			return nil, err
+		}
+		spec = &ConnSpec{Hosts: []HostPort{hp}, Params: make(map[string]string)}
+	}
 
-	// Log the connection string (with password masked)
-	maskedConnStr := fmt.Sprintf(
-		"postgres://%s:xxxxx@%s/%s?sslmode=disable",
-		connConfig.Username,
-		url,
-		connConfig.Database,
-	)
-	log.Printf("Connecting with: %s", maskedConnStr)
+	// Explicit fields win over credentials embedded in the URL
+	if connConfig.Username != "" {
+		spec.User = connConfig.Username
+	}
+	if connConfig.Password != "" {
+		spec.Password = connConfig.Password
+	}
+	if connConfig.Database != "" {
+		spec.DBName = connConfig.Database
+	}
+	if err := spec.requireLogin("username", "database"); err != nil {
+		return nil, err
+	}
 
-	// Try to connect with a timeout
-	log.Printf("Attempting to open connection to PostgreSQL...")
-	db, err := sql.Open("postgres", connStr)
+	// ngrok tunnels usually end at a local server without TLS, so SSL is opt-in here
+	sslConfig := connConfig.SSL
+	if sslConfig.Mode == "" && spec.Params["sslmode"] == "" {
+		sslConfig.Mode = SSLModeDisable
+	}
+
+	return dm.ConnectSpec(ctx, spec, sslConfig, connConfig.SSH)
+}
+
+// ConnectSpec connects to the first usable host of spec and makes it the
+// current connection. Hosts are tried in order, as libpq does, until one
+// accepts the connection and satisfies target_session_attrs.
+func (dm *DatabaseManager) ConnectSpec(ctx context.Context, spec *ConnSpec, sslConfig SSLConfig, sshConfig *SSHTunnelConfig) (_ *TLSInfo, err error) {
+	ctx, op := dm.startOp(ctx, "Connect", "")
+	defer op.end(&err)
+	if sslConfig.Mode == "" {
+		sslConfig.Mode = spec.Params["sslmode"]
+	}
+	ssl, err := dm.resolveSSL(sslConfig, SSLModePrefer)
 	if err != nil {
-		log.Printf("Failed to open database: %v", err)
-		return fmt.Errorf("failed to open database: %v", err)
+		return nil, err
 	}
+	defer func() {
+		if err != nil {
+			ssl.remove()
+		}
+	}()
 
-	// Set connection pool settings
-	db.SetMaxOpenConns(dm.resources.MaxConnections)
-	db.SetMaxIdleConns(dm.resources.MaxIdleConnections)
-	db.SetConnMaxLifetime(15 * time.Minute)
+	slog.InfoContext(ctx, "Connecting to database", "spec", spec, "sslmode", ssl.mode)
 
 	// Test the connection with timeout context
-	log.Printf("Testing connection with ping...")
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, dm.resources.ConnectTimeout)
 	defer cancel()
 
-	// First try a simple ping
-	if err := db.PingContext(ctx); err != nil {
-		db.Close()
-		log.Printf("Failed to ping database: %v", err)
-		return fmt.Errorf("failed to connect to database: %v", err)
+	var tunnel *sshTunnel
+	if sshConfig != nil {
+		if tunnel, err = dm.openTunnel(ctx, sshConfig); err != nil {
+			slog.WarnContext(ctx, "Failed to open SSH tunnel", "error", err)
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				tunnel.Close()
+			}
+		}()
+	}
+
+	db, hp, mode, err := dm.openSpec(ctx, spec, ssl, tunnel)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to connect to database", "error", err)
+		return nil, err
 	}
-	log.Printf("Ping successful!")
 
 	// Verify connection and get current database name
-	log.Printf("Querying database name...")
 	var dbName string
 	err = db.QueryRowContext(ctx, "SELECT current_database()").Scan(&dbName)
 	if err != nil {
 		db.Close()
-		log.Printf("Failed to verify database connection: %v", err)
-		return fmt.Errorf("failed to verify database connection: %v", err)
+		slog.WarnContext(ctx, "Failed to verify database connection", "error", err)
+		return nil, fmt.Errorf("failed to verify database connection: %w", err)
 	}
 
-	// Close existing connection if any
-	if dm.currentDB != nil {
-		if err := dm.currentDB.Close(); err != nil {
-			log.Printf("Warning: failed to close previous connection: %v", err)
-		}
-		dm.currentDB = nil
-	}
+	info := tlsInfo(ctx, db, tunnel, mode, hp.Address(), hp.Host)
+	op.span.SetAttributes(attribute.String("server.address", hp.Host), attribute.String("db.namespace", dbName))
 
 	// Store the new connection
-	dm.currentDB = db
-	log.Printf("Successfully connected to database:")
-	log.Printf("- Confirmed Database Name: %s", dbName)
-	log.Printf("- Requested Database Name: %s", connConfig.Database)
+	dm.setConnection(db, ssl, tunnel, ConnectionProfile{Host: hp.Address(), Database: dbName, User: spec.User})
+	slog.InfoContext(ctx, "Connected to database", "host", hp.Address(), "database", dbName, "sslmode", mode)
 
 	// Verify if connected to the requested database
-	if dbName != connConfig.Database {
-		log.Printf("WARNING: Connected to %s but requested database was %s", dbName, connConfig.Database)
+	if spec.DBName != "" && dbName != spec.DBName {
+		slog.WarnContext(ctx, "Connected to a different database than requested", "database", dbName, "requested", spec.DBName)
+	}
+
+	return info, nil
+}
+
+// openSpec tries the hosts of spec in order and returns the first pool that
+// answers and matches target_session_attrs. prefer-standby makes a second pass
+// accepting any server when no standby was found.
+func (dm *DatabaseManager) openSpec(ctx context.Context, spec *ConnSpec, ssl *sslSettings, tunnel *sshTunnel) (*sql.DB, HostPort, string, error) {
+	attrs := spec.Params["target_session_attrs"]
+	passes := []string{attrs}
+	switch attrs {
+	case "":
+		passes = []string{"any"}
+	case "prefer-standby":
+		passes = []string{"standby", "any"}
 	}
 
+	var lastErr error
+	for _, want := range passes {
+		for i, hp := range spec.Hosts {
+			db, mode, err := dm.openPool(ctx, ssl, tunnel, func(params map[string]string) string {
+				slog.DebugContext(ctx, "Opening connection", "dsn", spec.redactedDSN(hp, params))
+				return spec.dsn(hp, params)
+			})
+			if err == nil {
+				if err = checkSessionAttrs(ctx, db, want); err == nil {
+					return db, hp, mode, nil
+				}
+				db.Close()
+			}
+			lastErr = err
+
+			// Like libpq, give up on authentication errors and unknown databases
+			var pqErr *pq.Error
+			if ctx.Err() != nil || (errors.As(err, &pqErr) && (pqErr.Code.Class() == "28" || pqErr.Code == "3D000")) {
+				return nil, HostPort{}, "", err
+			}
+			if i < len(spec.Hosts)-1 {
+				slog.WarnContext(ctx, "Host failed, trying the next one", "host", hp.Address(), "error", err)
+			}
+		}
+	}
+	return nil, HostPort{}, "", lastErr
+}
+
+// checkSessionAttrs reports whether the server behind db satisfies a target_session_attrs value
+func checkSessionAttrs(ctx context.Context, db *sql.DB, want string) error {
+	if want == "any" {
+		return nil
+	}
+
+	var readOnly string
+	var inRecovery bool
+	err := db.QueryRowContext(ctx,
+		"SELECT current_setting('transaction_read_only'), pg_is_in_recovery()",
+	).Scan(&readOnly, &inRecovery)
+	if err != nil {
+		return fmt.Errorf("failed to check target_session_attrs: %w", err)
+	}
+
+	var ok bool
+	switch want {
+	case "read-write":
+		ok = readOnly == "off"
+	case "read-only":
+		ok = readOnly == "on"
+	case "primary":
+		ok = !inRecovery
+	case "standby":
+		ok = inRecovery
+	}
+	if !ok {
+		return fmt.Errorf("%w: server is not %s", ErrTargetSessionAttrs, want)
+	}
 	return nil
 }
 
-// ListTables returns all tables in the current database
-func (dm *DatabaseManager) ListTables() ([]string, error) {
+// setConnection replaces the current connection, closing the previous one with
+// its tunnel, certificate files and health monitor and dropping everything cached for it
+func (dm *DatabaseManager) setConnection(db *sql.DB, ssl *sslSettings, tunnel *sshTunnel, profile ConnectionProfile) {
+	monitor := newHealthMonitor(db, tunnel, profile.Host, dm.resources, dm.health)
+
+	dm.mu.Lock()
+	oldDB, oldSSL, oldTunnel, oldMonitor, oldConnID := dm.currentDB, dm.ssl, dm.tunnel, dm.monitor, dm.connID
+	dm.currentDB, dm.profile, dm.ssl, dm.tunnel, dm.monitor = db, profile, ssl, tunnel, monitor
+	dm.connID = dm.nextConnID()
+	dm.mu.Unlock()
+
+	// Tear the old connection down outside the lock so requests on the new one are not held up
+	oldMonitor.Stop()
+	if oldDB != nil {
+		if err := oldDB.Close(); err != nil {
+			slog.Warn("Failed to close previous connection", "error", err)
+		}
+	}
+	oldSSL.remove()
+	oldTunnel.Close()
+	if oldConnID != "" {
+		dm.cache.DeletePrefix(oldConnID + "/")
+	}
+
+	monitor.start()
+}
+
+// CurrentConnection returns the profile of the current connection, or nil when there is none
+func (dm *DatabaseManager) CurrentConnection() *ConnectionProfile {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
 	if dm.currentDB == nil {
-		return nil, fmt.Errorf("no database connection")
+		return nil
+	}
+	profile := dm.profile
+	return &profile
+}
+
+// ListTables returns all tables in the current database
+func (dm *DatabaseManager) ListTables(ctx context.Context) (_ []string, err error) {
+	ctx, op := dm.startOp(ctx, "ListTables", "")
+	defer op.end(&err)
+	db, err := dm.db()
+	if err != nil {
+		return nil, err
+	}
+
+	cacheKey := dm.cacheKey("tables")
+	if cached, ok := dm.cache.Get(cacheKey); ok {
+		op.cacheHit()
+		return cached.([]string), nil
 	}
 
 	query := `
@@ -197,9 +386,10 @@ func (dm *DatabaseManager) ListTables() ([]string, error) {
 		ORDER BY table_name;
 	`
 
-	rows, err := dm.currentDB.Query(query)
+	op.statement(query)
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query tables: %v", err)
+		return nil, fmt.Errorf("failed to query tables: %w", err)
 	}
 	defer rows.Close()
 
@@ -207,18 +397,23 @@ func (dm *DatabaseManager) ListTables() ([]string, error) {
 	for rows.Next() {
 		var tableName string
 		if err := rows.Scan(&tableName); err != nil {
-			return nil, fmt.Errorf("failed to scan table name: %v", err)
+			return nil, fmt.Errorf("failed to scan table name: %w", err)
 		}
 		tables = append(tables, tableName)
 	}
 
+	op.returned(len(tables))
+	dm.cache.Set(cacheKey, tables, dm.resources.SchemaCacheTTL)
 	return tables, nil
 }
 
 // GetTableColumns returns the column information for a given table
-func (dm *DatabaseManager) GetTableColumns(tableName string) ([]map[string]interface{}, error) {
-	if dm.currentDB == nil {
-		return nil, fmt.Errorf("no database connection")
+func (dm *DatabaseManager) GetTableColumns(ctx context.Context, tableName string) (_ []map[string]interface{}, err error) {
+	ctx, op := dm.startOp(ctx, "GetTableColumns", tableName)
+	defer op.end(&err)
+	db, err := dm.db()
+	if err != nil {
+		return nil, err
 	}
 
 	columnsQuery := `
@@ -229,9 +424,10 @@ func (dm *DatabaseManager) GetTableColumns(tableName string) ([]map[string]inter
 		ORDER BY ordinal_position;
 	`
 
-	columnRows, err := dm.currentDB.Query(columnsQuery, tableName)
+	op.statement(columnsQuery)
+	columnRows, err := db.QueryContext(ctx, columnsQuery, tableName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get columns: %v", err)
+		return nil, fmt.Errorf("failed to get columns: %w", err)
 	}
 	defer columnRows.Close()
 
@@ -239,7 +435,7 @@ func (dm *DatabaseManager) GetTableColumns(tableName string) ([]map[string]inter
 	for columnRows.Next() {
 		var columnName, dataType string
 		if err := columnRows.Scan(&columnName, &dataType); err != nil {
-			return nil, fmt.Errorf("failed to scan column: %v", err)
+			return nil, fmt.Errorf("failed to scan column: %w", err)
 		}
 
 		column := map[string]interface{}{
@@ -251,25 +447,30 @@ func (dm *DatabaseManager) GetTableColumns(tableName string) ([]map[string]inter
 		columns = append(columns, column)
 	}
 
+	op.returned(len(columns))
 	return columns, nil
 }
 
 // GetTableData returns the data for a given table
-func (dm *DatabaseManager) GetTableData(tableName string) ([]map[string]interface{}, error) {
-	if dm.currentDB == nil {
-		return nil, fmt.Errorf("no database connection")
+func (dm *DatabaseManager) GetTableData(ctx context.Context, tableName string) (_ []map[string]interface{}, err error) {
+	ctx, op := dm.startOp(ctx, "GetTableData", tableName)
+	defer op.end(&err)
+	db, err := dm.db()
+	if err != nil {
+		return nil, err
 	}
 
 	dataQuery := fmt.Sprintf("SELECT * FROM %s LIMIT 100", pq.QuoteIdentifier(tableName))
-	dataRows, err := dm.currentDB.Query(dataQuery)
+	op.statement(dataQuery)
+	dataRows, err := db.QueryContext(ctx, dataQuery)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get data: %v", err)
+		return nil, fmt.Errorf("failed to get data: %w", err)
 	}
 	defer dataRows.Close()
 
 	columnNames, err := dataRows.Columns()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get column names: %v", err)
+		return nil, fmt.Errorf("failed to get column names: %w", err)
 	}
 
 	var rows []map[string]interface{}
@@ -281,7 +482,7 @@ func (dm *DatabaseManager) GetTableData(tableName string) ([]map[string]interfac
 		}
 
 		if err := dataRows.Scan(valuePtrs...); err != nil {
-			return nil, fmt.Errorf("failed to scan row: %v", err)
+			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
 
 		row := make(map[string]interface{})
@@ -303,6 +504,7 @@ func (dm *DatabaseManager) GetTableData(tableName string) ([]map[string]interfac
 		rows = append(rows, row)
 	}
 
+	op.returned(len(rows))
 	return rows, nil
 }
 
@@ -320,28 +522,69 @@ func getColumnType(pgType string) string {
 	}
 }
 
-// GetTableCount returns the total number of rows in a table
-func (dm *DatabaseManager) GetTableCount(tableName string) (int64, error) {
+// GetTableCount returns the number of rows in a table matching the filter of q
+func (dm *DatabaseManager) GetTableCount(ctx context.Context, q TableQuery) (_ int64, err error) {
+	ctx, op := dm.startOp(ctx, "GetTableCount", q.Table)
+	defer op.end(&err)
 	// Check if we have an active connection
-	if dm.currentDB == nil {
-		return 0, fmt.Errorf("no active database connection")
+	db, err := dm.db()
+	if err != nil {
+		return 0, err
+	}
+
+	cacheKey := dm.cacheKey("count", q.Table)
+	if q.filtered() {
+		cacheKey = dm.cacheKey("count", q.Table, q.digest())
+	}
+	if dm.resources.CacheQueryResults {
+		if cached, ok := dm.cache.Get(cacheKey); ok {
+			op.cacheHit()
+			return cached.(int64), nil
+		}
+	}
+
+	var query string
+	var args []interface{}
+	if !q.filtered() {
+		// Use standard SQL query to count all rows in the table
+		query = fmt.Sprintf("SELECT COUNT(*) FROM %s", pq.QuoteIdentifier(q.Table))
+	} else {
+		schema, err := dm.GetTableSchema(ctx, q.Table)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get schema: %w", err)
+		}
+		if query, args, err = q.BuildCount(schema); err != nil {
+			return 0, err
+		}
 	}
 
 	var count int64
-	// Use standard SQL query to count all rows in the table
-	query := fmt.Sprintf("SELECT COUNT(*) FROM %s", pq.QuoteIdentifier(tableName))
-	err := dm.currentDB.QueryRow(query).Scan(&count)
+	op.statement(query)
+	err = db.QueryRowContext(ctx, query, args...).Scan(&count)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get table count: %v", err)
+		return 0, fmt.Errorf("failed to get table count: %w", err)
 	}
 
+	if dm.resources.CacheQueryResults {
+		dm.cache.Set(cacheKey, count, dm.resources.QueryCacheTTL)
+	}
 	return count, nil
 }
 
 // GetTableSchema returns the schema for a given table
-func (dm *DatabaseManager) GetTableSchema(tableName string) (*TableSchema, error) {
-	if dm.currentDB == nil {
-		return nil, fmt.Errorf("no database connection")
+func (dm *DatabaseManager) GetTableSchema(ctx context.Context, tableName string) (_ *TableSchema, err error) {
+	ctx, op := dm.startOp(ctx, "GetTableSchema", tableName)
+	defer op.end(&err)
+	db, err := dm.db()
+	if err != nil {
+		return nil, err
+	}
+
+	// Schema metadata is read on every page load and cell edit, so serve it from cache
+	cacheKey := dm.cacheKey("schema", tableName)
+	if cached, ok := dm.cache.Get(cacheKey); ok {
+		op.cacheHit()
+		return cached.(*TableSchema), nil
 	}
 
 	query := `
@@ -349,23 +592,39 @@ func (dm *DatabaseManager) GetTableSchema(tableName string) (*TableSchema, error
 			c.column_name,
 			c.data_type,
 			c.is_nullable = 'YES' as is_nullable,
-			CASE WHEN pk.column_name IS NOT NULL THEN true ELSE false END as is_primary
+			CASE WHEN pk.column_name IS NOT NULL THEN true ELSE false END as is_primary,
+			c.character_maximum_length,
+			c.column_default IS NOT NULL OR c.is_identity = 'YES' as has_default,
+			c.is_generated = 'ALWAYS' OR c.identity_generation = 'ALWAYS' as is_generated,
+			ARRAY(
+				SELECT e.enumlabel
+				FROM pg_catalog.pg_type t
+				JOIN pg_catalog.pg_namespace n ON n.oid = t.typnamespace
+				JOIN pg_catalog.pg_enum e ON e.enumtypid = t.oid
+				WHERE t.typname = c.udt_name
+					AND n.nspname = c.udt_schema
+				ORDER BY e.enumsortorder
+			) as enum_values
 		FROM information_schema.columns c
 		LEFT JOIN (
 			SELECT kcu.column_name
 			FROM information_schema.table_constraints tc
 			JOIN information_schema.key_column_usage kcu 
 				ON tc.constraint_name = kcu.constraint_name
+				AND tc.table_schema = kcu.table_schema
 			WHERE tc.table_name = $1 
+				AND tc.table_schema = 'public'
 				AND tc.constraint_type = 'PRIMARY KEY'
 		) pk ON c.column_name = pk.column_name
 		WHERE c.table_name = $1
+			AND c.table_schema = 'public'
 		ORDER BY c.ordinal_position;
 	`
 
-	rows, err := dm.currentDB.Query(query, tableName)
+	op.statement(query)
+	rows, err := db.QueryContext(ctx, query, tableName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get schema: %v", err)
+		return nil, fmt.Errorf("failed to get schema: %w", err)
 	}
 	defer rows.Close()
 
@@ -375,32 +634,113 @@ func (dm *DatabaseManager) GetTableSchema(tableName string) (*TableSchema, error
 
 	for rows.Next() {
 		var col ColumnSchema
-		if err := rows.Scan(&col.Name, &col.DataType, &col.IsNullable, &col.IsPrimary); err != nil {
-			return nil, fmt.Errorf("failed to scan column: %v", err)
+		var maxLength sql.NullInt64
+		if err := rows.Scan(
+			&col.Name,
+			&col.DataType,
+			&col.IsNullable,
+			&col.IsPrimary,
+			&maxLength,
+			&col.HasDefault,
+			&col.IsGenerated,
+			pq.Array(&col.EnumValues),
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan column: %w", err)
+		}
+		if maxLength.Valid {
+			length := int(maxLength.Int64)
+			col.MaxLength = &length
 		}
 		schema.Columns = append(schema.Columns, col)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read schema: %w", err)
+	}
 
+	if len(schema.Columns) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, tableName)
+	}
+
+	if schema.TrigramColumns, err = trigramColumns(ctx, db, tableName); err != nil {
+		return nil, err
+	}
+
+	op.returned(len(schema.Columns))
+	dm.cache.Set(cacheKey, schema, dm.resources.SchemaCacheTTL)
 	return schema, nil
 }
 
-// GetTableDataPaginated returns paginated data with proper type conversions
-func (dm *DatabaseManager) GetTableDataPaginated(tableName string, page, pageSize int) ([]map[string]interface{}, error) {
-	schema, err := dm.GetTableSchema(tableName)
+// trigramColumns returns the columns of a table covered by a pg_trgm index
+func trigramColumns(ctx context.Context, db *sql.DB, tableName string) ([]string, error) {
+	query := `
+		SELECT DISTINCT a.attname
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		CROSS JOIN LATERAL unnest(i.indkey::int2[], i.indclass::oid[]) AS k(attnum, opclass)
+		JOIN pg_opclass oc ON oc.oid = k.opclass
+		JOIN pg_attribute a ON a.attrelid = c.oid AND a.attnum = k.attnum
+		WHERE n.nspname = 'public'
+			AND c.relname = $1
+			AND oc.opcname IN ('gin_trgm_ops', 'gist_trgm_ops')
+		ORDER BY a.attname
+	`
+
+	rows, err := db.QueryContext(ctx, query, tableName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get schema: %v", err)
+		return nil, fmt.Errorf("failed to get trigram indexes: %w", err)
 	}
+	defer rows.Close()
 
-	offset := page * pageSize
-	query := fmt.Sprintf("SELECT * FROM %s LIMIT %d OFFSET %d",
-		pq.QuoteIdentifier(tableName),
-		pageSize,
-		offset,
-	)
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, fmt.Errorf("failed to scan trigram index column: %w", err)
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read trigram indexes: %w", err)
+	}
+	return columns, nil
+}
 
-	rows, err := dm.currentDB.Query(query)
+// GetTableDataPaginated returns the page of rows q describes with proper type conversions
+func (dm *DatabaseManager) GetTableDataPaginated(ctx context.Context, q TableQuery) (_ []map[string]interface{}, err error) {
+	tableName := q.Table
+	ctx, op := dm.startOp(ctx, "GetTableDataPaginated", tableName)
+	defer op.end(&err)
+	db, err := dm.db()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get data: %v", err)
+		return nil, err
+	}
+
+	schema, err := dm.GetTableSchema(ctx, tableName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schema: %w", err)
+	}
+
+	cacheKey := dm.cacheKey("data", tableName, strconv.Itoa(q.Page), strconv.Itoa(q.PageSize))
+	if q.filtered() || len(q.Sort) > 0 {
+		cacheKey = dm.cacheKey("data", tableName, strconv.Itoa(q.Page), strconv.Itoa(q.PageSize), q.digest())
+	}
+	if dm.resources.CacheQueryResults {
+		if cached, ok := dm.cache.Get(cacheKey); ok {
+			op.cacheHit()
+			return cached.([]map[string]interface{}), nil
+		}
+	}
+
+	query, args, err := q.Build(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	op.statement(query)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get data: %w", err)
 	}
 	defer rows.Close()
 
@@ -421,7 +761,7 @@ func (dm *DatabaseManager) GetTableDataPaginated(tableName string, page, pageSiz
 		}
 
 		if err := rows.Scan(valuePtrs...); err != nil {
-			return nil, fmt.Errorf("failed to scan row: %v", err)
+			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
 
 		row := make(map[string]interface{})
@@ -429,6 +769,14 @@ func (dm *DatabaseManager) GetTableDataPaginated(tableName string, page, pageSiz
 		// Convert values based on schema
 		for i, col := range columns {
 			val := values[i]
+			if col == MatchedColumnsKey {
+				var matched pq.StringArray
+				if err := matched.Scan(val); err != nil {
+					return nil, fmt.Errorf("failed to read matched columns: %w", err)
+				}
+				row[col] = []string(matched)
+				continue
+			}
 			colSchema := columnSchemas[col]
 
 			if val == nil {
@@ -444,7 +792,7 @@ func (dm *DatabaseManager) GetTableDataPaginated(tableName string, page, pageSiz
 			// Convert value based on data type
 			convertedVal, err := convertValue(val, colSchema.DataType)
 			if err != nil {
-				return nil, fmt.Errorf("failed to convert value: %v", err)
+				return nil, fmt.Errorf("failed to convert value: %w", err)
 			}
 			row[col] = convertedVal
 		}
@@ -465,76 +813,44 @@ func (dm *DatabaseManager) GetTableDataPaginated(tableName string, page, pageSiz
 
 		results = append(results, row)
 	}
+	op.returned(len(results))
 
+	if dm.resources.CacheQueryResults {
+		dm.cache.Set(cacheKey, results, dm.resources.QueryCacheTTL)
+	}
 	return results, nil
 }
 
-// ConnectDirect establishes a direct connection to the specified database
-func (dm *DatabaseManager) ConnectDirect(config DirectConnectionConfig) error {
-	// Clean the host in case it contains any protocol prefixes
-	host := sanitizeHostURL(config.Host)
-
-	// Build the connection string
-	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		host,
-		config.Port,
-		config.User,
-		config.Password,
-		config.DBName,
-		config.SSLMode,
-	)
-
-	// Log connection details (without password)
-	log.Printf("Direct connection attempt details:")
-	log.Printf("- Host: %s (original: %s)", host, config.Host)
-	log.Printf("- Port: %s", config.Port)
-	log.Printf("- Database: %s", config.DBName)
-	log.Printf("- User: %s", config.User)
-	log.Printf("- SSL Mode: %s", config.SSLMode)
-
-	// Try to connect
-	log.Printf("Attempting to open direct connection to PostgreSQL...")
-	db, err := sql.Open("postgres", connStr)
+// BuildTableQuery returns the SQL and arguments GetTableDataPaginated runs for q
+func (dm *DatabaseManager) BuildTableQuery(ctx context.Context, q TableQuery) (string, []interface{}, error) {
+	schema, err := dm.GetTableSchema(ctx, q.Table)
 	if err != nil {
-		log.Printf("Failed to open database: %v", err)
-		return fmt.Errorf("failed to open database: %v", err)
+		return "", nil, fmt.Errorf("failed to get schema: %w", err)
 	}
+	return q.Build(schema)
+}
 
-	// Set connection pool settings
-	db.SetMaxOpenConns(dm.resources.MaxConnections)
-	db.SetMaxIdleConns(dm.resources.MaxIdleConnections)
-	db.SetConnMaxLifetime(15 * time.Minute)
-
-	// Test the connection with timeout context
-	log.Printf("Testing direct connection with ping...")
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
-
-	// Try a simple ping first
-	if err := db.PingContext(ctx); err != nil {
-		db.Close()
-		log.Printf("Failed to ping database: %v", err)
-		return fmt.Errorf("failed to connect to database (ping failed): %v", err)
+// CreateRow creates a new row in the specified table
+func (dm *DatabaseManager) CreateRow(ctx context.Context, tableName string, data map[string]interface{}) (err error) {
+	ctx, op := dm.startOp(ctx, "CreateRow", tableName)
+	defer op.end(&err)
+	db, err := dm.db()
+	if err != nil {
+		return err
 	}
-	log.Printf("Ping successful!")
 
-	// Close existing connection if any
-	if dm.currentDB != nil {
-		if err := dm.currentDB.Close(); err != nil {
-			log.Printf("Warning: failed to close previous connection: %v", err)
-		}
+	schema, err := dm.GetTableSchema(ctx, tableName)
+	if err != nil {
+		return fmt.Errorf("failed to get schema: %w", err)
 	}
 
-	dm.currentDB = db
-	log.Printf("Successfully established direct connection to database %s", config.DBName)
-	return nil
-}
-
-// CreateRow creates a new row in the specified table
-func (dm *DatabaseManager) CreateRow(tableName string, data map[string]interface{}) error {
-	if dm.currentDB == nil {
-		return fmt.Errorf("no database connection")
+	// Validate and coerce the payload before it reaches the database
+	data, err = validateRow(schema, data, false)
+	if err != nil {
+		return err
+	}
+	if err := checkTimeValues(ctx, db, schema, data); err != nil {
+		return err
 	}
 
 	// Build the INSERT query dynamically
@@ -556,34 +872,71 @@ func (dm *DatabaseManager) CreateRow(tableName string, data map[string]interface
 		strings.Join(columns, ", "),
 		strings.Join(placeholders, ", "),
 	)
+	if len(columns) == 0 {
+		query = fmt.Sprintf("INSERT INTO %s DEFAULT VALUES", pq.QuoteIdentifier(tableName))
+	}
 
 	// Execute the query
-	_, err := dm.currentDB.Exec(query, values...)
+	op.statement(query)
+	result, err := db.ExecContext(ctx, query, values...)
 	if err != nil {
-		return fmt.Errorf("failed to create row: %v", err)
+		return mapWriteError(fmt.Errorf("failed to create row: %w", err))
+	}
+	dm.invalidateTableData(tableName)
+	if n, err := result.RowsAffected(); err == nil {
+		op.affected(n)
 	}
 
 	return nil
 }
 
 // UpdateRow updates an existing row in the specified table
-func (dm *DatabaseManager) UpdateRow(tableName string, id string, data map[string]interface{}) error {
-	if dm.currentDB == nil {
-		return fmt.Errorf("no database connection")
+func (dm *DatabaseManager) UpdateRow(ctx context.Context, tableName string, id string, data map[string]interface{}) (err error) {
+	ctx, op := dm.startOp(ctx, "UpdateRow", tableName)
+	defer op.end(&err)
+	db, err := dm.db()
+	if err != nil {
+		return err
 	}
 
-	// Build the UPDATE query dynamically
-	setValues := make([]string, 0, len(data))
-	values := make([]interface{}, 0, len(data))
-	i := 1
+	schema, err := dm.GetTableSchema(ctx, tableName)
+	if err != nil {
+		return fmt.Errorf("failed to get schema: %w", err)
+	}
 
+	// The ID identifies the row and is never part of the SET clause
+	fields := make(map[string]interface{}, len(data))
 	for column, value := range data {
-		if column != "id" { // Skip the ID field
-			setValues = append(setValues, fmt.Sprintf("%s = $%d", pq.QuoteIdentifier(column), i))
-			values = append(values, value)
-			i++
+		if column != "id" {
+			fields[column] = value
 		}
 	}
+	if len(fields) == 0 {
+		return &ValidationError{Fields: []FieldError{{
+			Code:    "empty_payload",
+			Message: "no columns to update",
+		}}}
+	}
+
+	// Validate and coerce the payload before it reaches the database
+	fields, err = validateRow(schema, fields, true)
+	if err != nil {
+		return err
+	}
+	if err := checkTimeValues(ctx, db, schema, fields); err != nil {
+		return err
+	}
+
+	// Build the UPDATE query dynamically
+	setValues := make([]string, 0, len(fields))
+	values := make([]interface{}, 0, len(fields))
+	i := 1
+
+	for column, value := range fields {
+		setValues = append(setValues, fmt.Sprintf("%s = $%d", pq.QuoteIdentifier(column), i))
+		values = append(values, value)
+		i++
+	}
 
 	// Add ID as the last parameter
 	values = append(values, id)
@@ -596,27 +949,33 @@ func (dm *DatabaseManager) UpdateRow(tableName string, id string, data map[strin
 	)
 
 	// Execute the query
-	result, err := dm.currentDB.Exec(query, values...)
+	op.statement(query)
+	result, err := db.ExecContext(ctx, query, values...)
 	if err != nil {
-		return fmt.Errorf("failed to update row: %v", err)
+		return mapWriteError(fmt.Errorf("failed to update row: %w", err))
 	}
+	dm.invalidateTableData(tableName)
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("error checking rows affected: %v", err)
+		return fmt.Errorf("error checking rows affected: %w", err)
 	}
+	op.affected(rowsAffected)
 
 	if rowsAffected == 0 {
-		return fmt.Errorf("no row found with id %s", id)
+		return fmt.Errorf("%w: no row found with id %s", ErrRowNotFound, id)
 	}
 
 	return nil
 }
 
 // DeleteRow deletes a row from the specified table
-func (dm *DatabaseManager) DeleteRow(tableName string, id string) error {
-	if dm.currentDB == nil {
-		return fmt.Errorf("no database connection")
+func (dm *DatabaseManager) DeleteRow(ctx context.Context, tableName string, id string) (err error) {
+	ctx, op := dm.startOp(ctx, "DeleteRow", tableName)
+	defer op.end(&err)
+	db, err := dm.db()
+	if err != nil {
+		return err
 	}
 
 	query := fmt.Sprintf(
@@ -625,28 +984,49 @@ func (dm *DatabaseManager) DeleteRow(tableName string, id string) error {
 	)
 
 	// Execute the query
-	result, err := dm.currentDB.Exec(query, id)
+	op.statement(query)
+	result, err := db.ExecContext(ctx, query, id)
 	if err != nil {
-		return fmt.Errorf("failed to delete row: %v", err)
+		return fmt.Errorf("failed to delete row: %w", err)
 	}
+	dm.invalidateTableData(tableName)
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("error checking rows affected: %v", err)
+		return fmt.Errorf("error checking rows affected: %w", err)
 	}
+	op.affected(rowsAffected)
 
 	if rowsAffected == 0 {
-		return fmt.Errorf("no row found with id %s", id)
+		return fmt.Errorf("%w: no row found with id %s", ErrRowNotFound, id)
 	}
 
 	return nil
 }
 
 // UpdateCell updates a single cell in the specified table
-func (dm *DatabaseManager) UpdateCell(tableName string, pkColumn string, pkValue string, columnName string, value interface{}) error {
-	if dm.currentDB == nil {
-		return fmt.Errorf("no database connection")
+func (dm *DatabaseManager) UpdateCell(ctx context.Context, tableName string, pkColumn string, pkValue string, columnName string, value interface{}) (err error) {
+	ctx, op := dm.startOp(ctx, "UpdateCell", tableName)
+	defer op.end(&err)
+	db, err := dm.db()
+	if err != nil {
+		return err
+	}
+
+	schema, err := dm.GetTableSchema(ctx, tableName)
+	if err != nil {
+		return fmt.Errorf("failed to get schema: %w", err)
+	}
+
+	// Validate and coerce the new value before it reaches the database
+	fields, err := validateRow(schema, map[string]interface{}{columnName: value}, true)
+	if err != nil {
+		return err
+	}
+	if err := checkTimeValues(ctx, db, schema, fields); err != nil {
+		return err
 	}
+	value = fields[columnName]
 
 	query := fmt.Sprintf(
 		"UPDATE %s SET %s = $1 WHERE %s = $2",
@@ -655,27 +1035,30 @@ func (dm *DatabaseManager) UpdateCell(tableName string, pkColumn string, pkValue
 		pq.QuoteIdentifier(pkColumn),
 	)
 
-	log.Printf("Executing query: %s with values: [%v, %s]", query, value, pkValue)
+	// Only the statement is logged; the new value never is, and the key goes
+	// under its column name so sensitive key columns are redacted
+	slog.DebugContext(ctx, "Updating cell", "query", query, slog.Group("key", pkColumn, pkValue))
 
 	// Execute the query
-	result, err := dm.currentDB.Exec(query, value, pkValue)
+	op.statement(query)
+	result, err := db.ExecContext(ctx, query, value, pkValue)
 	if err != nil {
-		log.Printf("Error executing update query: %v", err)
-		return fmt.Errorf("failed to update cell: %v", err)
+		slog.WarnContext(ctx, "Cell update failed", "table", tableName, "column", columnName, "error", err)
+		return mapWriteError(fmt.Errorf("failed to update cell: %w", err))
 	}
+	dm.invalidateTableData(tableName)
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		log.Printf("Error checking rows affected: %v", err)
-		return fmt.Errorf("error checking rows affected: %v", err)
+		return fmt.Errorf("error checking rows affected: %w", err)
 	}
+	op.affected(rowsAffected)
 
 	if rowsAffected == 0 {
-		log.Printf("No rows affected. No row found with %s = %s", pkColumn, pkValue)
-		return fmt.Errorf("no row found with %s = %s", pkColumn, pkValue)
+		return fmt.Errorf("%w: no row found with %s = %s", ErrRowNotFound, pkColumn, pkValue)
 	}
 
-	log.Printf("Successfully updated cell. Rows affected: %d", rowsAffected)
+	slog.DebugContext(ctx, "Updated cell", "table", tableName, "column", columnName, "rows", rowsAffected)
 	return nil
 }
 
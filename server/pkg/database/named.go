@@ -0,0 +1,343 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// paramTypes maps the types a named parameter can declare to the column type
+// its values are checked as
+var paramTypes = map[string]string{
+	"text":        "text",
+	"integer":     "integer",
+	"bigint":      "bigint",
+	"numeric":     "numeric",
+	"boolean":     "boolean",
+	"date":        "date",
+	"timestamp":   "timestamp without time zone",
+	"timestamptz": "timestamp with time zone",
+	"uuid":        "uuid",
+	"json":        "jsonb",
+}
+
+// NamedParam declares a :name parameter of a statement
+type NamedParam struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type"`
+	Required    bool        `json:"required"`
+	Default     interface{} `json:"default,omitempty"`
+	Description string      `json:"description,omitempty"`
+}
+
+// ParamTypes lists the types a named parameter can declare
+func ParamTypes() []string {
+	types := make([]string, 0, len(paramTypes))
+	for t := range paramTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// ValidateNamedParams checks that query uses only :name parameters and that
+// they match the declarations one to one
+func ValidateNamedParams(query string, params []NamedParam) error {
+	verr := &ValidationError{}
+
+	_, used, positional := scanNamed(query, nil)
+	if positional {
+		verr.add("sql", "positional_parameter", "use :name parameters instead of $n placeholders")
+	}
+
+	declared := make(map[string]bool, len(params))
+	for i, p := range params {
+		field := fmt.Sprintf("params[%d]", i)
+		switch {
+		case !isParamName(p.Name):
+			verr.add(field, "invalid_name", "%q is not a valid parameter name", p.Name)
+		case declared[p.Name]:
+			verr.add(field, "duplicate", "parameter %q is declared twice", p.Name)
+		}
+		declared[p.Name] = true
+
+		if _, ok := paramTypes[p.Type]; !ok {
+			verr.add(field, "invalid_type", "type must be one of %s", strings.Join(ParamTypes(), ", "))
+		} else if p.Default != nil {
+			if _, ferr := coerceValue(paramColumn(p), p.Default); ferr != nil {
+				verr.add(field, "invalid_default", "default: %s", ferr.Message)
+			}
+		}
+	}
+
+	usedSet := make(map[string]bool, len(used))
+	for _, name := range used {
+		usedSet[name] = true
+		if !declared[name] {
+			verr.add("params", "undeclared", "parameter :%s is used but not declared", name)
+		}
+	}
+	for _, p := range params {
+		if isParamName(p.Name) && !usedSet[p.Name] {
+			verr.add("params", "unused", "parameter :%s is declared but not used", p.Name)
+			// Report duplicates once
+			usedSet[p.Name] = true
+		}
+	}
+
+	return verr.errOrNil()
+}
+
+// BindNamed rewrites the :name parameters of query to $n placeholders cast to
+// their declared type and returns the arguments, coerced from values by type.
+// Missing values take the declared default or NULL; required ones are an error.
+func BindNamed(query string, params []NamedParam, values map[string]interface{}) (string, []interface{}, error) {
+	if err := ValidateNamedParams(query, params); err != nil {
+		return "", nil, err
+	}
+
+	byName := make(map[string]NamedParam, len(params))
+	for _, p := range params {
+		byName[p.Name] = p
+	}
+
+	verr := &ValidationError{}
+	for name := range values {
+		if _, ok := byName[name]; !ok {
+			verr.add("params."+name, "unknown_parameter", "parameter is not declared")
+		}
+	}
+
+	casts := make(map[string]string, len(params))
+	for _, p := range params {
+		// Declared names are valid SQL type names, except json which binds as jsonb
+		casts[p.Name] = p.Type
+		if p.Type == "json" {
+			casts[p.Name] = "jsonb"
+		}
+	}
+
+	rewritten, used, _ := scanNamed(query, casts)
+	args := make([]interface{}, len(used))
+	for i, name := range used {
+		p := byName[name]
+		value, ok := values[name]
+		if !ok || value == nil {
+			if p.Required {
+				verr.add("params."+name, "required", "parameter is required")
+				continue
+			}
+			value = p.Default
+		}
+
+		coerced, ferr := coerceValue(paramColumn(p), value)
+		if ferr != nil {
+			ferr.Field = "params." + name
+			verr.Fields = append(verr.Fields, *ferr)
+			continue
+		}
+		args[i] = coerced
+	}
+
+	if err := verr.errOrNil(); err != nil {
+		return "", nil, err
+	}
+	return rewritten, args, nil
+}
+
+// paramColumn describes a parameter as a nullable column so values are
+// checked like cell writes
+func paramColumn(p NamedParam) ColumnSchema {
+	return ColumnSchema{Name: p.Name, DataType: paramTypes[p.Type], IsNullable: true}
+}
+
+// scanNamed replaces each :name outside literals, quoted identifiers and
+// comments with $n, numbering names in order of first use and adding the cast
+// casts holds for the name. It also reports whether the query contains $n
+// placeholders of its own. Inside an array subscript, :name is a slice bound
+// as in a[1:n], so a parameter there needs parentheses: a[(:lo):(:hi)].
+func scanNamed(query string, casts map[string]string) (rewritten string, names []string, positional bool) {
+	var b strings.Builder
+	index := make(map[string]int)
+	// nesting holds the open brackets and parentheses, with '[' only for subscripts
+	var nesting []byte
+
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			end := quotedEnd(query, i, c, c == '\'' && i > 0 && (query[i-1] == 'E' || query[i-1] == 'e'))
+			b.WriteString(query[i:end])
+			i = end
+
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			b.WriteString(query[i : i+end])
+			i += end
+
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := blockCommentEnd(query, i)
+			b.WriteString(query[i:end])
+			i = end
+
+		case c == '$':
+			if i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9' {
+				positional = true
+				b.WriteByte(c)
+				i++
+				continue
+			}
+			if tag, ok := dollarTag(query, i); ok {
+				end := strings.Index(query[i+len(tag):], tag)
+				if end < 0 {
+					end = len(query)
+				} else {
+					end += i + 2*len(tag)
+				}
+				b.WriteString(query[i:end])
+				i = end
+				continue
+			}
+			b.WriteByte(c)
+			i++
+
+		case c == ':' && strings.HasPrefix(query[i:], "::"):
+			b.WriteString("::")
+			i += 2
+
+		case c == '[' || c == '(':
+			if c == '(' || arrayConstructor(query, i) {
+				nesting = append(nesting, '(')
+			} else {
+				nesting = append(nesting, '[')
+			}
+			b.WriteByte(c)
+			i++
+
+		case c == ']' || c == ')':
+			if len(nesting) > 0 {
+				nesting = nesting[:len(nesting)-1]
+			}
+			b.WriteByte(c)
+			i++
+
+		case c == ':' && len(nesting) > 0 && nesting[len(nesting)-1] == '[':
+			b.WriteByte(c)
+			i++
+
+		case c == ':' && i+1 < len(query) && isParamStart(query[i+1]):
+			j := i + 1
+			for j < len(query) && isParamChar(query[j]) {
+				j++
+			}
+			name := query[i+1 : j]
+			n, ok := index[name]
+			if !ok {
+				names = append(names, name)
+				n = len(names)
+				index[name] = n
+			}
+			if cast := casts[name]; cast != "" {
+				fmt.Fprintf(&b, "($%d::%s)", n, cast)
+			} else {
+				fmt.Fprintf(&b, "$%d", n)
+			}
+			i = j
+
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String(), names, positional
+}
+
+// arrayConstructor reports whether the bracket at start opens an ARRAY[...]
+// constructor rather than a subscript
+func arrayConstructor(query string, start int) bool {
+	end := start
+	for end > 0 && (query[end-1] == ' ' || query[end-1] == '\t' || query[end-1] == '\n' || query[end-1] == '\r') {
+		end--
+	}
+	word := end
+	for word > 0 && isParamChar(query[word-1]) {
+		word--
+	}
+	return strings.EqualFold(query[word:end], "array")
+}
+
+// quotedEnd returns the index after the quote closing the literal or
+// identifier opened at start. Doubled quotes are escapes, as are backslashes
+// in escape strings (E'...').
+func quotedEnd(query string, start int, quote byte, backslashes bool) int {
+	for i := start + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if backslashes {
+				i++
+			}
+		case quote:
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(query)
+}
+
+// blockCommentEnd returns the index after the comment opened at start; block comments nest
+func blockCommentEnd(query string, start int) int {
+	depth := 0
+	for i := start; i < len(query)-1; i++ {
+		switch {
+		case query[i] == '/' && query[i+1] == '*':
+			depth++
+			i++
+		case query[i] == '*' && query[i+1] == '/':
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(query)
+}
+
+// dollarTag returns the $tag$ opening a dollar-quoted string at start
+func dollarTag(query string, start int) (string, bool) {
+	for i := start + 1; i < len(query); i++ {
+		switch {
+		case query[i] == '$':
+			return query[start : i+1], true
+		case !isParamChar(query[i]) || (i == start+1 && !isParamStart(query[i])):
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func isParamName(s string) bool {
+	if s == "" || !isParamStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isParamChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isParamStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isParamChar(c byte) bool {
+	return isParamStart(c) || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,273 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// fieldCodes lists the "field: code" pairs of a validation error, sorted
+func fieldCodes(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("error %v is not a *ValidationError", err)
+	}
+	codes := make([]string, 0, len(verr.Fields))
+	for _, f := range verr.Fields {
+		codes = append(codes, f.Field+": "+f.Code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func TestScanNamed(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		wantSQL        string
+		wantNames      []string
+		wantPositional bool
+	}{
+		{
+			name:      "numbered in order of first use",
+			query:     "SELECT * FROM t WHERE a = :x OR b = :x AND c = :y",
+			wantSQL:   "SELECT * FROM t WHERE a = $1 OR b = $1 AND c = $2",
+			wantNames: []string{"x", "y"},
+		},
+		{
+			name:      "cast after parameter",
+			query:     "SELECT :id::int, created_at::date",
+			wantSQL:   "SELECT $1::int, created_at::date",
+			wantNames: []string{"id"},
+		},
+		{
+			name:      "string literal with doubled quote",
+			query:     "SELECT 'it''s :x', :y",
+			wantSQL:   "SELECT 'it''s :x', $1",
+			wantNames: []string{"y"},
+		},
+		{
+			name:      "escape string with backslash quote",
+			query:     `SELECT E'it\'s :x', :y`,
+			wantSQL:   `SELECT E'it\'s :x', $1`,
+			wantNames: []string{"y"},
+		},
+		{
+			name:      "backslash ends a standard string",
+			query:     `SELECT 'a\', :y`,
+			wantSQL:   `SELECT 'a\', $1`,
+			wantNames: []string{"y"},
+		},
+		{
+			name:      "quoted identifier",
+			query:     `SELECT ":x" FROM t WHERE a = :y`,
+			wantSQL:   `SELECT ":x" FROM t WHERE a = $1`,
+			wantNames: []string{"y"},
+		},
+		{
+			name:      "dollar-quoted body",
+			query:     "SELECT $$ :x $$, :y",
+			wantSQL:   "SELECT $$ :x $$, $1",
+			wantNames: []string{"y"},
+		},
+		{
+			name:      "tagged dollar-quoted body",
+			query:     "SELECT $fn$ :x $$ :z $fn$, :y",
+			wantSQL:   "SELECT $fn$ :x $$ :z $fn$, $1",
+			wantNames: []string{"y"},
+		},
+		{
+			name:      "line comment",
+			query:     "SELECT 1 -- :x\nWHERE a = :y",
+			wantSQL:   "SELECT 1 -- :x\nWHERE a = $1",
+			wantNames: []string{"y"},
+		},
+		{
+			name:      "nested block comment",
+			query:     "SELECT /* outer /* inner */ :x */ :y",
+			wantSQL:   "SELECT /* outer /* inner */ :x */ $1",
+			wantNames: []string{"y"},
+		},
+		{
+			name:           "positional placeholder",
+			query:          "SELECT * FROM t WHERE a = $1 AND b = :y",
+			wantSQL:        "SELECT * FROM t WHERE a = $1 AND b = $1",
+			wantNames:      []string{"y"},
+			wantPositional: true,
+		},
+		{
+			name:      "array slice",
+			query:     "SELECT a[x:y] FROM t WHERE b = :y",
+			wantSQL:   "SELECT a[x:y] FROM t WHERE b = $1",
+			wantNames: []string{"y"},
+		},
+		{
+			name:    "array slice without lower bound",
+			query:   "SELECT a[:n], a[1:2][:m] FROM t",
+			wantSQL: "SELECT a[:n], a[1:2][:m] FROM t",
+		},
+		{
+			name:      "parenthesized parameters in a subscript",
+			query:     "SELECT a[(:lo):(:hi)]",
+			wantSQL:   "SELECT a[($1):($2)]",
+			wantNames: []string{"lo", "hi"},
+		},
+		{
+			name:      "array constructor",
+			query:     "SELECT ARRAY[:a, :b], array [:c]",
+			wantSQL:   "SELECT ARRAY[$1, $2], array [$3]",
+			wantNames: []string{"a", "b", "c"},
+		},
+		{
+			name:      "named function argument",
+			query:     "SELECT f(x := :v)",
+			wantSQL:   "SELECT f(x := $1)",
+			wantNames: []string{"v"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, names, positional := scanNamed(tt.query, nil)
+			if sql != tt.wantSQL {
+				t.Errorf("sql = %q, want %q", sql, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("names = %q, want %q", names, tt.wantNames)
+			}
+			if positional != tt.wantPositional {
+				t.Errorf("positional = %v, want %v", positional, tt.wantPositional)
+			}
+		})
+	}
+}
+
+func TestValidateNamedParams(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		params    []NamedParam
+		wantCodes []string
+	}{
+		{
+			name:   "declared and used",
+			query:  "SELECT * FROM t WHERE id = :id AND name = :name",
+			params: []NamedParam{{Name: "id", Type: "integer"}, {Name: "name", Type: "text"}},
+		},
+		{
+			name:      "positional placeholder",
+			query:     "SELECT * FROM t WHERE id = $1",
+			wantCodes: []string{"sql: positional_parameter"},
+		},
+		{
+			name:      "undeclared and unused",
+			query:     "SELECT * FROM t WHERE id = :id",
+			params:    []NamedParam{{Name: "other", Type: "integer"}},
+			wantCodes: []string{"params: undeclared", "params: unused"},
+		},
+		{
+			name:  "invalid declarations",
+			query: "SELECT :a, :b",
+			params: []NamedParam{
+				{Name: "a", Type: "integer"},
+				{Name: "a", Type: "integer"},
+				{Name: "b", Type: "money"},
+				{Name: "1x", Type: "text"},
+			},
+			wantCodes: []string{"params[1]: duplicate", "params[2]: invalid_type", "params[3]: invalid_name"},
+		},
+		{
+			name:      "invalid default",
+			query:     "SELECT :n",
+			params:    []NamedParam{{Name: "n", Type: "integer", Default: "ten"}},
+			wantCodes: []string{"params[0]: invalid_default"},
+		},
+		{
+			name:   "slice bound is not a parameter",
+			query:  "SELECT a[1:n] FROM t WHERE id = :id",
+			params: []NamedParam{{Name: "id", Type: "integer"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codes := fieldCodes(t, ValidateNamedParams(tt.query, tt.params))
+			if !reflect.DeepEqual(codes, tt.wantCodes) {
+				t.Errorf("codes = %q, want %q", codes, tt.wantCodes)
+			}
+		})
+	}
+}
+
+func TestBindNamed(t *testing.T) {
+	query := "SELECT * FROM t WHERE id = :id AND n > :min AND tags @> :tags"
+	params := []NamedParam{
+		{Name: "id", Type: "integer", Required: true},
+		{Name: "min", Type: "integer", Default: json.Number("10")},
+		{Name: "tags", Type: "json"},
+	}
+	wantSQL := "SELECT * FROM t WHERE id = ($1::integer) AND n > ($2::integer) AND tags @> ($3::jsonb)"
+
+	tests := []struct {
+		name      string
+		values    map[string]interface{}
+		wantArgs  []interface{}
+		wantCodes []string
+	}{
+		{
+			name:     "all values",
+			values:   map[string]interface{}{"id": json.Number("7"), "min": "3", "tags": []interface{}{"a"}},
+			wantArgs: []interface{}{int64(7), int64(3), `["a"]`},
+		},
+		{
+			name:     "defaults and null",
+			values:   map[string]interface{}{"id": json.Number("7")},
+			wantArgs: []interface{}{int64(7), int64(10), nil},
+		},
+		{
+			name:     "explicit null takes the default",
+			values:   map[string]interface{}{"id": json.Number("7"), "min": nil},
+			wantArgs: []interface{}{int64(7), int64(10), nil},
+		},
+		{
+			name:      "required missing",
+			values:    map[string]interface{}{},
+			wantCodes: []string{"params.id: required"},
+		},
+		{
+			name:      "unknown value",
+			values:    map[string]interface{}{"id": json.Number("7"), "max": json.Number("1")},
+			wantCodes: []string{"params.max: unknown_parameter"},
+		},
+		{
+			name:      "value of the wrong type",
+			values:    map[string]interface{}{"id": "seven"},
+			wantCodes: []string{"params.id: invalid_type"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, args, err := BindNamed(query, params, tt.values)
+			codes := fieldCodes(t, err)
+			if !reflect.DeepEqual(codes, tt.wantCodes) {
+				t.Fatalf("codes = %q, want %q", codes, tt.wantCodes)
+			}
+			if err != nil {
+				return
+			}
+			if sql != wantSQL {
+				t.Errorf("sql = %q, want %q", sql, wantSQL)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %#v, want %#v", args, tt.wantArgs)
+			}
+		})
+	}
+}
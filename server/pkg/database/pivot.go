@@ -0,0 +1,339 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Limits of a pivot table
+const (
+	defaultPivotColumns = 50
+	maxPivotColumns     = 200
+)
+
+// PivotQuery crosstabs the rows of a table matching Filter: one row per
+// combination of Rows, one column per value of Column and Aggregate in each cell
+type PivotQuery struct {
+	Table     string     `json:"table"`
+	Rows      []GroupKey `json:"rows"`
+	Column    GroupKey   `json:"column"`
+	Aggregate Aggregate  `json:"aggregate"`
+	Filter    *Filter    `json:"filter,omitempty"`
+	// MaxColumns caps the pivot columns; values beyond it are left out of the cells but not the totals
+	MaxColumns int `json:"maxColumns,omitempty"`
+	// Limit caps the rows, subtotals included
+	Limit int `json:"limit,omitempty"`
+}
+
+// PivotColumn is a value of the column dimension
+type PivotColumn struct {
+	Value interface{} `json:"value"`
+}
+
+// PivotRow is a row of a pivot table. Subtotal rows fix only the first Level
+// row dimensions and come before the rows they summarize.
+type PivotRow struct {
+	Keys     []interface{} `json:"keys"`
+	Level    int           `json:"level"`
+	Subtotal bool          `json:"subtotal"`
+	// Cells are aligned with the pivot columns; empty combinations are null
+	Cells []interface{} `json:"cells"`
+	Total interface{}   `json:"total"`
+}
+
+// PivotResult is a crosstab with row totals, subtotals and grand totals
+type PivotResult struct {
+	RowDimensions    []ResultColumn `json:"rowDimensions"`
+	ColumnDimension  ResultColumn   `json:"columnDimension"`
+	Measure          ResultColumn   `json:"measure"`
+	Columns          []PivotColumn  `json:"columns"`
+	ColumnsTruncated bool           `json:"columnsTruncated"`
+	Rows             []PivotRow     `json:"rows"`
+	Totals           PivotRow       `json:"totals"`
+	Truncated        bool           `json:"truncated"`
+}
+
+// pivotPlan is a validated pivot query
+type pivotPlan struct {
+	// values lists the distinct values of the column dimension, in column order
+	values string
+	// cells computes every cell, subtotal and total with grouping flags for the
+	// row dimensions and the column dimension, and whether the column value is
+	// one of the capped values
+	cells string
+	args  []interface{}
+
+	rows    []ResultColumn
+	column  ResultColumn
+	measure ResultColumn
+}
+
+// plan validates q against schema and builds its queries
+func (q PivotQuery) plan(schema *TableSchema) (*pivotPlan, error) {
+	columns := columnsByName(schema)
+	verr := &ValidationError{}
+
+	if len(q.Rows) == 0 {
+		verr.add("rows", "required", "at least one row dimension is required")
+	}
+	if len(q.Rows) > maxGroupKeys {
+		verr.add("rows", "too_many", "at most %d row dimensions are allowed", maxGroupKeys)
+	}
+	if q.MaxColumns < 0 || q.MaxColumns > maxPivotColumns {
+		verr.add("maxColumns", "out_of_range", "maxColumns must be between 1 and %d", maxPivotColumns)
+	}
+	if q.Limit < 0 || q.Limit > maxAggregateRows {
+		verr.add("limit", "out_of_range", "limit must be between 1 and %d", maxAggregateRows)
+	}
+
+	names := make(map[string]bool)
+	unique := func(field, name string) {
+		if names[name] {
+			verr.add(field, "duplicate", "dimension %q is used twice", name)
+		}
+		names[name] = true
+	}
+
+	p := &pivotPlan{}
+	rowExprs := make([]string, len(q.Rows))
+	for i, k := range q.Rows {
+		field := fmt.Sprintf("rows[%d]", i)
+		rowExprs[i] = groupExpr(k, field, columns, verr)
+		unique(field, k.Name())
+		p.rows = append(p.rows, ResultColumn{Name: k.Name(), Role: "dimension", Column: k.Column, Bucket: k.Bucket})
+	}
+	columnExpr := groupExpr(q.Column, "column", columns, verr)
+	unique("column", q.Column.Name())
+	p.column = ResultColumn{Name: q.Column.Name(), Role: "dimension", Column: q.Column.Column, Bucket: q.Column.Bucket}
+	measureExpr := aggregateExpr(q.Aggregate, "aggregate", columns, verr)
+	p.measure = ResultColumn{Name: q.Aggregate.Name(), Role: "measure", Column: q.Aggregate.Column, Func: q.Aggregate.Func}
+
+	where, _, args, _, whereErr := TableQuery{Table: q.Table, Filter: q.Filter}.where(schema)
+	if err := joinValidation(verr.errOrNil(), whereErr); err != nil {
+		return nil, err
+	}
+	p.args = args
+
+	maxColumns := q.MaxColumns
+	if maxColumns == 0 {
+		maxColumns = defaultPivotColumns
+	}
+	from := pq.QuoteIdentifier(q.Table) + where
+
+	values := fmt.Sprintf("SELECT DISTINCT %s FROM %s ORDER BY 1 NULLS LAST", columnExpr, from)
+	p.values = fmt.Sprintf("%s LIMIT %d", values, maxColumns+1)
+
+	// Rows are flagged when their column value is one of the pivot columns,
+	// the first maxColumns values of the values query. IN misses a null value,
+	// which is matched separately.
+	capped := fmt.Sprintf("(%[1]s IN (SELECT v FROM pivot_columns)) IS TRUE OR (%[1]s IS NULL AND EXISTS (SELECT 1 FROM pivot_columns WHERE v IS NULL))", columnExpr)
+	source := fmt.Sprintf("(SELECT *, %s AS pivot_capped FROM %s) pivot_rows", capped, from)
+	cellExpr := fmt.Sprintf("CASE WHEN pivot_capped THEN %s END", columnExpr)
+
+	// Each prefix of the row dimensions, from all of them down to none, is
+	// grouped with and without the column dimension. Cells group the values
+	// beyond the cap together, apart from null, so they add one group per
+	// row at most; the sets without the column keep totals over all values.
+	var sets []string
+	for n := len(rowExprs); n >= 0; n-- {
+		prefix := rowExprs[:n]
+		sets = append(sets, "("+strings.Join(append(append([]string{}, prefix...), "pivot_capped", cellExpr), ", ")+")")
+		sets = append(sets, "("+strings.Join(prefix, ", ")+")")
+	}
+
+	// Higher levels sort first, so the grand total leads and each subtotal
+	// precedes its group; a truncated result keeps them
+	selected := append(append([]string{}, rowExprs...), cellExpr, measureExpr)
+	var order []string
+	for _, expr := range append(append([]string{}, rowExprs...), cellExpr) {
+		selected = append(selected, "GROUPING("+expr+")")
+		order = append(order, "GROUPING("+expr+") DESC", expr+" NULLS LAST")
+	}
+	selected = append(selected, "pivot_capped")
+	p.cells = fmt.Sprintf("WITH pivot_columns (v) AS (%s LIMIT %d) SELECT %s FROM %s GROUP BY GROUPING SETS (%s) ORDER BY %s",
+		values, maxColumns, strings.Join(selected, ", "), source, strings.Join(sets, ", "), strings.Join(order, ", "))
+	return p, nil
+}
+
+// BuildPivotQuery returns the SQL and arguments computing the cells of a pivot table
+func (dm *DatabaseManager) BuildPivotQuery(ctx context.Context, q PivotQuery) (string, []interface{}, error) {
+	schema, err := dm.GetTableSchema(ctx, q.Table)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get schema: %w", err)
+	}
+	p, err := q.plan(schema)
+	if err != nil {
+		return "", nil, err
+	}
+	return p.cells, p.args, nil
+}
+
+// Pivot computes a pivot table. Columns are the values of the column
+// dimension in ascending order with nulls last; totals and subtotals are
+// aggregated by PostgreSQL, so they are exact for every aggregate and include
+// the values beyond the column cap, which get no cells.
+func (dm *DatabaseManager) Pivot(ctx context.Context, q PivotQuery) (_ *PivotResult, err error) {
+	ctx, op := dm.startOp(ctx, "Pivot", q.Table)
+	defer op.end(&err)
+	db, err := dm.db()
+	if err != nil {
+		return nil, err
+	}
+
+	schema, err := dm.GetTableSchema(ctx, q.Table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schema: %w", err)
+	}
+	p, err := q.plan(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PivotResult{
+		RowDimensions:   p.rows,
+		ColumnDimension: p.column,
+		Measure:         p.measure,
+		Columns:         make([]PivotColumn, 0),
+		Rows:            make([]PivotRow, 0),
+	}
+
+	// Column values
+	maxColumns := q.MaxColumns
+	if maxColumns == 0 {
+		maxColumns = defaultPivotColumns
+	}
+	op.statement(p.values)
+	rows, err := db.QueryContext(ctx, p.values, p.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pivot columns: %w", err)
+	}
+	defer rows.Close()
+	index := make(map[string]int)
+	for rows.Next() {
+		if len(result.Columns) == maxColumns {
+			result.ColumnsTruncated = true
+			break
+		}
+		var v interface{}
+		if err := rows.Scan(&v); err != nil {
+			return nil, fmt.Errorf("failed to scan pivot column: %w", err)
+		}
+		value := resultValue(v, false)
+		index[pivotKey(value)] = len(result.Columns)
+		result.Columns = append(result.Columns, PivotColumn{Value: value})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read pivot columns: %w", err)
+	}
+	rows.Close()
+
+	// Cells, subtotals and totals; the query is canceled rather than read to
+	// the end once the row limit is reached
+	cellsCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	op.statement(p.cells)
+	rows, err = db.QueryContext(cellsCtx, p.cells, p.args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute pivot: %w", err)
+	}
+	defer rows.Close()
+
+	dims := len(p.rows)
+	numeric, err := numericColumns(rows)
+	if err != nil {
+		return nil, err
+	}
+	limit := q.Limit
+	if limit == 0 {
+		limit = defaultAggregateRows
+	}
+	values := make([]interface{}, dims+2)
+	grouping := make([]int, dims+1)
+	var capped sql.NullBool
+	ptrs := make([]interface{}, 0, len(values)+len(grouping)+1)
+	for i := range values {
+		ptrs = append(ptrs, &values[i])
+	}
+	for i := range grouping {
+		ptrs = append(ptrs, &grouping[i])
+	}
+	ptrs = append(ptrs, &capped)
+
+	var current *PivotRow
+	newRow := func() *PivotRow {
+		return &PivotRow{Keys: make([]interface{}, 0, dims), Cells: make([]interface{}, len(result.Columns))}
+	}
+	grand := newRow()
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, fmt.Errorf("failed to scan pivot row: %w", err)
+		}
+		// Cells of the values beyond the cap
+		if grouping[dims] == 0 && !capped.Bool {
+			continue
+		}
+
+		// The level is the number of row dimensions grouped on
+		level := 0
+		for level < dims && grouping[level] == 0 {
+			level++
+		}
+		target := grand
+		if level > 0 {
+			keys := make([]interface{}, level)
+			for i := range keys {
+				keys[i] = resultValue(values[i], false)
+			}
+			if current == nil || current.Level != level || !sameKeys(current.Keys, keys) {
+				if len(result.Rows) == limit {
+					result.Truncated = true
+					cancel()
+					break
+				}
+				result.Rows = append(result.Rows, *newRow())
+				current = &result.Rows[len(result.Rows)-1]
+				current.Keys, current.Level, current.Subtotal = keys, level, level < dims
+			}
+			target = current
+		}
+
+		measure := resultValue(values[dims+1], numeric[dims+1])
+		if grouping[dims] == 1 {
+			target.Total = measure
+		} else if i, ok := index[pivotKey(resultValue(values[dims], false))]; ok {
+			target.Cells[i] = measure
+		}
+	}
+	// A truncated read was canceled, which Err reports
+	if err := rows.Err(); err != nil && !result.Truncated {
+		return nil, fmt.Errorf("failed to read pivot rows: %w", err)
+	}
+
+	result.Totals = *grand
+	op.returned(len(result.Rows))
+	return result, nil
+}
+
+// pivotKey identifies a dimension value across queries
+func pivotKey(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// sameKeys reports whether two rows have the same dimension values
+func sameKeys(a, b []interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if pivotKey(a[i]) != pivotKey(b[i]) {
+			return false
+		}
+	}
+	return true
+}
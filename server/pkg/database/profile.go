@@ -0,0 +1,493 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// Profile sources
+const (
+	ProfileSourceAuto   = "auto"
+	ProfileSourceStats  = "stats"
+	ProfileSourceSample = "sample"
+)
+
+const (
+	// Statistics are fresh while at most this fraction of rows changed since the last analyze
+	statsStaleFraction = 0.1
+	// Rows a sample aims for when no sample size is given
+	profileSampleRows = 100000
+	// Buckets of histograms and length distributions
+	profileBuckets = 10
+	// Distinct lengths read from a sample; longer tails are cut
+	maxProfileLengths = 1000
+)
+
+// ProfileOptions controls how a column is profiled
+type ProfileOptions struct {
+	// Source is auto, stats or sample; auto uses pg_stats when fresh
+	Source string
+	// SamplePercent of the table's pages to sample; derived from the row estimate when zero
+	SamplePercent float64
+	// TopN is the number of most common values returned
+	TopN int
+	// Budget bounds the time spent sampling; what was computed by then is returned as partial
+	Budget time.Duration
+}
+
+// ColumnProfile summarizes the values of a column. Fractions are of all rows.
+// From pg_stats, the histogram covers the values other than the top values;
+// from a sample it covers all non-null values and distinctCount is that of
+// the sample.
+type ColumnProfile struct {
+	Table         string              `json:"table"`
+	Column        string              `json:"column"`
+	DataType      string              `json:"dataType"`
+	Source        string              `json:"source"`
+	AnalyzedAt    *time.Time          `json:"analyzedAt,omitempty"`
+	SamplePercent float64             `json:"samplePercent,omitempty"`
+	SampledRows   int64               `json:"sampledRows,omitempty"`
+	RowEstimate   int64               `json:"rowEstimate"`
+	NullFraction  float64             `json:"nullFraction"`
+	DistinctCount float64             `json:"distinctCount"`
+	Min           *string             `json:"min"`
+	Max           *string             `json:"max"`
+	TopValues     []ValueFrequency    `json:"topValues"`
+	Lengths       *LengthDistribution `json:"lengths,omitempty"`
+	Histogram     []HistogramBucket   `json:"histogram,omitempty"`
+	// Partial is set when the time budget ran out before every part was computed
+	Partial bool `json:"partial"`
+}
+
+// ValueFrequency is a common value of a column
+type ValueFrequency struct {
+	Value     string  `json:"value"`
+	Frequency float64 `json:"frequency"`
+	Count     int64   `json:"count,omitempty"`
+}
+
+// LengthDistribution describes the lengths in characters of text values
+type LengthDistribution struct {
+	Min     int            `json:"min"`
+	Max     int            `json:"max"`
+	Avg     float64        `json:"avg"`
+	Buckets []LengthBucket `json:"buckets"`
+}
+
+// LengthBucket holds the fraction of non-null values with a length in [From, To]
+type LengthBucket struct {
+	From     int     `json:"from"`
+	To       int     `json:"to"`
+	Fraction float64 `json:"fraction"`
+}
+
+// HistogramBucket holds the fraction of rows with a value between Lower and Upper
+type HistogramBucket struct {
+	Lower    string  `json:"lower"`
+	Upper    string  `json:"upper"`
+	Fraction float64 `json:"fraction"`
+}
+
+// columnKind groups column types by the statistics that make sense for them
+func columnKind(dataType string) string {
+	switch strings.ToLower(dataType) {
+	case "text", "character varying", "character":
+		return "text"
+	case "smallint", "integer", "bigint", "numeric", "real", "double precision":
+		return "number"
+	case "date", "timestamp without time zone", "timestamp with time zone":
+		return "date"
+	default:
+		return ""
+	}
+}
+
+// ProfileColumn summarizes the values of a column from pg_stats or a sample
+func (dm *DatabaseManager) ProfileColumn(ctx context.Context, tableName, columnName string, opts ProfileOptions) (_ *ColumnProfile, err error) {
+	ctx, op := dm.startOp(ctx, "ProfileColumn", tableName)
+	defer op.end(&err)
+	db, err := dm.db()
+	if err != nil {
+		return nil, err
+	}
+
+	schema, err := dm.GetTableSchema(ctx, tableName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schema: %w", err)
+	}
+	col, ok := columnsByName(schema)[columnName]
+	if !ok {
+		verr := &ValidationError{}
+		verr.add("column", "unknown_column", "column %q does not exist", columnName)
+		return nil, verr
+	}
+
+	profile := &ColumnProfile{Table: tableName, Column: columnName, DataType: col.DataType, TopValues: []ValueFrequency{}}
+	fresh, err := dm.loadTableActivity(ctx, db, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.Source {
+	case ProfileSourceAuto, "":
+		if fresh && opts.SamplePercent == 0 {
+			found, err := dm.profileFromStats(ctx, db, profile, opts.TopN)
+			if err != nil || found {
+				return profile, err
+			}
+		}
+	case ProfileSourceStats:
+		found, err := dm.profileFromStats(ctx, db, profile, opts.TopN)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			verr := &ValidationError{}
+			verr.add("source", "no_statistics", "the column has no statistics; run ANALYZE or use a sample")
+			return nil, verr
+		}
+		return profile, nil
+	case ProfileSourceSample:
+	default:
+		verr := &ValidationError{}
+		verr.add("source", "invalid_value", "source must be auto, stats or sample")
+		return nil, verr
+	}
+
+	if err := dm.profileFromSample(ctx, op, db, profile, opts); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// loadTableActivity sets the row estimate and last analyze time of the table
+// and reports whether its statistics are fresh
+func (dm *DatabaseManager) loadTableActivity(ctx context.Context, db *sql.DB, profile *ColumnProfile) (bool, error) {
+	query := `
+		SELECT
+			GREATEST(c.reltuples, COALESCE(s.n_live_tup, 0))::bigint,
+			GREATEST(s.last_analyze, s.last_autoanalyze),
+			COALESCE(s.n_mod_since_analyze, 0)
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_stat_user_tables s ON s.relid = c.oid
+		WHERE n.nspname = 'public' AND c.relname = $1
+	`
+
+	var analyzedAt sql.NullTime
+	var modified int64
+	err := db.QueryRowContext(ctx, query, profile.Table).Scan(&profile.RowEstimate, &analyzedAt, &modified)
+	if err == sql.ErrNoRows {
+		return false, fmt.Errorf("%w: %s", ErrTableNotFound, profile.Table)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get table activity: %w", err)
+	}
+
+	if !analyzedAt.Valid {
+		return false, nil
+	}
+	profile.AnalyzedAt = &analyzedAt.Time
+	return float64(modified) <= statsStaleFraction*math.Max(float64(profile.RowEstimate), 1), nil
+}
+
+// profileFromStats fills profile from pg_stats and reports whether the column has statistics
+func (dm *DatabaseManager) profileFromStats(ctx context.Context, db *sql.DB, profile *ColumnProfile, topN int) (bool, error) {
+	query := `
+		SELECT
+			null_frac,
+			n_distinct,
+			most_common_vals::text::text[],
+			most_common_freqs,
+			histogram_bounds::text::text[]
+		FROM pg_stats
+		WHERE schemaname = 'public' AND tablename = $1 AND attname = $2
+	`
+
+	var nDistinct float64
+	var values, bounds pq.StringArray
+	var freqs pq.Float64Array
+	err := db.QueryRowContext(ctx, query, profile.Table, profile.Column).Scan(&profile.NullFraction, &nDistinct, &values, &freqs, &bounds)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read column statistics: %w", err)
+	}
+
+	profile.Source = ProfileSourceStats
+	// Negative counts are a fraction of the rows, so they scale with the table
+	profile.DistinctCount = nDistinct
+	if nDistinct < 0 {
+		profile.DistinctCount = math.Round(-nDistinct * float64(profile.RowEstimate))
+	}
+
+	common := 0.0
+	for i, v := range values {
+		if i < len(freqs) {
+			common += freqs[i]
+			if i < topN {
+				profile.TopValues = append(profile.TopValues, ValueFrequency{Value: v, Frequency: freqs[i]})
+			}
+		}
+	}
+
+	// The histogram holds the values other than the most common ones, in
+	// buckets of equal frequency
+	kind := columnKind(profile.DataType)
+	rest := math.Max(1-profile.NullFraction-common, 0)
+	if len(bounds) > 1 && (kind == "number" || kind == "date") {
+		profile.Histogram = histogramFromBounds(bounds, rest)
+	}
+
+	// The extremes may be common values as well as histogram bounds, and a
+	// column with few distinct values has only common values
+	if kind != "" && len(values)+len(bounds) > 0 {
+		typ := profile.DataType
+		if kind == "text" {
+			typ = "text"
+		}
+		query := fmt.Sprintf("SELECT min(v)::text, max(v)::text FROM unnest($1::text[]::%s[]) v", typ)
+		all := append(append([]string{}, values...), bounds...)
+		var minValue, maxValue sql.NullString
+		if err := db.QueryRowContext(ctx, query, pq.Array(all)).Scan(&minValue, &maxValue); err != nil {
+			return false, fmt.Errorf("failed to read column statistics: %w", err)
+		}
+		if minValue.Valid {
+			profile.Min, profile.Max = &minValue.String, &maxValue.String
+		}
+	}
+
+	if kind == "text" {
+		var points []lengthPoint
+		for i, v := range values {
+			if i < len(freqs) {
+				points = append(points, lengthPoint{utf8.RuneCountInString(v), freqs[i]})
+			}
+		}
+		for _, b := range bounds {
+			points = append(points, lengthPoint{utf8.RuneCountInString(b), rest / float64(len(bounds))})
+		}
+		profile.Lengths = lengthDistribution(points)
+	}
+	return true, nil
+}
+
+// profileFromSample fills profile from a TABLESAMPLE scan of the table. The
+// scan is repeatable, so every query sees the same rows, and runs in a
+// read-only transaction bounded by the budget.
+func (dm *DatabaseManager) profileFromSample(ctx context.Context, op *operation, db *sql.DB, profile *ColumnProfile, opts ProfileOptions) error {
+	percent := opts.SamplePercent
+	if percent == 0 {
+		percent = 100
+		if profile.RowEstimate > profileSampleRows {
+			percent = math.Max(100*float64(profileSampleRows)/float64(profile.RowEstimate), 0.01)
+		}
+	}
+	profile.Source = ProfileSourceSample
+	profile.SamplePercent = percent
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Budget)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The server stops on its own too, should the cancel request be lost. A
+	// timeout of 0 would disable it, so it is at least 1ms.
+	timeout := max(opts.Budget.Milliseconds(), 1)
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", timeout)); err != nil {
+		return fmt.Errorf("failed to set statement timeout: %w", err)
+	}
+
+	source := pq.QuoteIdentifier(profile.Table)
+	if percent < 100 {
+		source += fmt.Sprintf(" TABLESAMPLE SYSTEM (%g) REPEATABLE (0)", percent)
+	}
+	sample := fmt.Sprintf("(SELECT %s AS v FROM %s) s", pq.QuoteIdentifier(profile.Column), source)
+	kind := columnKind(profile.DataType)
+
+	// The summary is required; the rest is skipped once the budget runs out
+	minMax := "NULL::text, NULL::text"
+	if kind != "" {
+		minMax = "min(v)::text, max(v)::text"
+	}
+	query := fmt.Sprintf("SELECT count(*), count(v), count(DISTINCT v::text), %s FROM %s", minMax, sample)
+	op.statement(query)
+	var total, nonNull int64
+	var minValue, maxValue sql.NullString
+	if err := tx.QueryRowContext(ctx, query).Scan(&total, &nonNull, &profile.DistinctCount, &minValue, &maxValue); err != nil {
+		if budgetExceeded(ctx, err) {
+			return fmt.Errorf("failed to sample column within %s: %w", opts.Budget, context.DeadlineExceeded)
+		}
+		return fmt.Errorf("failed to sample column: %w", err)
+	}
+	profile.SampledRows = total
+	if minValue.Valid {
+		profile.Min, profile.Max = &minValue.String, &maxValue.String
+	}
+	if total == 0 {
+		return nil
+	}
+	profile.NullFraction = float64(total-nonNull) / float64(total)
+
+	steps := []func() error{
+		func() error {
+			query := fmt.Sprintf("SELECT v::text, count(*) FROM %s WHERE v IS NOT NULL GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT %d", sample, opts.TopN)
+			return scanRows(ctx, tx, query, func(rows *sql.Rows) error {
+				var v ValueFrequency
+				if err := rows.Scan(&v.Value, &v.Count); err != nil {
+					return err
+				}
+				v.Frequency = float64(v.Count) / float64(total)
+				profile.TopValues = append(profile.TopValues, v)
+				return nil
+			})
+		},
+	}
+	if kind == "text" {
+		steps = append(steps, func() error {
+			query := fmt.Sprintf("SELECT char_length(v), count(*) FROM %s WHERE v IS NOT NULL GROUP BY 1 ORDER BY 2 DESC LIMIT %d", sample, maxProfileLengths)
+			var points []lengthPoint
+			err := scanRows(ctx, tx, query, func(rows *sql.Rows) error {
+				var p lengthPoint
+				var count int64
+				if err := rows.Scan(&p.length, &count); err != nil {
+					return err
+				}
+				p.weight = float64(count) / float64(total)
+				points = append(points, p)
+				return nil
+			})
+			profile.Lengths = lengthDistribution(points)
+			return err
+		})
+	}
+	if (kind == "number" || kind == "date") && nonNull > 1 {
+		steps = append(steps, func() error {
+			fractions := make([]string, profileBuckets+1)
+			for i := range fractions {
+				fractions[i] = fmt.Sprintf("%g", float64(i)/profileBuckets)
+			}
+			query := fmt.Sprintf("SELECT percentile_disc(ARRAY[%s]) WITHIN GROUP (ORDER BY v)::text[] FROM %s",
+				strings.Join(fractions, ", "), sample)
+			var bounds pq.StringArray
+			if err := tx.QueryRowContext(ctx, query).Scan(&bounds); err != nil {
+				return err
+			}
+			profile.Histogram = histogramFromBounds(bounds, 1-profile.NullFraction)
+			return nil
+		})
+	}
+
+	for _, step := range steps {
+		if err := step(); err != nil {
+			if budgetExceeded(ctx, err) {
+				profile.Partial = true
+				return nil
+			}
+			return fmt.Errorf("failed to profile column: %w", err)
+		}
+	}
+	return nil
+}
+
+// scanRows runs query and calls fn for each row
+func scanRows(ctx context.Context, tx *sql.Tx, query string, fn func(*sql.Rows) error) error {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// budgetExceeded reports whether err came from running out of the time budget
+func budgetExceeded(ctx context.Context, err error) bool {
+	var pqErr *pq.Error
+	return errors.Is(ctx.Err(), context.DeadlineExceeded) ||
+		(errors.As(err, &pqErr) && pqErr.Code == "57014")
+}
+
+// histogramFromBounds turns equal-frequency bounds into at most profileBuckets
+// buckets sharing fraction of the rows
+func histogramFromBounds(bounds []string, fraction float64) []HistogramBucket {
+	if len(bounds) < 2 {
+		return nil
+	}
+	n := len(bounds) - 1
+	buckets := n
+	if buckets > profileBuckets {
+		buckets = profileBuckets
+	}
+
+	histogram := make([]HistogramBucket, 0, buckets)
+	prev := 0
+	for i := 1; i <= buckets; i++ {
+		next := int(math.Round(float64(i) * float64(n) / float64(buckets)))
+		histogram = append(histogram, HistogramBucket{
+			Lower:    bounds[prev],
+			Upper:    bounds[next],
+			Fraction: fraction * float64(next-prev) / float64(n),
+		})
+		prev = next
+	}
+	return histogram
+}
+
+// lengthPoint is a value length with the fraction of rows having it
+type lengthPoint struct {
+	length int
+	weight float64
+}
+
+// lengthDistribution summarizes weighted lengths in equal-width buckets, with
+// fractions of the non-null values
+func lengthDistribution(points []lengthPoint) *LengthDistribution {
+	if len(points) == 0 {
+		return nil
+	}
+
+	d := &LengthDistribution{Min: points[0].length, Max: points[0].length}
+	total, sum := 0.0, 0.0
+	for _, p := range points {
+		if p.length < d.Min {
+			d.Min = p.length
+		}
+		if p.length > d.Max {
+			d.Max = p.length
+		}
+		total += p.weight
+		sum += float64(p.length) * p.weight
+	}
+	if total == 0 {
+		return d
+	}
+	d.Avg = sum / total
+
+	width := (d.Max - d.Min + profileBuckets) / profileBuckets
+	d.Buckets = make([]LengthBucket, 0, profileBuckets)
+	for from := d.Min; from <= d.Max; from += width {
+		d.Buckets = append(d.Buckets, LengthBucket{From: from, To: from + width - 1})
+	}
+	for _, p := range points {
+		d.Buckets[(p.length-d.Min)/width].Fraction += p.weight / total
+	}
+	return d
+}
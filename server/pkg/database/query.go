@@ -0,0 +1,447 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Most conditions a filter tree may hold, to keep generated queries reasonable
+const maxFilterConditions = 50
+
+// Filter logics and the operators a condition can use
+const (
+	LogicAnd = "and"
+	LogicOr  = "or"
+)
+
+// comparisonOps maps the comparison operators to SQL
+var comparisonOps = map[string]string{
+	"eq":  "=",
+	"neq": "<>",
+	"lt":  "<",
+	"lte": "<=",
+	"gt":  ">",
+	"gte": ">=",
+}
+
+// patternOps maps the text match operators to the LIKE pattern around the value
+var patternOps = map[string]string{
+	"contains":   "%%%s%%",
+	"startsWith": "%s%%",
+	"endsWith":   "%%%s",
+}
+
+// Search modes, from the most to the least selective
+const (
+	SearchTSVector = "tsvector"
+	SearchTrigram  = "trigram"
+	SearchILike    = "ilike"
+)
+
+// Key of the row field listing the columns a search matched
+const MatchedColumnsKey = "_matchedColumns"
+
+// searchableTypes are the column types quick search matches with ILIKE; those
+// mapped to true are compared through their text form
+var searchableTypes = map[string]bool{
+	"text":              false,
+	"character varying": false,
+	"character":         false,
+	"uuid":              true,
+	"smallint":          true,
+	"integer":           true,
+	"bigint":            true,
+	"numeric":           true,
+	"real":              true,
+	"double precision":  true,
+}
+
+// Filter is a node of a filter tree. A group has Logic and combines its
+// Filters; a condition has Column and Op and compares the column with Value.
+type Filter struct {
+	Logic   string      `json:"logic,omitempty"`
+	Filters []Filter    `json:"filters,omitempty"`
+	Column  string      `json:"column,omitempty"`
+	Op      string      `json:"op,omitempty"`
+	Value   interface{} `json:"value,omitempty"`
+}
+
+// SortKey orders rows by a column, ascending unless Direction is desc
+type SortKey struct {
+	Column    string `json:"column"`
+	Direction string `json:"direction,omitempty"`
+}
+
+// TableQuery describes the page of rows read from a table. It is the single
+// place the data query is built, so what GetTableDataPaginated runs and what
+// Explain reports are always the same statement.
+type TableQuery struct {
+	Table    string    `json:"table"`
+	Page     int       `json:"page"`
+	PageSize int       `json:"pageSize"`
+	Filter   *Filter   `json:"filter,omitempty"`
+	Sort     []SortKey `json:"sort,omitempty"`
+	// Search is a quick search term matched across the columns of the table
+	Search string `json:"search,omitempty"`
+}
+
+// Build returns the SQL and its arguments. Filter and sort columns are checked
+// against schema and filter values are coerced to their column types. With a
+// search, each row also lists the columns that matched under MatchedColumnsKey.
+func (q TableQuery) Build(schema *TableSchema) (string, []interface{}, error) {
+	where, matched, args, _, whereErr := q.where(schema)
+	orderBy, orderErr := q.orderBy(schema)
+	if whereErr != nil || orderErr != nil {
+		return "", nil, joinValidation(whereErr, orderErr)
+	}
+
+	selected := "*"
+	if matched != "" {
+		selected = fmt.Sprintf("*, %s AS %s", matched, pq.QuoteIdentifier(MatchedColumnsKey))
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s%s%s LIMIT %d OFFSET %d",
+		selected,
+		pq.QuoteIdentifier(q.Table),
+		where,
+		orderBy,
+		q.PageSize,
+		q.Page*q.PageSize,
+	)
+	return query, args, nil
+}
+
+// BuildCount returns the SQL counting the rows matching the filter and search, and its arguments
+func (q TableQuery) BuildCount(schema *TableSchema) (string, []interface{}, error) {
+	where, _, args, whereArgs, err := q.where(schema)
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("SELECT COUNT(*) FROM %s%s", pq.QuoteIdentifier(q.Table), where), args[:whereArgs], nil
+}
+
+// filtered reports whether the query narrows the rows of the table
+func (q TableQuery) filtered() bool {
+	return q.Filter != nil || strings.TrimSpace(q.Search) != ""
+}
+
+// digest identifies the filter, search and sort of q in cache keys
+func (q TableQuery) digest() string {
+	data, _ := json.Marshal(struct {
+		Filter *Filter   `json:"filter"`
+		Sort   []SortKey `json:"sort"`
+		Search string    `json:"search"`
+	}{q.Filter, q.Sort, strings.TrimSpace(q.Search)})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// where returns the WHERE clause of the filter and search, empty without
+// them, and with a search the expression listing the matched columns. The
+// first whereArgs arguments are those the WHERE clause uses.
+func (q TableQuery) where(schema *TableSchema) (clause, matched string, args []interface{}, whereArgs int, err error) {
+	if !q.filtered() {
+		return "", "", nil, 0, nil
+	}
+
+	b := &filterBuilder{columns: columnsByName(schema), verr: &ValidationError{}}
+	var conditions []string
+	if q.Filter != nil {
+		conditions = append(conditions, b.build(*q.Filter, "filter"))
+		if b.conditions > maxFilterConditions {
+			b.verr.add("filter", "too_complex", "filter may hold at most %d conditions", maxFilterConditions)
+		}
+	}
+
+	whereArgs = len(b.args)
+	if term := strings.TrimSpace(q.Search); term != "" {
+		var cond string
+		cond, matched, whereArgs = b.search(schema, term)
+		conditions = append(conditions, cond)
+	}
+
+	if err := b.verr.errOrNil(); err != nil {
+		return "", "", nil, 0, err
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), matched, b.args, whereArgs, nil
+}
+
+// SearchStrategy returns how a quick search of the table runs and the
+// columns it looks in: tsvector columns when the table has any, else the
+// columns with a trigram index, else every text, uuid and numeric column
+func SearchStrategy(schema *TableSchema) (string, []string) {
+	var tsvector, text []string
+	for _, col := range schema.Columns {
+		switch dataType := strings.ToLower(col.DataType); {
+		case dataType == "tsvector":
+			tsvector = append(tsvector, col.Name)
+		case isSearchable(dataType):
+			text = append(text, col.Name)
+		}
+	}
+
+	switch {
+	case len(tsvector) > 0:
+		return SearchTSVector, tsvector
+	case len(schema.TrigramColumns) > 0:
+		return SearchTrigram, schema.TrigramColumns
+	default:
+		return SearchILike, text
+	}
+}
+
+func isSearchable(dataType string) bool {
+	_, ok := searchableTypes[dataType]
+	return ok
+}
+
+// orderBy returns the ORDER BY clause of the sort, empty without one. Primary
+// key columns not sorted on are appended so pages are stable.
+func (q TableQuery) orderBy(schema *TableSchema) (string, error) {
+	if len(q.Sort) == 0 {
+		return "", nil
+	}
+
+	columns := columnsByName(schema)
+	verr := &ValidationError{}
+	sorted := make(map[string]bool, len(q.Sort))
+	terms := make([]string, 0, len(q.Sort))
+	for i, key := range q.Sort {
+		field := fmt.Sprintf("sort[%d]", i)
+		if _, ok := columns[key.Column]; !ok {
+			verr.add(field, "unknown_column", "column %q does not exist", key.Column)
+			continue
+		}
+		var direction string
+		switch strings.ToLower(key.Direction) {
+		case "", "asc":
+			direction = "ASC"
+		case "desc":
+			direction = "DESC"
+		default:
+			verr.add(field, "invalid_value", "direction must be asc or desc")
+			continue
+		}
+		if sorted[key.Column] {
+			verr.add(field, "duplicate", "column %q is sorted twice", key.Column)
+			continue
+		}
+		sorted[key.Column] = true
+		terms = append(terms, pq.QuoteIdentifier(key.Column)+" "+direction)
+	}
+	if err := verr.errOrNil(); err != nil {
+		return "", err
+	}
+
+	for _, col := range schema.Columns {
+		if col.IsPrimary && !sorted[col.Name] {
+			terms = append(terms, pq.QuoteIdentifier(col.Name)+" ASC")
+		}
+	}
+	return " ORDER BY " + strings.Join(terms, ", "), nil
+}
+
+// filterBuilder turns a filter tree into SQL, collecting $n arguments and errors
+type filterBuilder struct {
+	columns    map[string]ColumnSchema
+	args       []interface{}
+	conditions int
+	verr       *ValidationError
+}
+
+func (b *filterBuilder) build(f Filter, field string) string {
+	if f.Logic != "" || len(f.Filters) > 0 {
+		return b.group(f, field)
+	}
+	return b.condition(f, field)
+}
+
+func (b *filterBuilder) group(f Filter, field string) string {
+	var join string
+	switch strings.ToLower(f.Logic) {
+	case LogicAnd, "":
+		join = " AND "
+	case LogicOr:
+		join = " OR "
+	default:
+		b.verr.add(field+".logic", "invalid_value", "logic must be and or or")
+		return ""
+	}
+	if f.Column != "" || f.Op != "" {
+		b.verr.add(field, "invalid_filter", "a group cannot also be a condition")
+		return ""
+	}
+	if len(f.Filters) == 0 {
+		b.verr.add(field+".filters", "required", "a group needs at least one filter")
+		return ""
+	}
+
+	parts := make([]string, 0, len(f.Filters))
+	for i, child := range f.Filters {
+		parts = append(parts, b.build(child, fmt.Sprintf("%s.filters[%d]", field, i)))
+	}
+	return "(" + strings.Join(parts, join) + ")"
+}
+
+func (b *filterBuilder) condition(f Filter, field string) string {
+	b.conditions++
+	col, ok := b.columns[f.Column]
+	if !ok {
+		if f.Column == "" {
+			b.verr.add(field+".column", "required", "column is required")
+		} else {
+			b.verr.add(field+".column", "unknown_column", "column %q does not exist", f.Column)
+		}
+		return ""
+	}
+	ident := pq.QuoteIdentifier(col.Name)
+
+	switch {
+	case f.Op == "isNull" || f.Op == "notNull":
+		if f.Op == "isNull" {
+			return ident + " IS NULL"
+		}
+		return ident + " IS NOT NULL"
+
+	case comparisonOps[f.Op] != "":
+		if f.Value == nil {
+			b.verr.add(field+".value", "required", "value is required; use isNull or notNull for NULL")
+			return ""
+		}
+		value, ferr := coerceValue(col, f.Value)
+		if ferr != nil {
+			b.verr.add(field+".value", ferr.Code, "%s", ferr.Message)
+			return ""
+		}
+		return fmt.Sprintf("%s %s %s", ident, comparisonOps[f.Op], b.arg(value))
+
+	case patternOps[f.Op] != "":
+		s, ok := f.Value.(string)
+		if !ok {
+			b.verr.add(field+".value", "invalid_type", "expected a string")
+			return ""
+		}
+		pattern := fmt.Sprintf(patternOps[f.Op], escapeLike(s))
+		return fmt.Sprintf("%s::text ILIKE %s", ident, b.arg(pattern))
+
+	case f.Op == "in":
+		values, ok := f.Value.([]interface{})
+		if !ok || len(values) == 0 {
+			b.verr.add(field+".value", "invalid_type", "expected a non-empty array")
+			return ""
+		}
+		placeholders := make([]string, len(values))
+		for i, v := range values {
+			value, ferr := coerceValue(col, v)
+			if ferr == nil && value == nil {
+				ferr = &FieldError{Code: "invalid_type", Message: "NULL never matches; use isNull"}
+			}
+			if ferr != nil {
+				b.verr.add(fmt.Sprintf("%s.value[%d]", field, i), ferr.Code, "%s", ferr.Message)
+				return ""
+			}
+			placeholders[i] = b.arg(value)
+		}
+		return fmt.Sprintf("%s IN (%s)", ident, strings.Join(placeholders, ", "))
+
+	default:
+		b.verr.add(field+".op", "invalid_value", "unknown operator %q", f.Op)
+		return ""
+	}
+}
+
+// search returns the condition matching term using the strategy of the
+// table, the expression listing the matched columns and the number of
+// arguments bound when the condition was complete. The list also names text
+// columns containing the term when the condition used other columns.
+func (b *filterBuilder) search(schema *TableSchema, term string) (string, string, int) {
+	mode, columns := SearchStrategy(schema)
+	if len(columns) == 0 {
+		b.verr.add("search", "not_searchable", "the table has no columns to search")
+		return "", "", len(b.args)
+	}
+
+	// The pattern is bound on first use, as unused parameters have no type
+	var pattern string
+	ilike := func(column string) string {
+		if pattern == "" {
+			pattern = b.arg("%" + escapeLike(term) + "%")
+		}
+		ident := pq.QuoteIdentifier(column)
+		if searchableTypes[strings.ToLower(b.columns[column].DataType)] {
+			ident += "::text"
+		}
+		return ident + " ILIKE " + pattern
+	}
+
+	var conditions, cases []string
+	seen := make(map[string]bool)
+	addCase := func(column, cond string) {
+		seen[column] = true
+		cases = append(cases, fmt.Sprintf("CASE WHEN %s THEN %s END", cond, pq.QuoteLiteral(column)))
+	}
+
+	if mode == SearchTSVector {
+		query := b.arg(term)
+		for _, column := range columns {
+			cond := fmt.Sprintf("%s @@ websearch_to_tsquery(%s)", pq.QuoteIdentifier(column), query)
+			conditions = append(conditions, cond)
+			addCase(column, cond)
+		}
+	} else {
+		for _, column := range columns {
+			cond := ilike(column)
+			conditions = append(conditions, cond)
+			addCase(column, cond)
+		}
+	}
+	condArgs := len(b.args)
+	for _, col := range schema.Columns {
+		if !seen[col.Name] && isSearchable(strings.ToLower(col.DataType)) {
+			addCase(col.Name, ilike(col.Name))
+		}
+	}
+
+	matched := fmt.Sprintf("ARRAY_REMOVE(ARRAY[%s]::text[], NULL)", strings.Join(cases, ", "))
+	return "(" + strings.Join(conditions, " OR ") + ")", matched, condArgs
+}
+
+// arg adds a bound argument and returns its placeholder
+func (b *filterBuilder) arg(v interface{}) string {
+	b.args = append(b.args, v)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+// joinValidation merges the fields of validation errors, returning the first other error as is
+func joinValidation(errs ...error) error {
+	joined := &ValidationError{}
+	for _, err := range errs {
+		var verr *ValidationError
+		switch {
+		case err == nil:
+		case errors.As(err, &verr):
+			joined.Fields = append(joined.Fields, verr.Fields...)
+		default:
+			return err
+		}
+	}
+	return joined.errOrNil()
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func columnsByName(schema *TableSchema) map[string]ColumnSchema {
+	columns := make(map[string]ColumnSchema, len(schema.Columns))
+	for _, col := range schema.Columns {
+		columns[col.Name] = col
+	}
+	return columns
+}
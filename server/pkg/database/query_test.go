@@ -0,0 +1,242 @@
+package database
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTableQueryBuild(t *testing.T) {
+	columns := []ColumnSchema{
+		{Name: "id", DataType: "integer", IsPrimary: true},
+		{Name: "name", DataType: "text"},
+		{Name: "email", DataType: "character varying"},
+		{Name: "created_at", DataType: "date"},
+	}
+	ilike := &TableSchema{Columns: columns}
+	trigram := &TableSchema{Columns: columns, TrigramColumns: []string{"name"}}
+	tsvector := &TableSchema{Columns: append(append([]ColumnSchema{}, columns...), ColumnSchema{Name: "doc", DataType: "tsvector"})}
+
+	filter := &Filter{Column: "id", Op: "gt", Value: json.Number("10")}
+	// The term holds a LIKE wildcard, which the pattern escapes
+	const term = "a_b"
+	const pattern = `%a\_b%`
+
+	// matchedCases lists the CASE expressions naming the matched columns
+	matchedCases := func(cases ...string) string {
+		return "ARRAY_REMOVE(ARRAY[" + strings.Join(cases, ", ") + "]::text[], NULL)"
+	}
+
+	tests := []struct {
+		name   string
+		schema *TableSchema
+		filter *Filter
+		search string
+		// wantWhere is the WHERE clause shared by both statements
+		wantWhere string
+		// wantMatched is the _matchedColumns expression, empty without a search
+		wantMatched   string
+		wantArgs      []interface{}
+		wantCountArgs []interface{}
+	}{
+		{
+			name:      "no filter or search",
+			schema:    ilike,
+			wantWhere: "",
+		},
+		{
+			name:          "ilike filter",
+			schema:        ilike,
+			filter:        filter,
+			wantWhere:     ` WHERE "id" > $1`,
+			wantArgs:      []interface{}{int64(10)},
+			wantCountArgs: []interface{}{int64(10)},
+		},
+		{
+			name:      "ilike search",
+			schema:    ilike,
+			search:    term,
+			wantWhere: ` WHERE ("id"::text ILIKE $1 OR "name" ILIKE $1 OR "email" ILIKE $1)`,
+			wantMatched: matchedCases(
+				`CASE WHEN "id"::text ILIKE $1 THEN 'id' END`,
+				`CASE WHEN "name" ILIKE $1 THEN 'name' END`,
+				`CASE WHEN "email" ILIKE $1 THEN 'email' END`,
+			),
+			wantArgs:      []interface{}{pattern},
+			wantCountArgs: []interface{}{pattern},
+		},
+		{
+			name:      "ilike filter and search",
+			schema:    ilike,
+			filter:    filter,
+			search:    term,
+			wantWhere: ` WHERE "id" > $1 AND ("id"::text ILIKE $2 OR "name" ILIKE $2 OR "email" ILIKE $2)`,
+			wantMatched: matchedCases(
+				`CASE WHEN "id"::text ILIKE $2 THEN 'id' END`,
+				`CASE WHEN "name" ILIKE $2 THEN 'name' END`,
+				`CASE WHEN "email" ILIKE $2 THEN 'email' END`,
+			),
+			wantArgs:      []interface{}{int64(10), pattern},
+			wantCountArgs: []interface{}{int64(10), pattern},
+		},
+		{
+			name:          "trigram filter",
+			schema:        trigram,
+			filter:        filter,
+			wantWhere:     ` WHERE "id" > $1`,
+			wantArgs:      []interface{}{int64(10)},
+			wantCountArgs: []interface{}{int64(10)},
+		},
+		{
+			name:      "trigram search",
+			schema:    trigram,
+			search:    term,
+			wantWhere: ` WHERE ("name" ILIKE $1)`,
+			wantMatched: matchedCases(
+				`CASE WHEN "name" ILIKE $1 THEN 'name' END`,
+				`CASE WHEN "id"::text ILIKE $1 THEN 'id' END`,
+				`CASE WHEN "email" ILIKE $1 THEN 'email' END`,
+			),
+			wantArgs:      []interface{}{pattern},
+			wantCountArgs: []interface{}{pattern},
+		},
+		{
+			name:      "trigram filter and search",
+			schema:    trigram,
+			filter:    filter,
+			search:    term,
+			wantWhere: ` WHERE "id" > $1 AND ("name" ILIKE $2)`,
+			wantMatched: matchedCases(
+				`CASE WHEN "name" ILIKE $2 THEN 'name' END`,
+				`CASE WHEN "id"::text ILIKE $2 THEN 'id' END`,
+				`CASE WHEN "email" ILIKE $2 THEN 'email' END`,
+			),
+			wantArgs:      []interface{}{int64(10), pattern},
+			wantCountArgs: []interface{}{int64(10), pattern},
+		},
+		{
+			name:          "tsvector filter",
+			schema:        tsvector,
+			filter:        filter,
+			wantWhere:     ` WHERE "id" > $1`,
+			wantArgs:      []interface{}{int64(10)},
+			wantCountArgs: []interface{}{int64(10)},
+		},
+		{
+			// The ILIKE pattern naming other matched columns is bound after
+			// the WHERE arguments, so the count leaves it out
+			name:      "tsvector search",
+			schema:    tsvector,
+			search:    term,
+			wantWhere: ` WHERE ("doc" @@ websearch_to_tsquery($1))`,
+			wantMatched: matchedCases(
+				`CASE WHEN "doc" @@ websearch_to_tsquery($1) THEN 'doc' END`,
+				`CASE WHEN "id"::text ILIKE $2 THEN 'id' END`,
+				`CASE WHEN "name" ILIKE $2 THEN 'name' END`,
+				`CASE WHEN "email" ILIKE $2 THEN 'email' END`,
+			),
+			wantArgs:      []interface{}{term, pattern},
+			wantCountArgs: []interface{}{term},
+		},
+		{
+			name:      "tsvector filter and search",
+			schema:    tsvector,
+			filter:    filter,
+			search:    term,
+			wantWhere: ` WHERE "id" > $1 AND ("doc" @@ websearch_to_tsquery($2))`,
+			wantMatched: matchedCases(
+				`CASE WHEN "doc" @@ websearch_to_tsquery($2) THEN 'doc' END`,
+				`CASE WHEN "id"::text ILIKE $3 THEN 'id' END`,
+				`CASE WHEN "name" ILIKE $3 THEN 'name' END`,
+				`CASE WHEN "email" ILIKE $3 THEN 'email' END`,
+			),
+			wantArgs:      []interface{}{int64(10), term, pattern},
+			wantCountArgs: []interface{}{int64(10), term},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := TableQuery{Table: "users", Page: 2, PageSize: 25, Filter: tt.filter, Search: tt.search}
+
+			selected := "*"
+			if tt.wantMatched != "" {
+				selected = `*, ` + tt.wantMatched + ` AS "_matchedColumns"`
+			}
+			wantSQL := "SELECT " + selected + ` FROM "users"` + tt.wantWhere + " LIMIT 25 OFFSET 50"
+
+			sql, args, err := q.Build(tt.schema)
+			if err != nil {
+				t.Fatalf("Build: %v", err)
+			}
+			if sql != wantSQL {
+				t.Errorf("Build sql =\n%s\nwant\n%s", sql, wantSQL)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("Build args = %#v, want %#v", args, tt.wantArgs)
+			}
+
+			wantCount := `SELECT COUNT(*) FROM "users"` + tt.wantWhere
+			sql, args, err = q.BuildCount(tt.schema)
+			if err != nil {
+				t.Fatalf("BuildCount: %v", err)
+			}
+			if sql != wantCount {
+				t.Errorf("BuildCount sql =\n%s\nwant\n%s", sql, wantCount)
+			}
+			if !reflect.DeepEqual(args, tt.wantCountArgs) {
+				t.Errorf("BuildCount args = %#v, want %#v", args, tt.wantCountArgs)
+			}
+		})
+	}
+}
+
+func TestTableQueryBuildErrors(t *testing.T) {
+	// Neither column can be searched
+	schema := &TableSchema{Columns: []ColumnSchema{
+		{Name: "active", DataType: "boolean"},
+		{Name: "created_at", DataType: "date"},
+	}}
+
+	tests := []struct {
+		name      string
+		query     TableQuery
+		wantCodes []string
+	}{
+		{
+			name:      "unknown filter column",
+			query:     TableQuery{Filter: &Filter{Column: "missing", Op: "eq", Value: "x"}},
+			wantCodes: []string{"filter.column: unknown_column"},
+		},
+		{
+			name:      "value of the wrong type",
+			query:     TableQuery{Filter: &Filter{Column: "active", Op: "eq", Value: "maybe"}},
+			wantCodes: []string{"filter.value: invalid_type"},
+		},
+		{
+			name:      "nothing to search",
+			query:     TableQuery{Search: "x"},
+			wantCodes: []string{"search: not_searchable"},
+		},
+		{
+			name: "filter and sort errors together",
+			query: TableQuery{
+				Filter: &Filter{Logic: "xor", Filters: []Filter{{Column: "active", Op: "isNull"}}},
+				Sort:   []SortKey{{Column: "active", Direction: "down"}},
+			},
+			wantCodes: []string{"filter.logic: invalid_value", "sort[0]: invalid_value"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.query.Table = "t"
+			tt.query.PageSize = 10
+			_, _, err := tt.query.Build(schema)
+			if codes := fieldCodes(t, err); !reflect.DeepEqual(codes, tt.wantCodes) {
+				t.Errorf("codes = %q, want %q", codes, tt.wantCodes)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+// Characters of context kept on each side of a match in search snippets
+const snippetContext = 40
+
+// SearchOptions describes a search across tables
+type SearchOptions struct {
+	Query string
+	// Schemas to search; the public schema when empty
+	Schemas []string
+	// Limit stops the search after this many hits
+	Limit int
+	// Parallelism bounds the tables searched at once; it is capped so the
+	// search leaves connections for other requests
+	Parallelism int
+}
+
+// SearchHit is a column value matching the search
+type SearchHit struct {
+	Schema     string                 `json:"schema"`
+	Table      string                 `json:"table"`
+	Column     string                 `json:"column"`
+	PrimaryKey map[string]interface{} `json:"primaryKey"`
+	Snippet    string                 `json:"snippet"`
+}
+
+// SearchTableError reports a table that could not be searched
+type SearchTableError struct {
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+	Err    error  `json:"-"`
+}
+
+func (e *SearchTableError) Error() string {
+	return fmt.Sprintf("failed to search %s.%s: %v", e.Schema, e.Table, e.Err)
+}
+
+func (e *SearchTableError) Unwrap() error {
+	return e.Err
+}
+
+// SearchSummary describes a finished search
+type SearchSummary struct {
+	Hits           int  `json:"hits"`
+	TablesSearched int  `json:"tablesSearched"`
+	TablesFailed   int  `json:"tablesFailed"`
+	Truncated      bool `json:"truncated"`
+	TimedOut       bool `json:"timedOut"`
+}
+
+// searchTable is a table with the columns a search looks in
+type searchTable struct {
+	schema     string
+	name       string
+	primaryKey []string
+	text       []string
+	uuid       []string
+}
+
+// searchResult is what a worker reports for one table
+type searchResult struct {
+	hits []SearchHit
+	err  error
+}
+
+// Search looks for opts.Query in the text-like and uuid columns of every table
+// in the selected schemas. Tables are searched in parallel and hits are passed
+// to emit as each table finishes, until the limit is reached, emit returns
+// false or ctx is done; the queries still running are then canceled. Tables
+// that fail are passed to fail and do not stop the search.
+func (dm *DatabaseManager) Search(ctx context.Context, opts SearchOptions, emit func(SearchHit) bool, fail func(*SearchTableError)) (_ *SearchSummary, err error) {
+	ctx, op := dm.startOp(ctx, "Search", "")
+	defer op.end(&err)
+	db, err := dm.db()
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(opts.Query) == "" {
+		verr := &ValidationError{}
+		verr.add("q", "required", "a search term is required")
+		return nil, verr
+	}
+	if len(opts.Schemas) == 0 {
+		opts.Schemas = []string{"public"}
+	}
+
+	tables, err := dm.searchTables(ctx, db, opts.Schemas)
+	if err != nil {
+		return nil, err
+	}
+
+	// Leave at least half of the pool to other requests
+	workers := opts.Parallelism
+	if most := dm.resources.MaxConnections / 2; workers > most {
+		workers = most
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan searchTable)
+	results := make(chan searchResult)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				hits, err := dm.searchTable(ctx, db, t, opts.Query, opts.Limit)
+				select {
+				case results <- searchResult{hits: hits, err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, t := range tables {
+			select {
+			case jobs <- t:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	summary := &SearchSummary{}
+	stopped := false
+	for result := range results {
+		if stopped {
+			continue
+		}
+		summary.TablesSearched++
+
+		var tableErr *SearchTableError
+		if errors.As(result.err, &tableErr) {
+			if ctx.Err() != nil {
+				// Canceled with the search rather than failed on its own
+				continue
+			}
+			summary.TablesFailed++
+			fail(tableErr)
+			continue
+		}
+
+		for _, hit := range result.hits {
+			if opts.Limit > 0 && summary.Hits == opts.Limit {
+				summary.Truncated = true
+				break
+			}
+			if !emit(hit) {
+				stopped = true
+				break
+			}
+			summary.Hits++
+		}
+		if summary.Truncated || stopped {
+			stopped = true
+			cancel()
+		}
+	}
+
+	op.returned(summary.Hits)
+	if err := ctx.Err(); err != nil && !stopped {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return summary, fmt.Errorf("search stopped: %w", err)
+		}
+		summary.TimedOut = true
+	}
+	return summary, nil
+}
+
+// searchTables lists the tables of schemas with their primary key and searchable columns
+func (dm *DatabaseManager) searchTables(ctx context.Context, db *sql.DB, schemas []string) ([]searchTable, error) {
+	query := `
+		SELECT
+			c.table_schema,
+			c.table_name,
+			c.column_name,
+			c.data_type = 'uuid' AS is_uuid,
+			EXISTS (
+				SELECT 1
+				FROM information_schema.table_constraints tc
+				JOIN information_schema.key_column_usage kcu
+					ON tc.constraint_name = kcu.constraint_name
+					AND tc.table_schema = kcu.table_schema
+					AND tc.table_name = kcu.table_name
+				WHERE tc.table_schema = c.table_schema
+					AND tc.table_name = c.table_name
+					AND tc.constraint_type = 'PRIMARY KEY'
+					AND kcu.column_name = c.column_name
+			) AS is_primary,
+			c.data_type IN ('text', 'character varying', 'character', 'uuid')
+				OR c.udt_name = 'citext' AS searchable
+		FROM information_schema.columns c
+		JOIN information_schema.tables t
+			ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+		WHERE c.table_schema = ANY($1)
+			AND t.table_type = 'BASE TABLE'
+		ORDER BY c.table_schema, c.table_name, c.ordinal_position
+	`
+
+	rows, err := db.QueryContext(ctx, query, pq.Array(schemas))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list searchable columns: %w", err)
+	}
+	defer rows.Close()
+
+	var tables []searchTable
+	for rows.Next() {
+		var schema, table, column string
+		var isUUID, isPrimary, searchable bool
+		if err := rows.Scan(&schema, &table, &column, &isUUID, &isPrimary, &searchable); err != nil {
+			return nil, fmt.Errorf("failed to scan column: %w", err)
+		}
+		if n := len(tables); n == 0 || tables[n-1].schema != schema || tables[n-1].name != table {
+			tables = append(tables, searchTable{schema: schema, name: table})
+		}
+		t := &tables[len(tables)-1]
+		if isPrimary {
+			t.primaryKey = append(t.primaryKey, column)
+		}
+		switch {
+		case !searchable:
+		case isUUID:
+			t.uuid = append(t.uuid, column)
+		default:
+			t.text = append(t.text, column)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read columns: %w", err)
+	}
+
+	searchable := tables[:0]
+	for _, t := range tables {
+		if len(t.text) > 0 || len(t.uuid) > 0 {
+			searchable = append(searchable, t)
+		}
+	}
+	return searchable, nil
+}
+
+// searchTable returns the hits in one table, at most limit rows of them.
+// Text columns match case-insensitively anywhere in the value; uuid columns
+// only match a term that is itself a UUID, exactly.
+func (dm *DatabaseManager) searchTable(ctx context.Context, db *sql.DB, t searchTable, term string, limit int) (_ []SearchHit, err error) {
+	ctx, op := dm.startOp(ctx, "SearchTable", t.name)
+	defer op.end(&err)
+
+	uuidTerm := strings.ToLower(strings.TrimSpace(term))
+	matchUUID := isUUID(uuidTerm)
+	args := []interface{}{"%" + escapeLike(term) + "%"}
+	var conditions, columns []string
+	for _, col := range t.text {
+		conditions = append(conditions, pq.QuoteIdentifier(col)+"::text ILIKE $1")
+		columns = append(columns, col)
+	}
+	if matchUUID && len(t.uuid) > 0 {
+		args = append(args, uuidTerm)
+		for _, col := range t.uuid {
+			conditions = append(conditions, pq.QuoteIdentifier(col)+" = $2::uuid")
+			columns = append(columns, col)
+		}
+	}
+	if len(conditions) == 0 {
+		return nil, nil
+	}
+
+	// Tables without a primary key are identified by the physical row location
+	key := t.primaryKey
+	selected := make([]string, 0, len(key)+len(columns))
+	if len(key) == 0 {
+		key = []string{"ctid"}
+		selected = append(selected, "ctid::text")
+	} else {
+		for _, col := range key {
+			selected = append(selected, pq.QuoteIdentifier(col)+"::text")
+		}
+	}
+	// A column is only returned where it matched, so hits follow the
+	// server's ILIKE rather than a comparison redone here
+	for i, col := range columns {
+		selected = append(selected, fmt.Sprintf("CASE WHEN %s THEN %s::text END", conditions[i], pq.QuoteIdentifier(col)))
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s.%s WHERE %s",
+		strings.Join(selected, ", "),
+		pq.QuoteIdentifier(t.schema),
+		pq.QuoteIdentifier(t.name),
+		strings.Join(conditions, " OR "),
+	)
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	op.statement(query)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, &SearchTableError{Schema: t.schema, Table: t.name, Err: err}
+	}
+	defer rows.Close()
+
+	var hits []SearchHit
+	values := make([]sql.NullString, len(selected))
+	ptrs := make([]interface{}, len(selected))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	lowerTerm := strings.ToLower(term)
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, &SearchTableError{Schema: t.schema, Table: t.name, Err: err}
+		}
+		pk := make(map[string]interface{}, len(key))
+		for i, col := range key {
+			pk[col] = values[i].String
+		}
+		for i, col := range columns {
+			v := values[len(key)+i]
+			if !v.Valid {
+				continue
+			}
+			snippet := v.String
+			if i < len(t.text) {
+				snippet = matchSnippet(v.String, lowerTerm)
+			}
+			hits = append(hits, SearchHit{Schema: t.schema, Table: t.name, Column: col, PrimaryKey: pk, Snippet: snippet})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &SearchTableError{Schema: t.schema, Table: t.name, Err: err}
+	}
+
+	op.returned(len(hits))
+	return hits, nil
+}
+
+// matchSnippet returns the part of value around the first case-insensitive
+// occurrence of lowerTerm, with ellipses where it was cut. When the occurrence
+// cannot be located, e.g. because lowercasing changed the length of the value
+// or the server's collation folds case differently, the snippet is the start
+// of the value.
+func matchSnippet(value, lowerTerm string) string {
+	// Lowercasing can change byte lengths, so search rune by rune
+	runes := []rune(value)
+	lower := []rune(strings.ToLower(value))
+	termRunes := []rune(lowerTerm)
+	if len(lower) != len(runes) {
+		lower = runes
+	}
+
+	at := -1
+	for i := 0; i+len(termRunes) <= len(lower); i++ {
+		if string(lower[i:i+len(termRunes)]) == lowerTerm {
+			at = i
+			break
+		}
+	}
+	if at < 0 {
+		at = 0
+	}
+
+	start, end := at-snippetContext, at+len(termRunes)+snippetContext
+	prefix, suffix := "…", "…"
+	if start <= 0 {
+		start, prefix = 0, ""
+	}
+	if end >= len(runes) {
+		end, suffix = len(runes), ""
+	}
+	return prefix + string(runes[start:end]) + suffix
+}
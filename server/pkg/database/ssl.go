@@ -0,0 +1,339 @@
+package database
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"dbviewer-saas/config"
+
+	"github.com/lib/pq"
+)
+
+// SSL modes accepted on connection configs. lib/pq itself only implements
+// disable, require, verify-ca and verify-full; allow and prefer are emulated
+// by retrying the other way when the first attempt is refused.
+const (
+	SSLModeDisable    = "disable"
+	SSLModeAllow      = "allow"
+	SSLModePrefer     = "prefer"
+	SSLModeRequire    = "require"
+	SSLModeVerifyCA   = "verify-ca"
+	SSLModeVerifyFull = "verify-full"
+)
+
+// sslRequestCode is the protocol code a client sends to ask the server to start TLS
+const sslRequestCode = 80877103
+
+// SSLConfig holds the TLS settings of a database connection. Certificates and
+// the key are either uploaded as PEM text or taken from a named profile in
+// the server configuration; uploaded values take precedence.
+type SSLConfig struct {
+	Mode       string `json:"mode,omitempty"`
+	RootCert   string `json:"rootCert,omitempty"`
+	ClientCert string `json:"clientCert,omitempty"`
+	ClientKey  string `json:"clientKey,omitempty"`
+	Profile    string `json:"profile,omitempty"`
+}
+
+// TLSInfo describes the TLS session of an established connection
+type TLSInfo struct {
+	Enabled            bool       `json:"enabled"`
+	Mode               string     `json:"mode"`
+	Version            string     `json:"version,omitempty"`
+	Cipher             string     `json:"cipher,omitempty"`
+	Bits               int        `json:"bits,omitempty"`
+	ServerCertSubject  string     `json:"serverCertSubject,omitempty"`
+	ServerCertIssuer   string     `json:"serverCertIssuer,omitempty"`
+	ServerCertNotAfter *time.Time `json:"serverCertNotAfter,omitempty"`
+}
+
+// sslSettings are the resolved lib/pq parameters of a connection attempt
+type sslSettings struct {
+	mode       string
+	rootCert   string
+	clientCert string
+	clientKey  string
+
+	// dir holds certificates written from uploads; it lives as long as the
+	// connection because lib/pq reads the files again for every new session
+	dir string
+}
+
+// params returns the lib/pq connection parameters for the given mode
+func (s *sslSettings) params(mode string) map[string]string {
+	params := map[string]string{"sslmode": mode}
+	if mode == SSLModeDisable {
+		return params
+	}
+	if s.rootCert != "" {
+		params["sslrootcert"] = s.rootCert
+	}
+	if s.clientCert != "" {
+		params["sslcert"] = s.clientCert
+		params["sslkey"] = s.clientKey
+	}
+	return params
+}
+
+// attempts returns the lib/pq modes to try, in order
+func (s *sslSettings) attempts() []string {
+	switch s.mode {
+	case SSLModePrefer:
+		return []string{SSLModeRequire, SSLModeDisable}
+	case SSLModeAllow:
+		return []string{SSLModeDisable, SSLModeRequire}
+	default:
+		return []string{s.mode}
+	}
+}
+
+// retryable reports whether a failed attempt in mode should fall through to the next one
+func (s *sslSettings) retryable(mode string, err error) bool {
+	switch s.mode {
+	case SSLModePrefer:
+		return mode == SSLModeRequire && errors.Is(err, pq.ErrSSLNotSupported)
+	case SSLModeAllow:
+		// The server rejected the plain connection, typically a hostssl-only pg_hba entry
+		var pqErr *pq.Error
+		return mode == SSLModeDisable && errors.As(err, &pqErr) && pqErr.Code.Class() == "28"
+	default:
+		return false
+	}
+}
+
+// remove deletes the certificates written for this connection
+func (s *sslSettings) remove() {
+	if s == nil || s.dir == "" {
+		return
+	}
+	if err := os.RemoveAll(s.dir); err != nil {
+		slog.Warn("Failed to remove SSL files", "dir", s.dir, "error", err)
+	}
+}
+
+// SetSSLProfiles registers the certificate profiles connection requests may reference
+func (dm *DatabaseManager) SetSSLProfiles(profiles map[string]config.SSLProfile) {
+	dm.sslProfiles = profiles
+}
+
+// resolveSSL validates cfg, merges in its profile and writes uploaded
+// certificates to a private temporary directory
+func (dm *DatabaseManager) resolveSSL(cfg SSLConfig, defaultMode string) (*sslSettings, error) {
+	verr := &ValidationError{}
+
+	var profile config.SSLProfile
+	if cfg.Profile != "" {
+		p, ok := dm.sslProfiles[cfg.Profile]
+		if !ok {
+			verr.add("ssl.profile", "unknown_profile", "SSL profile %q is not configured", cfg.Profile)
+			return nil, verr
+		}
+		profile = p
+	}
+
+	settings := &sslSettings{
+		mode:       firstNonEmpty(cfg.Mode, profile.Mode, defaultMode),
+		rootCert:   profile.RootCertFile,
+		clientCert: profile.ClientCertFile,
+		clientKey:  profile.ClientKeyFile,
+	}
+
+	switch settings.mode {
+	case SSLModeDisable, SSLModeAllow, SSLModePrefer, SSLModeRequire, SSLModeVerifyCA, SSLModeVerifyFull:
+	default:
+		verr.add("ssl.mode", "invalid_value",
+			"must be one of disable, allow, prefer, require, verify-ca or verify-full")
+	}
+
+	if cfg.RootCert != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(cfg.RootCert)) {
+		verr.add("ssl.rootCert", "invalid_value", "must contain at least one PEM certificate")
+	}
+	if (cfg.ClientCert == "") != (cfg.ClientKey == "") {
+		verr.add("ssl.clientKey", "required", "clientCert and clientKey must be provided together")
+	} else if cfg.ClientCert != "" {
+		if _, err := tls.X509KeyPair([]byte(cfg.ClientCert), []byte(cfg.ClientKey)); err != nil {
+			verr.add("ssl.clientCert", "invalid_value", "client certificate and key do not form a valid pair: %v", err)
+		}
+	}
+	if err := verr.errOrNil(); err != nil {
+		return nil, err
+	}
+
+	if cfg.RootCert == "" && cfg.ClientCert == "" {
+		return settings, nil
+	}
+
+	dir, err := os.MkdirTemp("", "dbviewer-ssl-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory for SSL files: %w", err)
+	}
+	settings.dir = dir
+
+	write := func(name, contents string) (string, error) {
+		path := filepath.Join(dir, name)
+		// lib/pq refuses keys readable by group or others
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			return "", fmt.Errorf("failed to write %s: %w", name, err)
+		}
+		return path, nil
+	}
+
+	if cfg.RootCert != "" {
+		if settings.rootCert, err = write("root.crt", cfg.RootCert); err != nil {
+			settings.remove()
+			return nil, err
+		}
+	}
+	if cfg.ClientCert != "" {
+		if settings.clientCert, err = write("client.crt", cfg.ClientCert); err != nil {
+			settings.remove()
+			return nil, err
+		}
+		if settings.clientKey, err = write("client.key", cfg.ClientKey); err != nil {
+			settings.remove()
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// openPool opens a pool for each SSL mode attempt until one answers a ping.
+// connStr builds the connection string for the given lib/pq parameters, and
+// tunnel, when set, carries the connections through a bastion.
+func (dm *DatabaseManager) openPool(ctx context.Context, settings *sslSettings, tunnel *sshTunnel, connStr func(params map[string]string) string) (*sql.DB, string, error) {
+	var lastErr error
+	for _, mode := range settings.attempts() {
+		connector, err := pq.NewConnector(connStr(settings.params(mode)))
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to open database: %w", err)
+		}
+		if tunnel != nil {
+			connector.Dialer(tunnel)
+		}
+		db := sql.OpenDB(connector)
+
+		// Set connection pool settings
+		db.SetMaxOpenConns(dm.resources.MaxConnections)
+		db.SetMaxIdleConns(dm.resources.MaxIdleConnections)
+		db.SetConnMaxLifetime(dm.resources.ConnMaxLifetime)
+
+		err = db.PingContext(ctx)
+		if err == nil {
+			return db, mode, nil
+		}
+		db.Close()
+		lastErr = err
+
+		if !settings.retryable(mode, err) {
+			break
+		}
+		slog.InfoContext(ctx, "Connection failed, retrying with another sslmode", "sslmode", mode, "error", err)
+	}
+	return nil, "", fmt.Errorf("failed to connect to database: %w", lastErr)
+}
+
+// tlsInfo reports the TLS session of db. The server certificate is not exposed
+// by PostgreSQL, so it is read by a separate SSLRequest handshake to addr,
+// made through tunnel when the connection uses one.
+func tlsInfo(ctx context.Context, db *sql.DB, tunnel *sshTunnel, mode, addr, serverName string) *TLSInfo {
+	info := &TLSInfo{Mode: mode}
+	if mode == SSLModeDisable {
+		return info
+	}
+
+	var version, cipher sql.NullString
+	var bits sql.NullInt64
+	err := db.QueryRowContext(ctx,
+		"SELECT ssl, version, cipher, bits FROM pg_stat_ssl WHERE pid = pg_backend_pid()",
+	).Scan(&info.Enabled, &version, &cipher, &bits)
+	if err != nil {
+		// Poolers and some managed services hide pg_stat_ssl; the probe below still fills in the details
+		slog.WarnContext(ctx, "Failed to read pg_stat_ssl", "error", err)
+		info.Enabled = true
+	}
+	info.Version = version.String
+	info.Cipher = cipher.String
+	info.Bits = int(bits.Int64)
+	if !info.Enabled {
+		return info
+	}
+
+	dial := (&net.Dialer{}).DialContext
+	if tunnel != nil {
+		dial = tunnel.DialContext
+	}
+	state, err := probeServerTLS(ctx, dial, addr, serverName)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to read the server certificate", "error", err)
+		return info
+	}
+	if info.Version == "" {
+		info.Version = tls.VersionName(state.Version)
+		info.Cipher = tls.CipherSuiteName(state.CipherSuite)
+	}
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		notAfter := cert.NotAfter
+		info.ServerCertSubject = cert.Subject.String()
+		info.ServerCertIssuer = cert.Issuer.String()
+		info.ServerCertNotAfter = &notAfter
+	}
+	return info
+}
+
+// probeServerTLS opens a connection to a PostgreSQL server, negotiates TLS
+// with an SSLRequest and returns the handshake state without logging in
+func probeServerTLS(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), addr, serverName string) (*tls.ConnectionState, error) {
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], sslRequestCode)
+	if _, err := conn.Write(request); err != nil {
+		return nil, fmt.Errorf("failed to send SSLRequest: %w", err)
+	}
+
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, fmt.Errorf("failed to read SSLRequest reply: %w", err)
+	}
+	if reply[0] != 'S' {
+		return nil, pq.ErrSSLNotSupported
+	}
+
+	// Verification already happened on the real connection; this one only reads the certificate
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	state := tlsConn.ConnectionState()
+	return &state, nil
+}
+
+// firstNonEmpty returns the first non-empty string
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,128 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Most rows RunStatement returns; the rest are dropped and the result marked truncated
+const maxStatementRows = 1000
+
+// Leading keywords of statements that cannot change data. EXPLAIN is left
+// out: EXPLAIN ANALYZE runs the statement it explains.
+var readOnlyKeywords = map[string]bool{
+	"select": true, "values": true, "table": true, "show": true,
+}
+
+// StatementResult holds the rows a statement returned. Writes report only the
+// rows they return, e.g. through RETURNING.
+type StatementResult struct {
+	Columns   []string                 `json:"columns"`
+	Rows      []map[string]interface{} `json:"rows"`
+	RowCount  int                      `json:"rowCount"`
+	Truncated bool                     `json:"truncated"`
+}
+
+// RunStatement executes a single statement with $n arguments against the
+// current connection. The statement is prepared, so input holding several
+// commands is rejected. Anything but a plain read drops the cache of the
+// connection, since it may have changed any table.
+func (dm *DatabaseManager) RunStatement(ctx context.Context, query string, args []interface{}) (_ *StatementResult, err error) {
+	ctx, op := dm.startOp(ctx, "RunStatement", "")
+	defer op.end(&err)
+	db, err := dm.db()
+	if err != nil {
+		return nil, err
+	}
+
+	op.statement(query)
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	readOnly := readOnlyKeywords[firstKeyword(query)]
+	if !readOnly {
+		defer dm.InvalidateCache("")
+	}
+
+	// Closing rows early reads the rest of the result, so reads past the
+	// limit are canceled instead. Writes must run to completion, with the
+	// remaining rows skipped, so their errors are still reported.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run statement: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get column names: %w", err)
+	}
+
+	result := &StatementResult{Columns: columns, Rows: make([]map[string]interface{}, 0)}
+	for rows.Next() {
+		if len(result.Rows) == maxStatementRows {
+			result.Truncated = true
+			if readOnly {
+				cancel()
+				break
+			}
+			continue
+		}
+
+		values := make([]interface{}, len(columns))
+		valuePtrs := make([]interface{}, len(columns))
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		row := make(map[string]interface{}, len(columns))
+		for i, name := range columns {
+			if b, ok := values[i].([]byte); ok {
+				row[name] = string(b)
+			} else {
+				row[name] = values[i]
+			}
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if err := rows.Err(); err != nil && !(result.Truncated && readOnly) {
+		return nil, fmt.Errorf("failed to read rows: %w", err)
+	}
+
+	result.RowCount = len(result.Rows)
+	op.returned(result.RowCount)
+	return result, nil
+}
+
+// firstKeyword returns the lowercased first word of query, skipping comments and parentheses
+func firstKeyword(query string) string {
+	for {
+		query = strings.TrimLeft(query, " \t\r\n(")
+		switch {
+		case strings.HasPrefix(query, "--"):
+			end := strings.IndexByte(query, '\n')
+			if end < 0 {
+				return ""
+			}
+			query = query[end:]
+		case strings.HasPrefix(query, "/*"):
+			query = query[blockCommentEnd(query, 0):]
+		default:
+			end := 0
+			for end < len(query) && isParamChar(query[end]) {
+				end++
+			}
+			return strings.ToLower(query[:end])
+		}
+	}
+}
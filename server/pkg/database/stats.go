@@ -0,0 +1,244 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Columns of the table statistics query that TableStats can be sorted by
+var tableStatsSortColumns = map[string]string{
+	"name":            "name",
+	"rowEstimate":     "row_estimate",
+	"totalSize":       "total_size",
+	"heapSize":        "heap_size",
+	"indexSize":       "index_size",
+	"toastSize":       "toast_size",
+	"liveTuples":      "live_tuples",
+	"deadTuples":      "dead_tuples",
+	"lastVacuum":      "last_vacuum",
+	"lastAutovacuum":  "last_autovacuum",
+	"lastAnalyze":     "last_analyze",
+	"lastAutoanalyze": "last_autoanalyze",
+	"bloatSize":       "bloat_size",
+	"bloatRatio":      "bloat_ratio",
+}
+
+// TableStats describes the size and maintenance state of a table. Sizes are in bytes.
+type TableStats struct {
+	Name        string `json:"name"`
+	RowEstimate int64  `json:"rowEstimate"`
+	// TotalSize includes the heap, indexes and TOAST
+	TotalSize       int64      `json:"totalSize"`
+	HeapSize        int64      `json:"heapSize"`
+	IndexSize       int64      `json:"indexSize"`
+	ToastSize       int64      `json:"toastSize"`
+	LiveTuples      int64      `json:"liveTuples"`
+	DeadTuples      int64      `json:"deadTuples"`
+	LastVacuum      *time.Time `json:"lastVacuum"`
+	LastAutovacuum  *time.Time `json:"lastAutovacuum"`
+	LastAnalyze     *time.Time `json:"lastAnalyze"`
+	LastAutoanalyze *time.Time `json:"lastAutoanalyze"`
+	// BloatSize estimates the heap space beyond what the live rows need at the
+	// table's fillfactor; null until the table is analyzed
+	BloatSize *int64 `json:"bloatSize"`
+	// BloatRatio is BloatSize over HeapSize
+	BloatRatio *float64 `json:"bloatRatio"`
+}
+
+// DatabaseStats describes the size and activity of the connected database
+// since its statistics were last reset
+type DatabaseStats struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	Connections int    `json:"connections"`
+	// CacheHitRatio is the share of block reads served from shared buffers;
+	// null before any block was read
+	CacheHitRatio *float64   `json:"cacheHitRatio"`
+	BlocksHit     int64      `json:"blocksHit"`
+	BlocksRead    int64      `json:"blocksRead"`
+	Commits       int64      `json:"commits"`
+	Rollbacks     int64      `json:"rollbacks"`
+	Deadlocks     int64      `json:"deadlocks"`
+	TempFiles     int64      `json:"tempFiles"`
+	TempBytes     int64      `json:"tempBytes"`
+	StatsReset    *time.Time `json:"statsReset"`
+}
+
+// TableStats returns the statistics of the tables in the public schema sorted
+// by sort, largest total size first by default. Nulls sort last either way.
+func (dm *DatabaseManager) TableStats(ctx context.Context, sort []SortKey) (_ []TableStats, err error) {
+	ctx, op := dm.startOp(ctx, "TableStats", "")
+	defer op.end(&err)
+	db, err := dm.db()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sort) == 0 {
+		sort = []SortKey{{Column: "totalSize", Direction: "desc"}}
+	}
+	verr := &ValidationError{}
+	var order []string
+	for i, key := range sort {
+		column, ok := tableStatsSortColumns[key.Column]
+		if !ok {
+			verr.add(fmt.Sprintf("sort[%d].column", i), "invalid_value", "cannot sort by %q", key.Column)
+			continue
+		}
+		var direction string
+		switch strings.ToLower(key.Direction) {
+		case "", "asc":
+			direction = "ASC"
+		case "desc":
+			direction = "DESC"
+		default:
+			verr.add(fmt.Sprintf("sort[%d].direction", i), "invalid_value", "direction must be asc or desc")
+			continue
+		}
+		order = append(order, column+" "+direction+" NULLS LAST")
+	}
+	if err := verr.errOrNil(); err != nil {
+		return nil, err
+	}
+	order = append(order, "name")
+
+	// The bloat estimate compares the pages of the heap to those its rows
+	// would fill: the average width of the analyzed columns plus the tuple
+	// header (23 bytes aligned to 24) and line pointer (4), on pages less their
+	// 24 byte header and the free space the fillfactor reserves
+	query := `
+		WITH widths AS (
+			SELECT tablename, SUM((1 - null_frac) * avg_width) AS row_width
+			FROM pg_stats
+			WHERE schemaname = 'public'
+			GROUP BY tablename
+		), tables AS (
+			SELECT
+				c.relname AS name,
+				GREATEST(c.reltuples, COALESCE(s.n_live_tup, 0))::bigint AS row_estimate,
+				pg_total_relation_size(c.oid) AS total_size,
+				pg_relation_size(c.oid) AS heap_size,
+				pg_indexes_size(c.oid) AS index_size,
+				COALESCE(pg_total_relation_size(NULLIF(c.reltoastrelid, 0)), 0) AS toast_size,
+				COALESCE(s.n_live_tup, 0) AS live_tuples,
+				COALESCE(s.n_dead_tup, 0) AS dead_tuples,
+				s.last_vacuum,
+				s.last_autovacuum,
+				s.last_analyze,
+				s.last_autoanalyze,
+				CASE WHEN w.row_width IS NOT NULL AND c.reltuples >= 0 THEN
+					GREATEST(c.relpages - CEIL(c.reltuples * (28 + w.row_width)
+						/ ((current_setting('block_size')::int - 24) * COALESCE((
+							SELECT substring(opt FROM 'fillfactor=(\d+)')::int
+							FROM unnest(c.reloptions) opt
+							WHERE opt LIKE 'fillfactor=%'
+						), 100) / 100.0)), 0)::bigint * current_setting('block_size')::bigint
+				END AS bloat_size
+			FROM pg_class c
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			LEFT JOIN pg_stat_user_tables s ON s.relid = c.oid
+			LEFT JOIN widths w ON w.tablename = c.relname
+			WHERE n.nspname = 'public' AND c.relkind = 'r'
+		)
+		SELECT *, bloat_size::float8 / NULLIF(heap_size, 0) AS bloat_ratio
+		FROM tables
+		ORDER BY ` + strings.Join(order, ", ")
+
+	op.statement(query)
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get table statistics: %w", err)
+	}
+	defer rows.Close()
+
+	stats := make([]TableStats, 0)
+	for rows.Next() {
+		var t TableStats
+		var lastVacuum, lastAutovacuum, lastAnalyze, lastAutoanalyze sql.NullTime
+		var bloatSize sql.NullInt64
+		var bloatRatio sql.NullFloat64
+		if err := rows.Scan(
+			&t.Name, &t.RowEstimate, &t.TotalSize, &t.HeapSize, &t.IndexSize, &t.ToastSize,
+			&t.LiveTuples, &t.DeadTuples,
+			&lastVacuum, &lastAutovacuum, &lastAnalyze, &lastAutoanalyze,
+			&bloatSize, &bloatRatio,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan table statistics: %w", err)
+		}
+		t.LastVacuum = nullTime(lastVacuum)
+		t.LastAutovacuum = nullTime(lastAutovacuum)
+		t.LastAnalyze = nullTime(lastAnalyze)
+		t.LastAutoanalyze = nullTime(lastAutoanalyze)
+		if bloatSize.Valid {
+			t.BloatSize = &bloatSize.Int64
+		}
+		if bloatRatio.Valid {
+			t.BloatRatio = &bloatRatio.Float64
+		}
+		stats = append(stats, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read table statistics: %w", err)
+	}
+
+	op.returned(len(stats))
+	return stats, nil
+}
+
+// DatabaseStats returns the size and activity of the connected database
+func (dm *DatabaseManager) DatabaseStats(ctx context.Context) (_ *DatabaseStats, err error) {
+	ctx, op := dm.startOp(ctx, "DatabaseStats", "")
+	defer op.end(&err)
+	db, err := dm.db()
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT
+			datname,
+			pg_database_size(datid),
+			numbackends,
+			blks_hit::float8 / NULLIF(blks_hit + blks_read, 0),
+			blks_hit,
+			blks_read,
+			xact_commit,
+			xact_rollback,
+			deadlocks,
+			temp_files,
+			temp_bytes,
+			stats_reset
+		FROM pg_stat_database
+		WHERE datname = current_database()
+	`
+
+	op.statement(query)
+	stats := &DatabaseStats{}
+	var hitRatio sql.NullFloat64
+	var statsReset sql.NullTime
+	err = db.QueryRowContext(ctx, query).Scan(
+		&stats.Name, &stats.Size, &stats.Connections,
+		&hitRatio, &stats.BlocksHit, &stats.BlocksRead,
+		&stats.Commits, &stats.Rollbacks, &stats.Deadlocks,
+		&stats.TempFiles, &stats.TempBytes, &statsReset,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database statistics: %w", err)
+	}
+	if hitRatio.Valid {
+		stats.CacheHitRatio = &hitRatio.Float64
+	}
+	stats.StatsReset = nullTime(statsReset)
+	return stats, nil
+}
+
+// nullTime returns the time of t, or nil when it is null
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
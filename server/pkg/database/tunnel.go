@@ -0,0 +1,474 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Interval between keepalive requests on an open tunnel
+const tunnelKeepaliveInterval = 30 * time.Second
+
+// SSHTunnelConfig describes a bastion host the database is reached through.
+// The bastion authenticates with a private key or a password, and its host key
+// must match KnownHosts or the server's known_hosts file.
+type SSHTunnelConfig struct {
+	Host       string `json:"host"`
+	Port       string `json:"port,omitempty"`
+	User       string `json:"user"`
+	PrivateKey string `json:"privateKey,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+	Password   string `json:"password,omitempty"`
+	// KnownHosts holds known_hosts lines for the bastion
+	KnownHosts string `json:"knownHosts,omitempty"`
+}
+
+// TunnelError is returned when the SSH tunnel cannot be established.
+// Stage is "dial", "host_key", "auth" or "forward".
+type TunnelError struct {
+	Stage string
+	err   error
+}
+
+func (e *TunnelError) Error() string {
+	return fmt.Sprintf("ssh tunnel %s failed: %v", e.Stage, e.err)
+}
+
+func (e *TunnelError) Unwrap() error {
+	return e.err
+}
+
+// TunnelStatus reports the health of the SSH tunnel of the current connection
+type TunnelStatus struct {
+	Bastion    string     `json:"bastion"`
+	Healthy    bool       `json:"healthy"`
+	LastError  string     `json:"lastError,omitempty"`
+	LastCheck  *time.Time `json:"lastCheck,omitempty"`
+	Reconnects int        `json:"reconnects"`
+	OpenSince  time.Time  `json:"openSince"`
+}
+
+// sshTunnel forwards database connections through a bastion. It implements
+// pq.Dialer and pq.DialerContext and redials the bastion when the SSH
+// connection drops.
+type sshTunnel struct {
+	addr    string
+	config  *ssh.ClientConfig
+	timeout time.Duration
+
+	mu     sync.Mutex
+	client *ssh.Client
+	// redialing is closed when the redial in progress, if any, finishes
+	redialing chan struct{}
+	status    TunnelStatus
+	done      chan struct{}
+}
+
+// SetSSHKnownHostsFile sets the known_hosts file used when a tunnel config carries no host keys
+func (dm *DatabaseManager) SetSSHKnownHostsFile(path string) {
+	dm.sshKnownHostsFile = path
+}
+
+// openTunnel validates cfg and connects to the bastion
+func (dm *DatabaseManager) openTunnel(ctx context.Context, cfg *SSHTunnelConfig) (*sshTunnel, error) {
+	verr := &ValidationError{}
+	if cfg.Host == "" {
+		verr.add("ssh.host", "required", "Bastion host is required")
+	}
+	if cfg.User == "" {
+		verr.add("ssh.user", "required", "SSH user is required")
+	}
+
+	var auth []ssh.AuthMethod
+	if cfg.PrivateKey != "" {
+		var signer ssh.Signer
+		var err error
+		if cfg.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(cfg.PrivateKey), []byte(cfg.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey([]byte(cfg.PrivateKey))
+		}
+		var missing *ssh.PassphraseMissingError
+		switch {
+		case errors.As(err, &missing):
+			verr.add("ssh.passphrase", "required", "The private key is encrypted; a passphrase is required")
+		case err != nil:
+			verr.add("ssh.privateKey", "invalid_value", "Invalid private key: %v", err)
+		default:
+			auth = append(auth, ssh.PublicKeys(signer))
+		}
+	}
+	if cfg.Password != "" {
+		auth = append(auth, ssh.Password(cfg.Password))
+	}
+	if cfg.PrivateKey == "" && cfg.Password == "" {
+		verr.add("ssh.privateKey", "required", "A private key or password is required")
+	}
+
+	hostKeyCallback, err := dm.hostKeyCallback(cfg.KnownHosts)
+	if err != nil {
+		verr.add("ssh.knownHosts", "invalid_value", "%v", err)
+	}
+	if err := verr.errOrNil(); err != nil {
+		return nil, err
+	}
+
+	port := cfg.Port
+	if port == "" {
+		port = "22"
+	}
+
+	t := &sshTunnel{
+		addr: net.JoinHostPort(cfg.Host, port),
+		config: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         dm.resources.ConnectTimeout,
+		},
+		timeout: dm.resources.ConnectTimeout,
+		done:    make(chan struct{}),
+	}
+	t.status.Bastion = t.addr
+	t.status.OpenSince = time.Now()
+
+	client, err := t.dialBastion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	t.publish(client)
+
+	go t.keepalive()
+	slog.InfoContext(ctx, "SSH tunnel open", "bastion", t.addr, "user", cfg.User)
+	return t, nil
+}
+
+// hostKeyCallback verifies bastion host keys against the given known_hosts
+// lines, or against the configured known_hosts file when none are given
+func (dm *DatabaseManager) hostKeyCallback(knownHostsLines string) (ssh.HostKeyCallback, error) {
+	if knownHostsLines == "" {
+		if dm.sshKnownHostsFile == "" {
+			return nil, errors.New("known_hosts entries for the bastion are required")
+		}
+		callback, err := knownhosts.New(dm.sshKnownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read known_hosts file: %w", err)
+		}
+		return callback, nil
+	}
+
+	// knownhosts only parses files, so stage the lines in a private directory
+	dir, err := os.MkdirTemp("", "dbviewer-ssh-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory for known_hosts: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(path, []byte(knownHostsLines), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write known_hosts: %w", err)
+	}
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid known_hosts: %w", err)
+	}
+	return callback, nil
+}
+
+// dialBastion opens the SSH connection to the bastion
+func (t *sshTunnel) dialBastion(ctx context.Context) (*ssh.Client, error) {
+	dialer := net.Dialer{Timeout: t.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, &TunnelError{Stage: "dial", err: err}
+	}
+
+	// Bound the handshake, which ssh.NewClientConn does not do on its own
+	deadline := time.Now().Add(t.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, t.addr, t.config)
+	if err != nil {
+		conn.Close()
+		// Timeouts, resets and a bastion hanging up mid-handshake are
+		// connectivity problems; what remains is the server refusing us
+		var keyErr *knownhosts.KeyError
+		var netErr net.Error
+		switch {
+		case errors.As(err, &keyErr):
+			return nil, &TunnelError{Stage: "host_key", err: err}
+		case errors.As(err, &netErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			return nil, &TunnelError{Stage: "dial", err: err}
+		default:
+			return nil, &TunnelError{Stage: "auth", err: err}
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// currentClient returns the SSH client, redialing the bastion if it was lost.
+// The dial runs outside the lock so status reads never wait on it; callers
+// arriving during a redial wait for its outcome.
+func (t *sshTunnel) currentClient(ctx context.Context) (*ssh.Client, error) {
+	for {
+		t.mu.Lock()
+		select {
+		case <-t.done:
+			t.mu.Unlock()
+			return nil, &TunnelError{Stage: "dial", err: errors.New("tunnel closed")}
+		default:
+		}
+		if client := t.client; client != nil {
+			t.mu.Unlock()
+			return client, nil
+		}
+		if wait := t.redialing; wait != nil {
+			t.mu.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, &TunnelError{Stage: "dial", err: ctx.Err()}
+			}
+		}
+		wait := make(chan struct{})
+		t.redialing = wait
+		t.mu.Unlock()
+
+		client, err := t.dialBastion(ctx)
+
+		t.mu.Lock()
+		t.redialing = nil
+		close(wait)
+		select {
+		case <-t.done:
+			t.mu.Unlock()
+			if client != nil {
+				client.Close()
+			}
+			return nil, &TunnelError{Stage: "dial", err: errors.New("tunnel closed")}
+		default:
+		}
+		if err != nil {
+			t.status.LastError = err.Error()
+			t.mu.Unlock()
+			return nil, err
+		}
+		t.publish(client)
+		t.status.Reconnects++
+		t.mu.Unlock()
+
+		slog.InfoContext(ctx, "SSH tunnel re-established", "bastion", t.addr)
+		return client, nil
+	}
+}
+
+// publish makes client the current SSH client; t.mu must be held. The client
+// is dropped as soon as its connection ends, so the next dial reconnects.
+func (t *sshTunnel) publish(client *ssh.Client) {
+	t.client = client
+	t.status.Healthy = true
+	t.status.LastError = ""
+	go func() {
+		err := client.Wait()
+		if err == nil {
+			err = errors.New("connection to bastion closed")
+		}
+		t.markUnhealthy(client, err)
+	}()
+}
+
+// DialContext opens a forwarded connection to address on the far side of the bastion
+func (t *sshTunnel) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, err := t.currentClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.DialContext(ctx, network, address)
+	if err != nil {
+		// A rejected channel means the bastion is fine but cannot reach address;
+		// anything else points at a dead SSH connection, dropped so the next dial reconnects
+		var openErr *ssh.OpenChannelError
+		if !errors.As(err, &openErr) {
+			t.markUnhealthy(client, err)
+		}
+		return nil, &TunnelError{Stage: "forward", err: err}
+	}
+	return &forwardedConn{Conn: conn}, nil
+}
+
+// forwardedConn is a connection through the bastion. SSH channels do not
+// support deadlines, which lib/pq sets for connect_timeout, so a deadline
+// closes the connection when it passes instead of failing the dial.
+type forwardedConn struct {
+	net.Conn
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+// SetDeadline closes the connection at deadline; a zero deadline cancels it
+func (c *forwardedConn) SetDeadline(deadline time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !deadline.IsZero() {
+		c.timer = time.AfterFunc(time.Until(deadline), func() { c.Conn.Close() })
+	}
+	return nil
+}
+
+// SetReadDeadline behaves like SetDeadline, as reads and writes cannot be bounded apart
+func (c *forwardedConn) SetReadDeadline(deadline time.Time) error {
+	return c.SetDeadline(deadline)
+}
+
+// SetWriteDeadline behaves like SetDeadline, as reads and writes cannot be bounded apart
+func (c *forwardedConn) SetWriteDeadline(deadline time.Time) error {
+	return c.SetDeadline(deadline)
+}
+
+// Close cancels any pending deadline and closes the connection
+func (c *forwardedConn) Close() error {
+	c.SetDeadline(time.Time{})
+	return c.Conn.Close()
+}
+
+// Dial implements pq.Dialer
+func (t *sshTunnel) Dial(network, address string) (net.Conn, error) {
+	return t.DialContext(context.Background(), network, address)
+}
+
+// DialTimeout implements pq.Dialer
+func (t *sshTunnel) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return t.DialContext(ctx, network, address)
+}
+
+// keepalive probes the bastion until the tunnel is closed
+func (t *sshTunnel) keepalive() {
+	ticker := time.NewTicker(tunnelKeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			t.check()
+		}
+	}
+}
+
+// check sends one keepalive request and records the result
+func (t *sshTunnel) check() {
+	t.mu.Lock()
+	client := t.client
+	t.mu.Unlock()
+
+	now := time.Now()
+	if client == nil {
+		// Reconnect eagerly so the status reflects whether the bastion is reachable
+		ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+		_, err := t.currentClient(ctx)
+		cancel()
+		t.mu.Lock()
+		t.status.LastCheck = &now
+		t.mu.Unlock()
+		if err != nil {
+			slog.Warn("SSH tunnel is down", "bastion", t.addr, "error", err)
+		}
+		return
+	}
+
+	_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+	if err != nil {
+		t.markUnhealthy(client, err)
+		slog.Warn("SSH tunnel lost", "bastion", t.addr, "error", err)
+	}
+
+	t.mu.Lock()
+	t.status.LastCheck = &now
+	if err == nil {
+		t.status.Healthy = true
+		t.status.LastError = ""
+	}
+	t.mu.Unlock()
+}
+
+// markUnhealthy closes client if it is still the current one
+func (t *sshTunnel) markUnhealthy(client *ssh.Client, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.client != client {
+		return
+	}
+	client.Close()
+	t.client = nil
+	t.status.Healthy = false
+	t.status.LastError = err.Error()
+}
+
+// Status returns a snapshot of the tunnel health
+func (t *sshTunnel) Status() TunnelStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+// Close stops the keepalive loop and closes the SSH connection
+func (t *sshTunnel) Close() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	select {
+	case <-t.done:
+		return
+	default:
+		close(t.done)
+	}
+	if t.client != nil {
+		t.client.Close()
+		t.client = nil
+	}
+	t.status.Healthy = false
+}
+
+// TunnelStatus returns the health of the current connection's SSH tunnel, or
+// nil when the connection does not use one
+func (dm *DatabaseManager) TunnelStatus() *TunnelStatus {
+	dm.mu.RLock()
+	tunnel := dm.tunnel
+	dm.mu.RUnlock()
+
+	if tunnel == nil {
+		return nil
+	}
+	status := tunnel.Status()
+	return &status
+}
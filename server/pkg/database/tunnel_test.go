@@ -0,0 +1,366 @@
+package database
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"dbviewer-saas/config"
+
+	"github.com/lib/pq"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// bastion is an in-process SSH server that forwards direct-tcpip channels
+type bastion struct {
+	addr    string
+	hostKey ssh.PublicKey
+
+	listener net.Listener
+	mu       sync.Mutex
+	conns    []*ssh.ServerConn
+}
+
+// startBastion serves SSH on a local port, accepting the password "secret"
+// and userKey for the user "tunnel"
+func startBastion(t *testing.T, userKey ssh.PublicKey) *bastion {
+	t.Helper()
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "tunnel" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == "tunnel" && userKey != nil && string(key.Marshal()) == string(userKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	cfg.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &bastion{addr: listener.Addr().String(), hostKey: hostSigner.PublicKey(), listener: listener}
+	t.Cleanup(func() {
+		listener.Close()
+		b.drop()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn, cfg)
+		}
+	}()
+	return b
+}
+
+// serve handles one SSH connection
+func (b *bastion) serve(conn net.Conn, cfg *ssh.ServerConfig) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	b.mu.Lock()
+	b.conns = append(b.conns, sshConn)
+	b.mu.Unlock()
+
+	go ssh.DiscardRequests(reqs)
+	for ch := range chans {
+		if ch.ChannelType() != "direct-tcpip" {
+			ch.Reject(ssh.UnknownChannelType, "only direct-tcpip is supported")
+			continue
+		}
+		var target struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(ch.ExtraData(), &target); err != nil {
+			ch.Reject(ssh.ConnectionFailed, "bad request")
+			continue
+		}
+		upstream, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			ch.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, requests, err := ch.Accept()
+		if err != nil {
+			upstream.Close()
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+		go func() {
+			defer channel.Close()
+			defer upstream.Close()
+			go io.Copy(upstream, channel)
+			io.Copy(channel, upstream)
+		}()
+	}
+}
+
+// drop closes every SSH connection, as when the bastion restarts
+func (b *bastion) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.conns {
+		c.Close()
+	}
+	b.conns = nil
+}
+
+// knownHosts returns a known_hosts line for the bastion with key
+func (b *bastion) knownHosts(key ssh.PublicKey) string {
+	return knownhosts.Line([]string{knownhosts.Normalize(b.addr)}, key)
+}
+
+// startPostgres serves a stand-in PostgreSQL that refuses every login with
+// SQLSTATE 28P01, enough to show the startup message went through the tunnel
+func startPostgres(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length int32
+				if err := binary.Read(conn, binary.BigEndian, &length); err != nil || length < 4 {
+					return
+				}
+				if _, err := io.CopyN(io.Discard, conn, int64(length-4)); err != nil {
+					return
+				}
+				var fields []byte
+				for _, f := range []struct {
+					code  byte
+					value string
+				}{{'S', "FATAL"}, {'C', "28P01"}, {'M', "password authentication failed"}} {
+					fields = append(append(append(fields, f.code), f.value...), 0)
+				}
+				fields = append(fields, 0)
+				msg := []byte{'E', 0, 0, 0, 0}
+				binary.BigEndian.PutUint32(msg[1:], uint32(len(fields)+4))
+				conn.Write(append(msg, fields...))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// pingThrough connects to the stand-in PostgreSQL at addr through tunnel the
+// way the manager does and returns the SQLSTATE it answered with
+func pingThrough(t *testing.T, tunnel *sshTunnel, addr string) (pq.ErrorCode, error) {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(addr)
+	connector, err := pq.NewConnector("host=" + host + " port=" + port + " user=u dbname=d sslmode=disable connect_timeout=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connector.Dialer(tunnel)
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = db.PingContext(ctx)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code, nil
+	}
+	return "", err
+}
+
+func testManager() *DatabaseManager {
+	return &DatabaseManager{resources: &config.SystemResources{ConnectTimeout: 5 * time.Second}}
+}
+
+func userKeyPair(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(block)), signer.PublicKey()
+}
+
+func TestTunnelForwardsThroughBastion(t *testing.T) {
+	privateKey, publicKey := userKeyPair(t)
+	b := startBastion(t, publicKey)
+	postgres := startPostgres(t)
+	host, port, _ := net.SplitHostPort(b.addr)
+
+	tests := []struct {
+		name string
+		cfg  SSHTunnelConfig
+	}{
+		{"password", SSHTunnelConfig{Host: host, Port: port, User: "tunnel", Password: "secret", KnownHosts: b.knownHosts(b.hostKey)}},
+		{"private key", SSHTunnelConfig{Host: host, Port: port, User: "tunnel", PrivateKey: privateKey, KnownHosts: b.knownHosts(b.hostKey)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel, err := testManager().openTunnel(context.Background(), &tt.cfg)
+			if err != nil {
+				t.Fatalf("openTunnel: %v", err)
+			}
+			defer tunnel.Close()
+
+			code, err := pingThrough(t, tunnel, postgres)
+			if err != nil {
+				t.Fatalf("ping: %v", err)
+			}
+			if code != "28P01" {
+				t.Errorf("SQLSTATE = %s, want 28P01 from the server behind the bastion", code)
+			}
+			if status := tunnel.Status(); !status.Healthy || status.Bastion != b.addr {
+				t.Errorf("status = %+v, want a healthy tunnel to %s", status, b.addr)
+			}
+		})
+	}
+}
+
+func TestTunnelErrorStages(t *testing.T) {
+	b := startBastion(t, nil)
+	host, port, _ := net.SplitHostPort(b.addr)
+
+	_, otherKey := userKeyPair(t)
+
+	// A listener that hangs up before the SSH handshake
+	hangup, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hangup.Close()
+	go func() {
+		for {
+			conn, err := hangup.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	hangupHost, hangupPort, _ := net.SplitHostPort(hangup.Addr().String())
+
+	tests := []struct {
+		name  string
+		cfg   SSHTunnelConfig
+		stage string
+	}{
+		{
+			name:  "known_hosts mismatch",
+			cfg:   SSHTunnelConfig{Host: host, Port: port, User: "tunnel", Password: "secret", KnownHosts: b.knownHosts(otherKey)},
+			stage: "host_key",
+		},
+		{
+			name:  "wrong password",
+			cfg:   SSHTunnelConfig{Host: host, Port: port, User: "tunnel", Password: "wrong", KnownHosts: b.knownHosts(b.hostKey)},
+			stage: "auth",
+		},
+		{
+			name:  "bastion hangs up during the handshake",
+			cfg:   SSHTunnelConfig{Host: hangupHost, Port: hangupPort, User: "tunnel", Password: "secret", KnownHosts: b.knownHosts(b.hostKey)},
+			stage: "dial",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel, err := testManager().openTunnel(context.Background(), &tt.cfg)
+			if err == nil {
+				tunnel.Close()
+				t.Fatal("openTunnel succeeded, want an error")
+			}
+			var tunnelErr *TunnelError
+			if !errors.As(err, &tunnelErr) {
+				t.Fatalf("error = %v, want a TunnelError", err)
+			}
+			if tunnelErr.Stage != tt.stage {
+				t.Errorf("stage = %q, want %q (%v)", tunnelErr.Stage, tt.stage, err)
+			}
+		})
+	}
+}
+
+func TestTunnelReconnectsAfterBastionDrops(t *testing.T) {
+	b := startBastion(t, nil)
+	postgres := startPostgres(t)
+	host, port, _ := net.SplitHostPort(b.addr)
+
+	cfg := SSHTunnelConfig{Host: host, Port: port, User: "tunnel", Password: "secret", KnownHosts: b.knownHosts(b.hostKey)}
+	tunnel, err := testManager().openTunnel(context.Background(), &cfg)
+	if err != nil {
+		t.Fatalf("openTunnel: %v", err)
+	}
+	defer tunnel.Close()
+
+	if _, err := pingThrough(t, tunnel, postgres); err != nil {
+		t.Fatalf("ping before the drop: %v", err)
+	}
+
+	b.drop()
+	deadline := time.Now().Add(5 * time.Second)
+	for tunnel.Status().Healthy {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel still reported healthy after the bastion dropped it")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	code, err := pingThrough(t, tunnel, postgres)
+	if err != nil {
+		t.Fatalf("ping after the drop: %v", err)
+	}
+	if code != "28P01" {
+		t.Errorf("SQLSTATE = %s, want 28P01", code)
+	}
+	if status := tunnel.Status(); !status.Healthy || status.Reconnects != 1 {
+		t.Errorf("status = %+v, want healthy after 1 reconnect", status)
+	}
+}
@@ -0,0 +1,323 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// Date and time types whose input syntax PostgreSQL checks, by information_schema data type
+var timeTypes = map[string]string{
+	"date":                        "date",
+	"timestamp without time zone": "timestamp",
+	"timestamp with time zone":    "timestamptz",
+	"time without time zone":      "time",
+	"time with time zone":         "timetz",
+}
+
+// validateRow checks a write payload against the table schema and returns the
+// values coerced to what the driver expects. When partial is false the payload
+// is treated as a new row and required columns must be present.
+func validateRow(schema *TableSchema, data map[string]interface{}, partial bool) (map[string]interface{}, error) {
+	columns := make(map[string]ColumnSchema, len(schema.Columns))
+	for _, col := range schema.Columns {
+		columns[col.Name] = col
+	}
+
+	verr := &ValidationError{}
+	values := make(map[string]interface{}, len(data))
+
+	for name, value := range data {
+		col, ok := columns[name]
+		if !ok {
+			verr.add(name, "unknown_column", "column does not exist")
+			continue
+		}
+
+		// Generated columns cannot be written, so a null sent back for one is ignored
+		if value == nil && col.IsGenerated {
+			continue
+		}
+
+		if col.IsGenerated {
+			verr.add(name, "generated_column", "column is generated and cannot be written")
+			continue
+		}
+
+		coerced, ferr := coerceValue(col, value)
+		if ferr != nil {
+			verr.Fields = append(verr.Fields, *ferr)
+			continue
+		}
+		values[name] = coerced
+	}
+
+	if !partial {
+		for _, col := range schema.Columns {
+			if _, ok := values[col.Name]; ok {
+				continue
+			}
+			if !col.IsNullable && !col.HasDefault && !col.IsGenerated {
+				verr.add(col.Name, "required", "column is required")
+			}
+		}
+	}
+
+	if err := verr.errOrNil(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// coerceValue converts a decoded JSON value into a driver value suitable for the column
+func coerceValue(col ColumnSchema, value interface{}) (interface{}, *FieldError) {
+	invalid := func(format string, args ...interface{}) *FieldError {
+		return &FieldError{Field: col.Name, Code: "invalid_type", Message: fmt.Sprintf(format, args...)}
+	}
+
+	if value == nil {
+		if !col.IsNullable {
+			return nil, &FieldError{Field: col.Name, Code: "not_null", Message: "column cannot be null"}
+		}
+		return nil, nil
+	}
+
+	if len(col.EnumValues) > 0 {
+		s, ok := value.(string)
+		if !ok {
+			return nil, invalid("expected one of %s", strings.Join(col.EnumValues, ", "))
+		}
+		for _, allowed := range col.EnumValues {
+			if s == allowed {
+				return s, nil
+			}
+		}
+		return nil, &FieldError{
+			Field:   col.Name,
+			Code:    "invalid_enum",
+			Message: fmt.Sprintf("value must be one of %s", strings.Join(col.EnumValues, ", ")),
+		}
+	}
+
+	switch strings.ToLower(col.DataType) {
+	case "smallint", "integer", "bigint":
+		n, err := toInt64(value)
+		if err != nil {
+			return nil, invalid("expected an integer")
+		}
+		var lo, hi int64 = math.MinInt64, math.MaxInt64
+		switch strings.ToLower(col.DataType) {
+		case "smallint":
+			lo, hi = math.MinInt16, math.MaxInt16
+		case "integer":
+			lo, hi = math.MinInt32, math.MaxInt32
+		}
+		if n < lo || n > hi {
+			return nil, &FieldError{
+				Field:   col.Name,
+				Code:    "out_of_range",
+				Message: fmt.Sprintf("value must be between %d and %d", lo, hi),
+			}
+		}
+		return n, nil
+
+	case "numeric", "decimal", "real", "double precision":
+		s, ok := numberString(value)
+		if !ok {
+			return nil, invalid("expected a number")
+		}
+		if _, err := strconv.ParseFloat(s, 64); err != nil && !strings.EqualFold(s, "NaN") {
+			return nil, invalid("expected a number")
+		}
+		return s, nil
+
+	case "boolean":
+		b, ok := toBool(value)
+		if !ok {
+			return nil, invalid("expected a boolean")
+		}
+		return b, nil
+
+	case "character varying", "character", "text":
+		var s string
+		switch v := value.(type) {
+		case string:
+			s = v
+		case json.Number:
+			s = v.String()
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			s = strconv.FormatBool(v)
+		default:
+			return nil, invalid("expected a string")
+		}
+		if col.MaxLength != nil && utf8.RuneCountInString(s) > *col.MaxLength {
+			return nil, &FieldError{
+				Field:   col.Name,
+				Code:    "too_long",
+				Message: fmt.Sprintf("value exceeds maximum length of %d", *col.MaxLength),
+			}
+		}
+		return s, nil
+
+	case "uuid":
+		s, ok := value.(string)
+		if !ok || !isUUID(s) {
+			return nil, invalid("expected a UUID")
+		}
+		return s, nil
+
+	case "date", "timestamp without time zone", "timestamp with time zone",
+		"time without time zone", "time with time zone":
+		// The format is left to checkTimeValues, which asks the server
+		s, ok := value.(string)
+		if !ok || strings.TrimSpace(s) == "" {
+			return nil, invalid("expected a date or time string")
+		}
+		return s, nil
+
+	case "json", "jsonb":
+		if s, ok := value.(string); ok && json.Valid([]byte(s)) {
+			return s, nil
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, invalid("value cannot be encoded as JSON")
+		}
+		return string(b), nil
+
+	case "array":
+		switch v := value.(type) {
+		case []interface{}:
+			return pq.Array(v), nil
+		case string:
+			return v, nil
+		default:
+			return nil, invalid("expected an array")
+		}
+	}
+
+	// Leave anything we do not model to PostgreSQL, but reject JSON structures
+	// the driver cannot encode
+	switch v := value.(type) {
+	case map[string]interface{}, []interface{}:
+		return nil, invalid("unsupported value for column of type %s", col.DataType)
+	case json.Number:
+		return v.String(), nil
+	default:
+		return v, nil
+	}
+}
+
+// toInt64 accepts JSON numbers and numeric strings that represent whole numbers
+func toInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return strconv.ParseInt(v.String(), 10, 64)
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v > math.MaxInt64 {
+			return 0, fmt.Errorf("not an integer")
+		}
+		return int64(v), nil
+	case string:
+		return strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	default:
+		return 0, fmt.Errorf("not an integer")
+	}
+}
+
+// numberString returns the textual form of a numeric value so numeric columns keep their precision
+func numberString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.String(), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case string:
+		return strings.TrimSpace(v), true
+	default:
+		return "", false
+	}
+}
+
+// toBool accepts booleans and the textual forms PostgreSQL understands
+func toBool(value interface{}) (bool, bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case json.Number:
+		switch v.String() {
+		case "1":
+			return true, true
+		case "0":
+			return false, true
+		}
+	case float64:
+		switch v {
+		case 1:
+			return true, true
+		case 0:
+			return false, true
+		}
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "true", "t", "yes", "y", "on", "1":
+			return true, true
+		case "false", "f", "no", "n", "off", "0":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// isUUID reports whether s is a UUID in any of the formats PostgreSQL accepts
+func isUUID(s string) bool {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	s = strings.ReplaceAll(s, "-", "")
+	if len(s) != 32 {
+		return false
+	}
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkTimeValues has the server parse the date and time values of a
+// validated row, so anything PostgreSQL accepts is accepted, and reports the
+// values it rejects as field errors
+func checkTimeValues(ctx context.Context, db *sql.DB, schema *TableSchema, values map[string]interface{}) error {
+	verr := &ValidationError{}
+	for _, col := range schema.Columns {
+		typ, ok := timeTypes[strings.ToLower(col.DataType)]
+		if !ok || len(col.EnumValues) > 0 {
+			continue
+		}
+		s, ok := values[col.Name].(string)
+		if !ok {
+			continue
+		}
+		var parsed string
+		err := db.QueryRowContext(ctx, "SELECT $1::"+typ+"::text", s).Scan(&parsed)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code.Class() == "22" {
+			verr.add(col.Name, "invalid_type", "expected a date or time string: %s", pqErr.Message)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check %s: %w", col.Name, err)
+		}
+	}
+	return verr.errOrNil()
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"dbviewer-saas/pkg/apierror"
+	"dbviewer-saas/pkg/database"
+	"dbviewer-saas/pkg/history"
+
+	"github.com/gorilla/mux"
+)
+
+// HandleAggregate groups the rows of a table matching a filter and returns
+// one row per group with the requested aggregates
+func (h *DatabaseHandler) HandleAggregate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var q database.AggregateQuery
+	if err := decodeJSON(r, &q); err != nil {
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Invalid request body"))
+		return
+	}
+	q.Table = mux.Vars(r)["table"]
+
+	result, err := h.aggregate(r, q)
+	if err != nil {
+		apierror.Write(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+// aggregate runs q and records it in the history
+func (h *DatabaseHandler) aggregate(r *http.Request, q database.AggregateQuery) (*database.AggregateResult, error) {
+	start := time.Now()
+	entry := history.Entry{Kind: history.KindAggregate, Table: q.Table}
+	if query, args, buildErr := h.dbManager.BuildAggregateQuery(r.Context(), q); buildErr == nil {
+		entry.SQL, entry.Params = query, args
+	}
+
+	result, err := h.dbManager.Aggregate(r.Context(), q)
+	rows := -1
+	if err == nil {
+		rows = len(result.Rows)
+	}
+	h.recordHistory(r, entry, q, start, rows, err)
+	return result, err
+}
+
+// HandlePivot crosstabs the rows of a table matching a filter by row
+// dimensions and a column dimension, with totals and subtotals
+func (h *DatabaseHandler) HandlePivot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var q database.PivotQuery
+	if err := decodeJSON(r, &q); err != nil {
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Invalid request body"))
+		return
+	}
+	q.Table = mux.Vars(r)["table"]
+
+	result, err := h.pivot(r, q)
+	if err != nil {
+		apierror.Write(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+// pivot runs q and records it in the history
+func (h *DatabaseHandler) pivot(r *http.Request, q database.PivotQuery) (*database.PivotResult, error) {
+	start := time.Now()
+	entry := history.Entry{Kind: history.KindPivot, Table: q.Table}
+	if query, args, buildErr := h.dbManager.BuildPivotQuery(r.Context(), q); buildErr == nil {
+		entry.SQL, entry.Params = query, args
+	}
+
+	result, err := h.dbManager.Pivot(r.Context(), q)
+	rows := -1
+	if err == nil {
+		rows = len(result.Rows)
+	}
+	h.recordHistory(r, entry, q, start, rows, err)
+	return result, err
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"dbviewer-saas/pkg/apierror"
+)
+
+// Interval of comment lines that keep idle event streams open through proxies
+const eventStreamHeartbeat = 15 * time.Second
+
+// HandleConnectionStatus returns the health of the current database connection
+func (h *DatabaseHandler) HandleConnectionStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.dbManager.HealthStatus())
+}
+
+// HandleConnectionEvents streams connection health as server-sent events. The
+// current state is sent first, then every update until the client goes away.
+func (h *DatabaseHandler) HandleConnectionEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// The stream outlives the server's write timeout, so lift the deadline for this response
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		apierror.Write(w, apierror.Wrap(err, apierror.CodeInternal, "Streaming is not supported"))
+		return
+	}
+
+	updates, unsubscribe := h.dbManager.SubscribeHealth()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event string, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	if err := send("status", h.dbManager.HealthStatus()); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(eventStreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case status, ok := <-updates:
+			if !ok {
+				// The server is shutting down
+				send("shutdown", map[string]string{"state": "shutdown"})
+				return
+			}
+			if err := send("status", status); err != nil {
+				slog.DebugContext(r.Context(), "Connection event stream closed", "error", err)
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
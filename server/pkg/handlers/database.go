@@ -3,27 +3,51 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"dbviewer-saas/config"
+	"dbviewer-saas/pkg/apierror"
+	"dbviewer-saas/pkg/auth"
 	"dbviewer-saas/pkg/database"
+	"dbviewer-saas/pkg/history"
+	"dbviewer-saas/pkg/savedquery"
+	"dbviewer-saas/pkg/tableview"
 
 	"github.com/gorilla/mux"
 )
 
 type DatabaseHandler struct {
 	dbManager *database.DatabaseManager
+	// history records queries and table views; nil when disabled
+	history      *history.Store
+	savedQueries *savedquery.Store
+	views        *tableview.Store
+	search       config.SearchConfig
 }
 
-func NewDatabaseHandler(dbManager *database.DatabaseManager) *DatabaseHandler {
+func NewDatabaseHandler(dbManager *database.DatabaseManager, historyStore *history.Store, savedQueries *savedquery.Store, views *tableview.Store, search config.SearchConfig) *DatabaseHandler {
 	return &DatabaseHandler{
-		dbManager: dbManager,
+		dbManager:    dbManager,
+		history:      historyStore,
+		savedQueries: savedQueries,
+		views:        views,
+		search:       search,
 	}
 }
 
+// connection names the current connection profile (user@host/database), or
+// is empty when there is none
+func (h *DatabaseHandler) connection() string {
+	if profile := h.dbManager.CurrentConnection(); profile != nil {
+		return profile.String()
+	}
+	return ""
+}
+
 // HandleConnect handles database connection requests
 func (h *DatabaseHandler) HandleConnect(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -36,66 +60,45 @@ func (h *DatabaseHandler) HandleConnect(w http.ResponseWriter, r *http.Request)
 	// Parse the request body
 	var connConfig database.ConnectionConfig
 	if err := json.NewDecoder(r.Body).Decode(&connConfig); err != nil {
-		log.Printf("Error parsing connection request: %v", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		slog.InfoContext(r.Context(), "Invalid connection request", "error", err)
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Invalid request body"))
 		return
 	}
 
 	// Validate required fields
 	if connConfig.URL == "" {
-		log.Printf("Missing URL in connection request")
-		http.Error(w, "Database URL is required", http.StatusBadRequest)
-		return
-	}
-
-	if connConfig.Username == "" {
-		log.Printf("Missing username in connection request")
-		http.Error(w, "Username is required", http.StatusBadRequest)
+		apierror.Write(w, apierror.InvalidField("url", "Database URL is required"))
 		return
 	}
 
-	if connConfig.Database == "" {
-		log.Printf("Missing database name in connection request")
-		http.Error(w, "Database name is required", http.StatusBadRequest)
-		return
-	}
-
-	// Log connection attempt (without password)
-	log.Printf("Connection attempt with URL: %s, Username: %s, Database: %s",
-		connConfig.URL, connConfig.Username, connConfig.Database)
+	// Username and database may come from a URI or key=value URL instead;
+	// Connect reports whichever is still missing
 
 	// Try to connect
-	if err := h.dbManager.Connect(connConfig); err != nil {
-		log.Printf("Connection failed: %v", err)
-
-		// Check error type to determine appropriate status code
-		if strings.Contains(strings.ToLower(err.Error()), "authentication") ||
-			strings.Contains(strings.ToLower(err.Error()), "password") {
-			http.Error(w, fmt.Sprintf("Authentication failed: %v", err), http.StatusUnauthorized)
-			return
-		}
-
-		if strings.Contains(strings.ToLower(err.Error()), "no such host") ||
-			strings.Contains(strings.ToLower(err.Error()), "connection refused") {
-			http.Error(w, fmt.Sprintf("Connection refused: %v", err), http.StatusBadGateway)
-			return
-		}
+	tlsInfo, err := h.dbManager.Connect(r.Context(), connConfig)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Connection failed", "error", err)
 
-		// Default error response
-		http.Error(w, fmt.Sprintf("Failed to connect: %v", err), http.StatusBadRequest)
+		// Classify by driver and network error types to pick the status
+		apierror.Write(w, err)
 		return
 	}
 
-	// Log successful connection
-	log.Printf("Successfully connected to database %s via %s",
-		connConfig.Database, connConfig.URL)
+	// Report what was parsed from the URL rather than the URL itself, which
+	// may hold a password
+	var dbName, host string
+	if profile := h.dbManager.CurrentConnection(); profile != nil {
+		dbName, host = profile.Database, profile.Host
+	}
 
 	// Return success response
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status":   "connected",
-		"database": connConfig.Database,
-		"host":     connConfig.URL,
+		"database": dbName,
+		"host":     host,
+		"tls":      tlsInfo,
+		"tunnel":   h.dbManager.TunnelStatus(),
 	})
 }
 
@@ -106,37 +109,97 @@ func (h *DatabaseHandler) HandleTableData(w http.ResponseWriter, r *http.Request
 	vars := mux.Vars(r)
 	tableName := vars["table"]
 	if tableName == "" {
-		http.Error(w, "Table name is required", http.StatusBadRequest)
+		apierror.Write(w, apierror.InvalidField("table", "Table name is required"))
 		return
 	}
 
 	// Parse pagination
 	page, pageSize := getPaginationParams(r)
+	q := database.TableQuery{Table: tableName, Page: page, PageSize: pageSize}
+
+	// A view supplies the filter, sort and page size the request leaves out
+	query := r.URL.Query()
+	var view *tableview.View
+	if id := query.Get("view"); id != "" {
+		v, err := h.views.Get(auth.FromContext(r.Context()), h.connection(), tableName, id)
+		if err != nil {
+			apierror.Write(w, viewError(err))
+			return
+		}
+		view = &v
+		q.Filter, q.Sort = v.Filter, v.Sort
+		if v.PageSize > 0 && !query.Has("pageSize") {
+			q.PageSize = v.PageSize
+		}
+	}
+	if raw := query.Get("filter"); raw != "" {
+		var filter database.Filter
+		decoder := json.NewDecoder(strings.NewReader(raw))
+		decoder.UseNumber()
+		if err := decoder.Decode(&filter); err != nil {
+			apierror.Write(w, apierror.InvalidField("filter", "filter must be a JSON filter tree"))
+			return
+		}
+		q.Filter = &filter
+	}
+	if query.Has("sort") {
+		q.Sort = parseSort(query.Get("sort"))
+	}
+	q.Search = strings.TrimSpace(query.Get("q"))
 
-	// Get total count
-	totalCount, err := h.dbManager.GetTableCount(tableName)
+	response, err := h.tableData(r, q)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apierror.Write(w, err)
 		return
 	}
+	if view != nil {
+		response["view"] = view
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+// tableData reads a page of a table with its total count and records the view in the history
+func (h *DatabaseHandler) tableData(r *http.Request, q database.TableQuery) (map[string]interface{}, error) {
+	start := time.Now()
+	entry := history.Entry{Kind: history.KindTable, Table: q.Table}
+	query, args, err := h.dbManager.BuildTableQuery(r.Context(), q)
+	if err != nil {
+		h.recordHistory(r, entry, q, start, -1, err)
+		return nil, err
+	}
+	entry.SQL, entry.Params = query, args
+
+	// Get total count
+	totalCount, err := h.dbManager.GetTableCount(r.Context(), q)
+	if err != nil {
+		h.recordHistory(r, entry, q, start, -1, err)
+		return nil, err
+	}
 
 	// Get data with schema-aware conversions
-	rows, err := h.dbManager.GetTableDataPaginated(tableName, page, pageSize)
+	rows, err := h.dbManager.GetTableDataPaginated(r.Context(), q)
+	h.recordHistory(r, entry, q, start, len(rows), err)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	response := map[string]interface{}{
 		"rows":       rows,
 		"totalCount": totalCount,
-		"page":       page,
-		"pageSize":   pageSize,
-	}
-
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+		"page":       q.Page,
+		"pageSize":   q.PageSize,
+	}
+	if q.Search != "" {
+		// The schema was cached when the query was built
+		if schema, err := h.dbManager.GetTableSchema(r.Context(), q.Table); err == nil {
+			mode, columns := database.SearchStrategy(schema)
+			response["search"] = map[string]interface{}{"mode": mode, "columns": columns}
+		}
 	}
+	return response, nil
 }
 
 func getPaginationParams(r *http.Request) (page, pageSize int) {
@@ -156,6 +219,13 @@ func getPaginationParams(r *http.Request) (page, pageSize int) {
 	return page, pageSize
 }
 
+// decodeJSON decodes a request body keeping numbers exact so large integers survive
+func decodeJSON(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
 // HandleListTables handles listing all tables in the database
 func (h *DatabaseHandler) HandleListTables(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -165,9 +235,9 @@ func (h *DatabaseHandler) HandleListTables(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	tables, err := h.dbManager.ListTables()
+	tables, err := h.dbManager.ListTables(r.Context())
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to list tables: %v", err), http.StatusInternalServerError)
+		apierror.Write(w, fmt.Errorf("failed to list tables: %w", err))
 		return
 	}
 
@@ -189,18 +259,18 @@ func (h *DatabaseHandler) HandleTableSchema(w http.ResponseWriter, r *http.Reque
 	vars := mux.Vars(r)
 	tableName := vars["table"]
 	if tableName == "" {
-		http.Error(w, "Table name is required", http.StatusBadRequest)
+		apierror.Write(w, apierror.InvalidField("table", "Table name is required"))
 		return
 	}
 
-	schema, err := h.dbManager.GetTableSchema(tableName)
+	schema, err := h.dbManager.GetTableSchema(r.Context(), tableName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apierror.Write(w, err)
 		return
 	}
 
 	if err := json.NewEncoder(w).Encode(schema); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+		slog.WarnContext(r.Context(), "Failed to encode response", "error", err)
 	}
 }
 
@@ -214,58 +284,37 @@ func (h *DatabaseHandler) HandleDirectConnect(w http.ResponseWriter, r *http.Req
 
 	// Parse request body
 	var req struct {
-		URL string `json:"url"`
+		URL string                    `json:"url"`
+		SSL database.SSLConfig        `json:"ssl"`
+		SSH *database.SSHTunnelConfig `json:"ssh"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Invalid request body"))
 		return
 	}
 
-	// Validate URL
-	if req.URL == "" {
-		http.Error(w, "Database URL is required", http.StatusBadRequest)
-		return
-	}
-
-	// Parse the database URL
-	dbURL, err := url.Parse(req.URL)
+	// Parse the postgres:// URI or key=value string. An sslmode in it applies
+	// unless the body sets ssl.mode.
+	spec, err := database.ParseConnSpec("url", req.URL)
 	if err != nil {
-		http.Error(w, "Invalid database URL", http.StatusBadRequest)
+		apierror.Write(w, err)
 		return
 	}
 
-	// Extract credentials from the URL
-	username := ""
-	password := ""
-	if dbURL.User != nil {
-		username = dbURL.User.Username()
-		password, _ = dbURL.User.Password()
-	}
-
-	// Extract database name from path
-	dbName := strings.TrimPrefix(dbURL.Path, "/")
-
-	// Create connection config
-	config := database.DirectConnectionConfig{
-		Host:     dbURL.Hostname(),
-		Port:     dbURL.Port(),
-		User:     username,
-		Password: password,
-		DBName:   dbName,
-		SSLMode:  "require",
-	}
-
 	// Attempt to connect
-	if err := h.dbManager.ConnectDirect(config); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to connect to database: %v", err), http.StatusInternalServerError)
+	tlsInfo, err := h.dbManager.ConnectSpec(r.Context(), spec, req.SSL, req.SSH)
+	if err != nil {
+		apierror.Write(w, err)
 		return
 	}
 
 	// Return success response
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
+	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message": "Successfully connected to database",
+		"tls":     tlsInfo,
+		"tunnel":  h.dbManager.TunnelStatus(),
 	})
 }
 
@@ -276,19 +325,19 @@ func (h *DatabaseHandler) HandleCreateRow(w http.ResponseWriter, r *http.Request
 	vars := mux.Vars(r)
 	tableName := vars["table"]
 	if tableName == "" {
-		http.Error(w, "Table name is required", http.StatusBadRequest)
+		apierror.Write(w, apierror.InvalidField("table", "Table name is required"))
 		return
 	}
 
 	var rowData map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&rowData); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := decodeJSON(r, &rowData); err != nil {
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Invalid request body"))
 		return
 	}
 
 	// Create the row
-	if err := h.dbManager.CreateRow(tableName, rowData); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create row: %v", err), http.StatusInternalServerError)
+	if err := h.dbManager.CreateRow(r.Context(), tableName, rowData); err != nil {
+		apierror.Write(w, err)
 		return
 	}
 
@@ -307,19 +356,19 @@ func (h *DatabaseHandler) HandleUpdateRow(w http.ResponseWriter, r *http.Request
 	id := vars["id"]
 
 	if tableName == "" || id == "" {
-		http.Error(w, "Table name and ID are required", http.StatusBadRequest)
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Table name and ID are required"))
 		return
 	}
 
 	var rowData map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&rowData); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := decodeJSON(r, &rowData); err != nil {
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Invalid request body"))
 		return
 	}
 
 	// Update the row
-	if err := h.dbManager.UpdateRow(tableName, id, rowData); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to update row: %v", err), http.StatusInternalServerError)
+	if err := h.dbManager.UpdateRow(r.Context(), tableName, id, rowData); err != nil {
+		apierror.Write(w, err)
 		return
 	}
 
@@ -338,13 +387,13 @@ func (h *DatabaseHandler) HandleDeleteRow(w http.ResponseWriter, r *http.Request
 	id := vars["id"]
 
 	if tableName == "" || id == "" {
-		http.Error(w, "Table name and ID are required", http.StatusBadRequest)
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Table name and ID are required"))
 		return
 	}
 
 	// Delete the row
-	if err := h.dbManager.DeleteRow(tableName, id); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to delete row: %v", err), http.StatusInternalServerError)
+	if err := h.dbManager.DeleteRow(r.Context(), tableName, id); err != nil {
+		apierror.Write(w, err)
 		return
 	}
 
@@ -363,19 +412,15 @@ func (h *DatabaseHandler) HandleUpdateCell(w http.ResponseWriter, r *http.Reques
 	pkValue := vars["id"]
 	columnName := vars["column"]
 
-	log.Printf("Attempting to update cell - Table: %s, Column: %s, PK Value: %s", tableName, columnName, pkValue)
-
 	if tableName == "" || pkValue == "" || columnName == "" {
-		log.Printf("Error: Missing required parameters - Table: %s, Column: %s, PK Value: %s", tableName, columnName, pkValue)
-		http.Error(w, "Table name, ID, and column name are required", http.StatusBadRequest)
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Table name, ID, and column name are required"))
 		return
 	}
 
 	// Get the primary key column name
-	schema, err := h.dbManager.GetTableSchema(tableName)
+	schema, err := h.dbManager.GetTableSchema(r.Context(), tableName)
 	if err != nil {
-		log.Printf("Error getting table schema: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to get table schema: %v", err), http.StatusInternalServerError)
+		apierror.Write(w, err)
 		return
 	}
 
@@ -389,35 +434,62 @@ func (h *DatabaseHandler) HandleUpdateCell(w http.ResponseWriter, r *http.Reques
 	}
 
 	if pkColumn == "" {
-		log.Printf("Error: No primary key found for table %s", tableName)
-		http.Error(w, "No primary key found for table", http.StatusBadRequest)
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "No primary key found for table").WithDetail("table", tableName))
 		return
 	}
 
 	var cellData struct {
 		Value interface{} `json:"value"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&cellData); err != nil {
-		log.Printf("Error decoding request body: %v", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := decodeJSON(r, &cellData); err != nil {
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Invalid request body"))
 		return
 	}
 
-	log.Printf("Updating cell - Table: %s, PK Column: %s, PK Value: %s, Column: %s, New Value: %v",
-		tableName, pkColumn, pkValue, columnName, cellData.Value)
-
 	// Update the cell using the primary key
-	if err := h.dbManager.UpdateCell(tableName, pkColumn, pkValue, columnName, cellData.Value); err != nil {
-		log.Printf("Error updating cell: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to update cell: %v", err), http.StatusInternalServerError)
+	if err := h.dbManager.UpdateCell(r.Context(), tableName, pkColumn, pkValue, columnName, cellData.Value); err != nil {
+		apierror.Write(w, err)
 		return
 	}
 
-	log.Printf("Successfully updated cell - Table: %s, PK Column: %s, PK Value: %s, Column: %s",
-		tableName, pkColumn, pkValue, columnName)
+	slog.InfoContext(r.Context(), "Updated cell", "table", tableName, "column", columnName)
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
 		"message": "Cell updated successfully",
 	})
 }
+
+// HandleInvalidateCache drops cached schema metadata and results, either for a
+// single table or for the whole connection
+func (h *DatabaseHandler) HandleInvalidateCache(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// The table may be given in the body or the query string; both are optional
+	var req struct {
+		Table string `json:"table"`
+	}
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Invalid request body"))
+			return
+		}
+	}
+	if req.Table == "" {
+		req.Table = r.URL.Query().Get("table")
+	}
+
+	removed := h.dbManager.InvalidateCache(req.Table)
+	slog.InfoContext(r.Context(), "Invalidated cache entries", "count", removed, "table", req.Table)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"invalidated": removed,
+		"table":       req.Table,
+	})
+}
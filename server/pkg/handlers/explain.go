@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"dbviewer-saas/pkg/apierror"
+	"dbviewer-saas/pkg/database"
+	"dbviewer-saas/pkg/history"
+)
+
+// explainRequest names either a statement or a table page to explain
+type explainRequest struct {
+	Statement string             `json:"statement,omitempty"`
+	Table     string             `json:"table,omitempty"`
+	Page      int                `json:"page,omitempty"`
+	PageSize  *int               `json:"pageSize,omitempty"`
+	Filter    *database.Filter   `json:"filter,omitempty"`
+	Sort      []database.SortKey `json:"sort,omitempty"`
+	Search    string             `json:"search,omitempty"`
+	database.ExplainOptions
+}
+
+// HandleExplain returns the plan of either a statement or the data query of a
+// table page. With analyze set the statement is executed inside a transaction
+// that is rolled back.
+func (h *DatabaseHandler) HandleExplain(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var req explainRequest
+	if err := decodeJSON(r, &req); err != nil {
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Invalid request body"))
+		return
+	}
+
+	result, err := h.explain(r, req)
+	if err != nil {
+		apierror.Write(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+// explain runs req and records it in the history
+func (h *DatabaseHandler) explain(r *http.Request, req explainRequest) (*database.ExplainResult, error) {
+	if (req.Statement == "") == (req.Table == "") {
+		return nil, apierror.New(apierror.CodeInvalidRequest, "Either statement or table is required")
+	}
+
+	start := time.Now()
+	var result *database.ExplainResult
+	var err error
+	entry := history.Entry{Kind: history.KindExplain, Table: req.Table, SQL: req.Statement}
+	if req.Table != "" {
+		// Defaults match those of the table data endpoint
+		q := database.TableQuery{Table: req.Table, Page: req.Page, PageSize: 25, Filter: req.Filter, Sort: req.Sort, Search: req.Search}
+		if req.PageSize != nil {
+			q.PageSize = *req.PageSize
+		}
+		if query, args, buildErr := h.dbManager.BuildTableQuery(r.Context(), q); buildErr == nil {
+			entry.SQL, entry.Params = query, args
+		}
+		result, err = h.dbManager.ExplainTable(r.Context(), q, req.ExplainOptions)
+	} else {
+		result, err = h.dbManager.Explain(r.Context(), req.Statement, req.ExplainOptions)
+	}
+
+	h.recordHistory(r, entry, req, start, -1, err)
+	return result, err
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"dbviewer-saas/pkg/apierror"
+	"dbviewer-saas/pkg/auth"
+	"dbviewer-saas/pkg/database"
+	"dbviewer-saas/pkg/history"
+
+	"github.com/gorilla/mux"
+)
+
+// recordHistory completes entry with the caller, connection and outcome and
+// stores it. rows is -1 when the request returns no rows. Failures to record
+// are logged and do not affect the request.
+func (h *DatabaseHandler) recordHistory(r *http.Request, entry history.Entry, request interface{}, start time.Time, rows int, err error) {
+	if h.history == nil {
+		return
+	}
+
+	id := auth.FromContext(r.Context())
+	entry.User, entry.Team = id.User, id.Team
+	entry.Connection = h.connection()
+	entry.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		entry.Error = apierror.From(err).Message
+	} else if rows >= 0 {
+		n := int64(rows)
+		entry.Rows = &n
+	}
+
+	raw, marshalErr := json.Marshal(request)
+	if marshalErr != nil {
+		slog.WarnContext(r.Context(), "Failed to record history entry", "error", marshalErr)
+		return
+	}
+	entry.Request = raw
+
+	if _, err := h.history.Record(entry); err != nil {
+		slog.WarnContext(r.Context(), "Failed to record history entry", "error", err)
+	}
+}
+
+// HandleHistory lists the caller's history, newest first. Query parameters:
+// q searches the SQL, table and error; kind, table, connection and status
+// (ok or error) filter; since and until bound the time (RFC 3339); page and
+// pageSize paginate.
+func (h *DatabaseHandler) HandleHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if h.history == nil {
+		apierror.Write(w, apierror.New(apierror.CodeNotFound, "Query history is disabled"))
+		return
+	}
+
+	query := r.URL.Query()
+	page, pageSize := getPaginationParams(r)
+	if page < 0 || pageSize < 1 {
+		apierror.Write(w, apierror.InvalidField("page", "page must not be negative and pageSize must be positive"))
+		return
+	}
+
+	filter := history.Filter{
+		User:       auth.FromContext(r.Context()).User,
+		Connection: query.Get("connection"),
+		Kind:       query.Get("kind"),
+		Table:      query.Get("table"),
+		Search:     query.Get("q"),
+		Status:     query.Get("status"),
+		Offset:     page * pageSize,
+		Limit:      pageSize,
+	}
+	switch filter.Status {
+	case "", "ok", "error":
+	default:
+		apierror.Write(w, apierror.InvalidField("status", "status must be ok or error"))
+		return
+	}
+	for _, bound := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if v := query.Get(bound.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				apierror.Write(w, apierror.InvalidField(bound.name, bound.name+" must be an RFC 3339 time"))
+				return
+			}
+			*bound.dst = t
+		}
+	}
+
+	entries, total := h.history.List(filter)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries":    entries,
+		"totalCount": total,
+		"page":       page,
+		"pageSize":   pageSize,
+	})
+}
+
+// HandleRerunHistory replays a history entry of the caller against the current
+// connection and responds like the endpoint that produced it. The re-run is
+// recorded as a new entry.
+func (h *DatabaseHandler) HandleRerunHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if h.history == nil {
+		apierror.Write(w, apierror.New(apierror.CodeNotFound, "Query history is disabled"))
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	entry, ok := h.history.Get(id)
+	// Other users' entries are reported as missing rather than forbidden
+	if !ok || entry.User != auth.FromContext(r.Context()).User {
+		apierror.Write(w, apierror.New(apierror.CodeNotFound, "History entry not found").WithDetail("id", id))
+		return
+	}
+	// A statement recorded on one database must not silently run on another
+	if entry.Connection != h.connection() {
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "The entry was recorded on another connection").
+			WithDetail("connection", entry.Connection))
+		return
+	}
+
+	var result interface{}
+	var err error
+	switch entry.Kind {
+	case history.KindTable:
+		var q database.TableQuery
+		if err = unmarshalExact(entry.Request, &q); err == nil {
+			result, err = h.tableData(r, q)
+		}
+	case history.KindExplain:
+		var req explainRequest
+		if err = unmarshalExact(entry.Request, &req); err == nil {
+			result, err = h.explain(r, req)
+		}
+	case history.KindSavedQuery:
+		var req savedQueryRun
+		if err = unmarshalExact(entry.Request, &req); err == nil {
+			result, err = h.runSavedQuery(r, req)
+		}
+	case history.KindAggregate:
+		var q database.AggregateQuery
+		if err = unmarshalExact(entry.Request, &q); err == nil {
+			result, err = h.aggregate(r, q)
+		}
+	case history.KindPivot:
+		var q database.PivotQuery
+		if err = unmarshalExact(entry.Request, &q); err == nil {
+			result, err = h.pivot(r, q)
+		}
+	default:
+		err = apierror.New(apierror.CodeInvalidRequest, "History entry cannot be re-run").WithDetail("kind", entry.Kind)
+	}
+	if err != nil {
+		apierror.Write(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+// unmarshalExact decodes a recorded request keeping numbers exact, as when the
+// request was first decoded
+func unmarshalExact(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
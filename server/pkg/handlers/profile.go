@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"dbviewer-saas/pkg/apierror"
+	"dbviewer-saas/pkg/database"
+
+	"github.com/gorilla/mux"
+)
+
+// Limits of the column profile parameters
+const (
+	defaultProfileTopN   = 10
+	maxProfileTopN       = 100
+	defaultProfileBudget = 5 * time.Second
+	maxProfileBudget     = time.Minute
+)
+
+// HandleColumnProfile summarizes the values of a column. Query parameters:
+// source (auto, stats or sample), sample (percent of the table to sample),
+// top (number of common values) and budget (time allowed for sampling, e.g. 10s).
+func (h *DatabaseHandler) HandleColumnProfile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	opts := database.ProfileOptions{
+		Source: query.Get("source"),
+		TopN:   defaultProfileTopN,
+		Budget: defaultProfileBudget,
+	}
+	if v := query.Get("sample"); v != "" {
+		percent, err := strconv.ParseFloat(v, 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			apierror.Write(w, apierror.InvalidField("sample", "sample must be a percentage above 0 and at most 100"))
+			return
+		}
+		opts.SamplePercent = percent
+	}
+	if v := query.Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxProfileTopN {
+			apierror.Write(w, apierror.InvalidField("top", "top must be between 1 and 100"))
+			return
+		}
+		opts.TopN = n
+	}
+	if v := query.Get("budget"); v != "" {
+		budget, err := time.ParseDuration(v)
+		if err != nil || budget < time.Millisecond || budget > maxProfileBudget {
+			apierror.Write(w, apierror.InvalidField("budget", "budget must be a duration between 1ms and 1m"))
+			return
+		}
+		opts.Budget = budget
+	}
+
+	profile, err := h.dbManager.ProfileColumn(r.Context(), vars["table"], vars["column"], opts)
+	if err != nil {
+		apierror.Write(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(profile)
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"dbviewer-saas/pkg/apierror"
+	"dbviewer-saas/pkg/auth"
+	"dbviewer-saas/pkg/database"
+	"dbviewer-saas/pkg/history"
+	"dbviewer-saas/pkg/savedquery"
+
+	"github.com/gorilla/mux"
+)
+
+// savedQueryRun is the body of a run request, also kept in the history for re-runs
+type savedQueryRun struct {
+	ID     string                 `json:"id"`
+	Params map[string]interface{} `json:"params"`
+}
+
+// savedQueryError maps store errors to API errors
+func savedQueryError(err error) error {
+	switch {
+	case errors.Is(err, savedquery.ErrNotFound):
+		return apierror.Wrap(err, apierror.CodeNotFound, "Saved query not found")
+	case errors.Is(err, savedquery.ErrNotOwner):
+		return apierror.Wrap(err, apierror.CodePermissionDenied, "Only the owner can change a saved query")
+	default:
+		return err
+	}
+}
+
+// HandleListSavedQueries lists the caller's queries and those shared with
+// their team, optionally filtered by tag and a search term q
+func (h *DatabaseHandler) HandleListSavedQueries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	queries := h.savedQueries.List(auth.FromContext(r.Context()), savedquery.Filter{
+		Tag:    r.URL.Query().Get("tag"),
+		Search: r.URL.Query().Get("q"),
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"queries":    queries,
+		"paramTypes": database.ParamTypes(),
+	})
+}
+
+// HandleCreateSavedQuery saves a query owned by the caller
+func (h *DatabaseHandler) HandleCreateSavedQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var q savedquery.Query
+	if err := decodeJSON(r, &q); err != nil {
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Invalid request body"))
+		return
+	}
+
+	saved, err := h.savedQueries.Create(auth.FromContext(r.Context()), q)
+	if err != nil {
+		apierror.Write(w, savedQueryError(err))
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Saved query created", "id", saved.ID, "visibility", saved.Visibility)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(saved)
+}
+
+// HandleGetSavedQuery returns a query visible to the caller
+func (h *DatabaseHandler) HandleGetSavedQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	q, err := h.savedQueries.Get(auth.FromContext(r.Context()), mux.Vars(r)["id"])
+	if err != nil {
+		apierror.Write(w, savedQueryError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(q)
+}
+
+// HandleUpdateSavedQuery replaces a query owned by the caller
+func (h *DatabaseHandler) HandleUpdateSavedQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var q savedquery.Query
+	if err := decodeJSON(r, &q); err != nil {
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Invalid request body"))
+		return
+	}
+
+	saved, err := h.savedQueries.Update(auth.FromContext(r.Context()), mux.Vars(r)["id"], q)
+	if err != nil {
+		apierror.Write(w, savedQueryError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(saved)
+}
+
+// HandleDeleteSavedQuery deletes a query owned by the caller
+func (h *DatabaseHandler) HandleDeleteSavedQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err := h.savedQueries.Delete(auth.FromContext(r.Context()), mux.Vars(r)["id"]); err != nil {
+		apierror.Write(w, savedQueryError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Saved query deleted successfully",
+	})
+}
+
+// HandleRunSavedQuery binds the parameters in the body, checked against their
+// declared types, and runs the query against the current connection
+func (h *DatabaseHandler) HandleRunSavedQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var req savedQueryRun
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, &req); err != nil {
+			apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Invalid request body"))
+			return
+		}
+	}
+	req.ID = mux.Vars(r)["id"]
+
+	result, err := h.runSavedQuery(r, req)
+	if err != nil {
+		apierror.Write(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+// runSavedQuery runs req and records it in the history
+func (h *DatabaseHandler) runSavedQuery(r *http.Request, req savedQueryRun) (*database.StatementResult, error) {
+	q, err := h.savedQueries.Get(auth.FromContext(r.Context()), req.ID)
+	if err != nil {
+		return nil, savedQueryError(err)
+	}
+
+	start := time.Now()
+	entry := history.Entry{Kind: history.KindSavedQuery, SQL: q.SQL}
+	query, args, err := database.BindNamed(q.SQL, q.Params, req.Params)
+	if err != nil {
+		h.recordHistory(r, entry, req, start, -1, err)
+		return nil, err
+	}
+	entry.SQL, entry.Params = query, args
+
+	result, err := h.dbManager.RunStatement(r.Context(), query, args)
+	rows := -1
+	if result != nil {
+		rows = result.RowCount
+	}
+	h.recordHistory(r, entry, req, start, rows, err)
+	return result, err
+}
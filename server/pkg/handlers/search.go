@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"dbviewer-saas/pkg/apierror"
+	"dbviewer-saas/pkg/database"
+)
+
+// HandleSearch looks for q in the text and uuid columns of all tables and
+// streams the hits as server-sent events while tables are searched:
+//
+//	hit        - a matching value with its table, column, primary key and snippet
+//	tableError - a table that could not be searched
+//	done       - the summary once the search ends
+//	error      - the search failed after the stream started
+//
+// schemas selects the schemas to search (comma separated, public by default)
+// and limit lowers the configured result limit.
+func (h *DatabaseHandler) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	query := r.URL.Query()
+	opts := database.SearchOptions{
+		Query:       query.Get("q"),
+		Limit:       h.search.MaxResults,
+		Parallelism: h.search.Parallelism,
+	}
+	if strings.TrimSpace(opts.Query) == "" {
+		apierror.Write(w, apierror.InvalidField("q", "q is required"))
+		return
+	}
+	for _, schema := range strings.Split(query.Get("schemas"), ",") {
+		if schema = strings.TrimSpace(schema); schema != "" {
+			opts.Schemas = append(opts.Schemas, schema)
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			apierror.Write(w, apierror.InvalidField("limit", "limit must be a positive integer"))
+			return
+		}
+		if limit < opts.Limit {
+			opts.Limit = limit
+		}
+	}
+
+	// The search is bounded by its own timeout rather than the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Now().Add(h.search.Timeout + 5*time.Second)); err != nil {
+		apierror.Write(w, apierror.Wrap(err, apierror.CodeInternal, "Streaming is not supported"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), h.search.Timeout)
+	defer cancel()
+
+	// Headers go out with the first event, so errors before any table was
+	// searched are still reported as plain API errors
+	started := false
+	send := func(event string, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if !started {
+			started = true
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("X-Accel-Buffering", "no")
+			w.WriteHeader(http.StatusOK)
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	emit := func(hit database.SearchHit) bool {
+		if err := send("hit", hit); err != nil {
+			slog.DebugContext(r.Context(), "Search stream closed", "error", err)
+			return false
+		}
+		return true
+	}
+	fail := func(tableErr *database.SearchTableError) {
+		slog.WarnContext(r.Context(), "Failed to search table", "schema", tableErr.Schema, "table", tableErr.Table, "error", tableErr.Err)
+		send("tableError", map[string]string{
+			"schema":  tableErr.Schema,
+			"table":   tableErr.Table,
+			"message": apierror.From(tableErr.Err).Message,
+		})
+	}
+
+	summary, err := h.dbManager.Search(ctx, opts, emit, fail)
+	if err != nil {
+		if !started {
+			apierror.Write(w, err)
+			return
+		}
+		apiErr := apierror.From(err)
+		send("error", map[string]interface{}{"code": apiErr.Code, "message": apiErr.Message})
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Search finished",
+		"hits", summary.Hits,
+		"tables", summary.TablesSearched,
+		"failed", summary.TablesFailed,
+		"truncated", summary.Truncated,
+		"timed_out", summary.TimedOut,
+	)
+	send("done", summary)
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"dbviewer-saas/pkg/apierror"
+)
+
+// HandleTableStats returns the size, bloat and maintenance statistics of every
+// table. sort takes comma-separated fields, each prefixed with - to sort
+// descending; the largest tables come first by default.
+func (h *DatabaseHandler) HandleTableStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	stats, err := h.dbManager.TableStats(r.Context(), parseSort(r.URL.Query().Get("sort")))
+	if err != nil {
+		apierror.Write(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"tables": stats,
+	}); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
+
+// HandleDatabaseStats returns the size, cache hit ratio, transaction counts
+// and temp file usage of the connected database
+func (h *DatabaseHandler) HandleDatabaseStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	stats, err := h.dbManager.DatabaseStats(r.Context())
+	if err != nil {
+		apierror.Write(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		slog.WarnContext(r.Context(), "Failed to encode response", "error", err)
+	}
+}
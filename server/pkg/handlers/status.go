@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"dbviewer-saas/pkg/admission"
+	"dbviewer-saas/pkg/database"
+)
+
+// StatusHandler reports the runtime state of the server
+type StatusHandler struct {
+	admission   *admission.Controller
+	rateLimiter *admission.RateLimiter
+	dbManager   *database.DatabaseManager
+}
+
+func NewStatusHandler(controller *admission.Controller, rateLimiter *admission.RateLimiter, dbManager *database.DatabaseManager) *StatusHandler {
+	return &StatusHandler{
+		admission:   controller,
+		rateLimiter: rateLimiter,
+		dbManager:   dbManager,
+	}
+}
+
+// HandleStatus returns admission queue depth, rate limiter, cache and SSH tunnel state
+func (h *StatusHandler) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"admission": h.admission.Stats(),
+		"rateLimit": map[string]interface{}{
+			"clients": h.rateLimiter.Clients(),
+		},
+		"cache":  h.dbManager.CacheStats(),
+		"tunnel": h.dbManager.TunnelStatus(),
+	})
+}
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"dbviewer-saas/pkg/apierror"
+	"dbviewer-saas/pkg/auth"
+	"dbviewer-saas/pkg/database"
+	"dbviewer-saas/pkg/tableview"
+
+	"github.com/gorilla/mux"
+)
+
+// viewError maps store errors to API errors
+func viewError(err error) error {
+	switch {
+	case errors.Is(err, tableview.ErrNotFound):
+		return apierror.Wrap(err, apierror.CodeNotFound, "View not found")
+	case errors.Is(err, tableview.ErrNotOwner):
+		return apierror.Wrap(err, apierror.CodePermissionDenied, "Only the owner can change a view")
+	default:
+		return err
+	}
+}
+
+// checkView validates the filter, sort and columns of v against the schema of its table
+func (h *DatabaseHandler) checkView(r *http.Request, v tableview.View) error {
+	schema, err := h.dbManager.GetTableSchema(r.Context(), v.Table)
+	if err != nil {
+		return err
+	}
+
+	verr := &database.ValidationError{}
+	if _, _, err := (database.TableQuery{Table: v.Table, Filter: v.Filter, Sort: v.Sort}).Build(schema); err != nil {
+		var queryErr *database.ValidationError
+		if !errors.As(err, &queryErr) {
+			return err
+		}
+		verr.Fields = append(verr.Fields, queryErr.Fields...)
+	}
+
+	columns := make(map[string]bool, len(schema.Columns))
+	for _, col := range schema.Columns {
+		columns[col.Name] = true
+	}
+	for _, list := range []struct {
+		field   string
+		columns []string
+	}{{"visibleColumns", v.VisibleColumns}, {"columnOrder", v.ColumnOrder}} {
+		for i, column := range list.columns {
+			if !columns[column] {
+				verr.Fields = append(verr.Fields, database.FieldError{
+					Field:   fmt.Sprintf("%s[%d]", list.field, i),
+					Code:    "unknown_column",
+					Message: fmt.Sprintf("column %q does not exist", column),
+				})
+			}
+		}
+	}
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// HandleListViews lists the views of a table owned by the caller or shared with their team
+func (h *DatabaseHandler) HandleListViews(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	views := h.views.List(auth.FromContext(r.Context()), h.connection(), mux.Vars(r)["table"])
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"views": views,
+	})
+}
+
+// HandleCreateView saves a view of a table owned by the caller
+func (h *DatabaseHandler) HandleCreateView(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var v tableview.View
+	if err := decodeJSON(r, &v); err != nil {
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Invalid request body"))
+		return
+	}
+	v.Table, v.Connection = mux.Vars(r)["table"], h.connection()
+	if err := h.checkView(r, v); err != nil {
+		apierror.Write(w, err)
+		return
+	}
+
+	saved, err := h.views.Create(auth.FromContext(r.Context()), v)
+	if err != nil {
+		apierror.Write(w, viewError(err))
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Table view created", "id", saved.ID, "table", saved.Table, "visibility", saved.Visibility)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(saved)
+}
+
+// HandleGetView returns a view of a table visible to the caller
+func (h *DatabaseHandler) HandleGetView(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	vars := mux.Vars(r)
+	v, err := h.views.Get(auth.FromContext(r.Context()), h.connection(), vars["table"], vars["id"])
+	if err != nil {
+		apierror.Write(w, viewError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
+
+// HandleUpdateView replaces a view owned by the caller
+func (h *DatabaseHandler) HandleUpdateView(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var v tableview.View
+	if err := decodeJSON(r, &v); err != nil {
+		apierror.Write(w, apierror.New(apierror.CodeInvalidRequest, "Invalid request body"))
+		return
+	}
+	vars := mux.Vars(r)
+	v.Table, v.Connection = vars["table"], h.connection()
+	if err := h.checkView(r, v); err != nil {
+		apierror.Write(w, err)
+		return
+	}
+
+	saved, err := h.views.Update(auth.FromContext(r.Context()), v.Connection, vars["table"], vars["id"], v)
+	if err != nil {
+		apierror.Write(w, viewError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(saved)
+}
+
+// HandleDeleteView deletes a view owned by the caller
+func (h *DatabaseHandler) HandleDeleteView(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	vars := mux.Vars(r)
+	if err := h.views.Delete(auth.FromContext(r.Context()), h.connection(), vars["table"], vars["id"]); err != nil {
+		apierror.Write(w, viewError(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "View deleted successfully",
+	})
+}
+
+// parseSort reads a sort parameter: comma-separated columns, each prefixed
+// with - to sort descending
+func parseSort(s string) []database.SortKey {
+	var keys []database.SortKey
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		key := database.SortKey{Column: term, Direction: "asc"}
+		if strings.HasPrefix(term, "-") {
+			key = database.SortKey{Column: term[1:], Direction: "desc"}
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
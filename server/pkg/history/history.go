@@ -0,0 +1,336 @@
+// Package history keeps a local, append-only record of the queries and table
+// views users run
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dbviewer-saas/config"
+	"dbviewer-saas/pkg/randid"
+)
+
+// Kinds of recorded requests; each names what a re-run replays
+const (
+	KindTable      = "table"
+	KindExplain    = "explain"
+	KindSavedQuery = "saved_query"
+	KindAggregate  = "aggregate"
+	KindPivot      = "pivot"
+)
+
+// Longest line read back from the history file
+const maxLineSize = 16 * 1024 * 1024
+
+// The file is rewritten once it holds this many more lines than live entries
+const compactSlack = 1000
+
+// How often entries past the retention limits are removed from the file
+const expireInterval = time.Minute
+
+// Entry is one recorded request
+type Entry struct {
+	ID         string        `json:"id"`
+	Time       time.Time     `json:"time"`
+	User       string        `json:"user"`
+	Team       string        `json:"team,omitempty"`
+	Connection string        `json:"connection,omitempty"`
+	Kind       string        `json:"kind"`
+	Table      string        `json:"table,omitempty"`
+	SQL        string        `json:"sql"`
+	Params     []interface{} `json:"params,omitempty"`
+	// Request is the API request that produced the entry, replayed on re-run
+	Request    json.RawMessage `json:"request,omitempty"`
+	DurationMs float64         `json:"durationMs"`
+	Rows       *int64          `json:"rows,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Filter selects entries; zero fields match everything
+type Filter struct {
+	User       string
+	Connection string
+	Kind       string
+	Table      string
+	// Search matches the SQL, table or error case-insensitively
+	Search string
+	// Status is "ok" or "error"
+	Status string
+	Since  time.Time
+	Until  time.Time
+	Offset int
+	Limit  int
+}
+
+// Store holds the history in memory and appends every entry to a JSON lines file
+type Store struct {
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	entries    []Entry // oldest first
+	lines      int
+	maxAge     time.Duration
+	maxEntries int
+	done       chan struct{}
+}
+
+// Open loads the history file, drops entries outside the retention limits and
+// prepares it for appending
+func Open(cfg config.HistoryConfig) (*Store, error) {
+	s := &Store{
+		path:       cfg.File,
+		maxAge:     cfg.MaxAge,
+		maxEntries: cfg.MaxEntries,
+		done:       make(chan struct{}),
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create history directory: %w", err)
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	s.prune()
+	if s.lines != len(s.entries) {
+		if err := s.compact(); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history file: %w", err)
+	}
+	s.file = f
+	go s.expire()
+	return s, nil
+}
+
+// expire periodically rewrites the file without the entries prune dropped, so
+// expired history does not linger on disk until the next compaction
+func (s *Store) expire() {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			select {
+			case <-s.done:
+				// Closed while waiting for the lock
+				s.mu.Unlock()
+				return
+			default:
+			}
+			s.prune()
+			if s.lines != len(s.entries) {
+				if err := s.compact(); err != nil {
+					slog.Warn("Failed to remove expired history entries", "error", err)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// load reads the entries in the history file, skipping lines that do not parse
+func (s *Store) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	skipped := 0
+	for scanner.Scan() {
+		s.lines++
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.ID == "" {
+			skipped++
+			continue
+		}
+		s.entries = append(s.entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read history file: %w", err)
+	}
+	if skipped > 0 {
+		slog.Warn("Skipped unreadable history entries", "count", skipped, "file", s.path)
+	}
+
+	// Appends are ordered, but keep the invariant even for edited files
+	sort.SliceStable(s.entries, func(i, j int) bool {
+		return s.entries[i].Time.Before(s.entries[j].Time)
+	})
+	return nil
+}
+
+// Record assigns e an ID and time, appends it to the file and returns it
+func (s *Store) Record(e Entry) (Entry, error) {
+	e.ID = randid.New()
+	e.Time = time.Now().UTC()
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return e, fmt.Errorf("failed to encode history entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Write(line); err != nil {
+		return e, fmt.Errorf("failed to write history entry: %w", err)
+	}
+	s.lines++
+	s.entries = append(s.entries, e)
+
+	s.prune()
+	if s.lines > 2*len(s.entries)+compactSlack {
+		if err := s.compact(); err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+// Get returns the entry with the given ID
+func (s *Store) Get(id string) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune()
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		if s.entries[i].ID == id {
+			return s.entries[i], true
+		}
+	}
+	return Entry{}, false
+}
+
+// List returns the entries matching f, newest first, and how many matched in total
+func (s *Store) List(f Filter) ([]Entry, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune()
+	search := strings.ToLower(f.Search)
+	matched := make([]Entry, 0)
+	total := 0
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		e := s.entries[i]
+		if !f.matches(e, search) {
+			continue
+		}
+		if total >= f.Offset && (f.Limit <= 0 || len(matched) < f.Limit) {
+			matched = append(matched, e)
+		}
+		total++
+	}
+	return matched, total
+}
+
+func (f Filter) matches(e Entry, search string) bool {
+	switch {
+	case f.User != "" && e.User != f.User,
+		f.Connection != "" && e.Connection != f.Connection,
+		f.Kind != "" && e.Kind != f.Kind,
+		f.Table != "" && e.Table != f.Table,
+		f.Status == "ok" && e.Error != "",
+		f.Status == "error" && e.Error == "",
+		!f.Since.IsZero() && e.Time.Before(f.Since),
+		!f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	}
+	if search == "" {
+		return true
+	}
+	return strings.Contains(strings.ToLower(e.SQL), search) ||
+		strings.Contains(strings.ToLower(e.Table), search) ||
+		strings.Contains(strings.ToLower(e.Error), search)
+}
+
+// Close stops expiring entries and closes the history file
+func (s *Store) Close() error {
+	close(s.done)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// prune drops entries older than the maximum age and beyond the maximum count.
+// The file keeps them until expire or the next compaction rewrites it.
+func (s *Store) prune() {
+	drop := 0
+	if s.maxAge > 0 {
+		cutoff := time.Now().Add(-s.maxAge)
+		drop = sort.Search(len(s.entries), func(i int) bool {
+			return !s.entries[i].Time.Before(cutoff)
+		})
+	}
+	if s.maxEntries > 0 && len(s.entries)-drop > s.maxEntries {
+		drop = len(s.entries) - s.maxEntries
+	}
+	// Appends reallocate the backing array once it is full, releasing dropped entries
+	s.entries = s.entries[drop:]
+}
+
+// compact rewrites the file with only the live entries, replacing it atomically
+func (s *Store) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to compact history: %w", err)
+	}
+
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, e := range s.entries {
+		if err := encoder.Encode(e); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return fmt.Errorf("failed to compact history: %w", err)
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to compact history: %w", err)
+	}
+	s.lines = len(s.entries)
+
+	// Appends must go to the new file
+	if s.file != nil {
+		s.file.Close()
+		if s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+			return fmt.Errorf("failed to reopen history file: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sort"
+	"time"
+
+	"dbviewer-saas/pkg/admission"
+	"dbviewer-saas/pkg/database"
+)
+
+// Longest a scrape waits for the session count before leaving it out
+const sessionQueryTimeout = 2 * time.Second
+
+// RegisterDatabase exposes operation latency, pool statistics, sessions,
+// connection health and cache usage of dm
+func RegisterDatabase(r *Registry, dm *database.DatabaseManager) {
+	duration := r.NewHistogramVec("dbviewer_db_operation_duration_seconds",
+		"Latency of database operations, cache hits included.", DefaultBuckets, "operation")
+	failures := r.NewCounterVec("dbviewer_db_operation_errors_total",
+		"Database operations that returned an error.", "operation")
+	dm.SetQueryObserver(func(operation string, d time.Duration, err error) {
+		duration.Observe(d.Seconds(), operation)
+		if err != nil {
+			failures.Inc(operation)
+		}
+	})
+
+	pool := []string{"pool"}
+	poolGauge := func(name, help string, value func(s poolSnapshot) float64) {
+		r.NewFunc(name, help, KindGauge, pool, func(_ context.Context, emit Emit) {
+			for _, s := range poolSnapshots(dm) {
+				emit(value(s), s.name)
+			}
+		})
+	}
+	poolCounter := func(name, help string, value func(s poolSnapshot) float64) {
+		r.NewFunc(name, help, KindCounter, pool, func(_ context.Context, emit Emit) {
+			for _, s := range poolSnapshots(dm) {
+				emit(value(s), s.name)
+			}
+		})
+	}
+	poolGauge("dbviewer_db_pool_max_open_connections", "Maximum open connections of the pool.",
+		func(s poolSnapshot) float64 { return float64(s.MaxOpenConnections) })
+	poolGauge("dbviewer_db_pool_open_connections", "Open connections, in use and idle.",
+		func(s poolSnapshot) float64 { return float64(s.OpenConnections) })
+	poolGauge("dbviewer_db_pool_in_use_connections", "Connections currently in use.",
+		func(s poolSnapshot) float64 { return float64(s.InUse) })
+	poolGauge("dbviewer_db_pool_idle_connections", "Idle connections.",
+		func(s poolSnapshot) float64 { return float64(s.Idle) })
+	poolCounter("dbviewer_db_pool_wait_count_total", "Connections waited for.",
+		func(s poolSnapshot) float64 { return float64(s.WaitCount) })
+	poolCounter("dbviewer_db_pool_wait_duration_seconds_total", "Time spent waiting for a connection.",
+		func(s poolSnapshot) float64 { return s.WaitDuration.Seconds() })
+	poolCounter("dbviewer_db_pool_max_idle_closed_total", "Connections closed because of the idle limit.",
+		func(s poolSnapshot) float64 { return float64(s.MaxIdleClosed) })
+	poolCounter("dbviewer_db_pool_max_lifetime_closed_total", "Connections closed because of their maximum lifetime.",
+		func(s poolSnapshot) float64 { return float64(s.MaxLifetimeClosed) })
+
+	r.NewFunc("dbviewer_db_sessions", "Server sessions on the connected database by state.",
+		KindGauge, []string{"state"}, func(ctx context.Context, emit Emit) {
+			ctx, cancel := context.WithTimeout(ctx, sessionQueryTimeout)
+			defer cancel()
+
+			counts, err := dm.SessionCounts(ctx)
+			if err != nil {
+				if !errors.Is(err, database.ErrNotConnected) {
+					slog.WarnContext(ctx, "Failed to collect session metrics", "error", err)
+				}
+				return
+			}
+			states := make([]string, 0, len(counts))
+			for state := range counts {
+				states = append(states, state)
+			}
+			sort.Strings(states)
+			for _, state := range states {
+				emit(float64(counts[state]), state)
+			}
+		})
+
+	r.NewFunc("dbviewer_db_connection_state", "Health of the database connection; 1 for the current state.",
+		KindGauge, []string{"state"}, func(_ context.Context, emit Emit) {
+			current := dm.HealthStatus().State
+			for _, state := range []database.ConnectionState{
+				database.StateDisconnected, database.StateHealthy, database.StateDegraded, database.StateDown,
+			} {
+				value := 0.0
+				if state == current {
+					value = 1
+				}
+				emit(value, string(state))
+			}
+		})
+	r.NewFunc("dbviewer_db_ping_latency_seconds", "Latency of the last successful health check.",
+		KindGauge, nil, func(_ context.Context, emit Emit) {
+			emit(dm.HealthStatus().LatencyMs / 1000)
+		})
+
+	cacheStat := func(name, help string, kind Kind, value func() float64) {
+		r.NewFunc(name, help, kind, nil, func(_ context.Context, emit Emit) {
+			emit(value())
+		})
+	}
+	cacheStat("dbviewer_cache_hits_total", "Lookups served from the metadata and result cache.", KindCounter,
+		func() float64 { return float64(dm.CacheStats().Hits) })
+	cacheStat("dbviewer_cache_misses_total", "Lookups not found in the cache.", KindCounter,
+		func() float64 { return float64(dm.CacheStats().Misses) })
+	cacheStat("dbviewer_cache_evictions_total", "Entries evicted to stay within the cache size.", KindCounter,
+		func() float64 { return float64(dm.CacheStats().Evictions) })
+	cacheStat("dbviewer_cache_hit_ratio", "Share of lookups served from the cache since start.", KindGauge,
+		func() float64 { return dm.CacheStats().HitRatio })
+	cacheStat("dbviewer_cache_entries", "Entries in the cache.", KindGauge,
+		func() float64 { return float64(dm.CacheStats().Entries) })
+	cacheStat("dbviewer_cache_used_bytes", "Estimated size of the cached entries.", KindGauge,
+		func() float64 { return float64(dm.CacheStats().UsedBytes) })
+}
+
+// RegisterAdmission exposes the admission queue and the rate limiter
+func RegisterAdmission(r *Registry, ac *admission.Controller, rl *admission.RateLimiter) {
+	stat := func(name, help string, kind Kind, value func(s admission.Stats) float64) {
+		r.NewFunc(name, help, kind, nil, func(_ context.Context, emit Emit) {
+			emit(value(ac.Stats()))
+		})
+	}
+	stat("dbviewer_admission_in_flight", "Requests holding an admission slot.", KindGauge,
+		func(s admission.Stats) float64 { return float64(s.InFlight) })
+	stat("dbviewer_admission_queued", "Requests waiting for an admission slot.", KindGauge,
+		func(s admission.Stats) float64 { return float64(s.Queued) })
+	stat("dbviewer_admission_max_concurrent", "Admission slots.", KindGauge,
+		func(s admission.Stats) float64 { return float64(s.MaxConcurrent) })
+	stat("dbviewer_admission_queue_size", "Requests allowed to wait for a slot.", KindGauge,
+		func(s admission.Stats) float64 { return float64(s.QueueSize) })
+	stat("dbviewer_admission_admitted_total", "Requests admitted.", KindCounter,
+		func(s admission.Stats) float64 { return float64(s.Admitted) })
+	stat("dbviewer_admission_rejected_total", "Requests shed because the queue was full.", KindCounter,
+		func(s admission.Stats) float64 { return float64(s.Rejected) })
+	stat("dbviewer_admission_timed_out_total", "Requests shed after waiting too long for a slot.", KindCounter,
+		func(s admission.Stats) float64 { return float64(s.TimedOut) })
+
+	r.NewFunc("dbviewer_rate_limit_clients", "Clients tracked by the rate limiter.", KindGauge, nil,
+		func(_ context.Context, emit Emit) {
+			emit(float64(rl.Clients()))
+		})
+}
+
+// poolSnapshot is the statistics of one named pool
+type poolSnapshot struct {
+	name string
+	sql.DBStats
+}
+
+func poolSnapshots(dm *database.DatabaseManager) []poolSnapshot {
+	stats := dm.PoolStats()
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	snapshots := make([]poolSnapshot, len(names))
+	for i, name := range names {
+		snapshots[i] = poolSnapshot{name: name, DBStats: stats[name]}
+	}
+	return snapshots
+}
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"dbviewer-saas/pkg/httputil"
+
+	"github.com/gorilla/mux"
+)
+
+// HTTPMetrics counts and times requests by route and status
+type HTTPMetrics struct {
+	requests *CounterVec
+	duration *HistogramVec
+}
+
+// NewHTTPMetrics registers the HTTP request metrics
+func NewHTTPMetrics(r *Registry) *HTTPMetrics {
+	return &HTTPMetrics{
+		requests: r.NewCounterVec("dbviewer_http_requests_total",
+			"HTTP requests by route, method and status code.", "route", "method", "status"),
+		duration: r.NewHistogramVec("dbviewer_http_request_duration_seconds",
+			"HTTP request latency by route and method.", DefaultBuckets, "route", "method"),
+	}
+}
+
+// Middleware records each request under its route template, so /api/tables/users
+// and /api/tables/orders share the series of /api/tables/{table}. Requests that
+// matched no route are recorded as "unmatched".
+func (m *HTTPMetrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		start := time.Now()
+		rec := httputil.NewStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		m.requests.Inc(route, r.Method, strconv.Itoa(rec.Status()))
+		m.duration.Observe(time.Since(start).Seconds(), route, r.Method)
+	})
+}
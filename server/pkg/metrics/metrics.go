@@ -0,0 +1,324 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Kind is the Prometheus type of a metric family
+type Kind string
+
+const (
+	KindCounter   Kind = "counter"
+	KindGauge     Kind = "gauge"
+	KindHistogram Kind = "histogram"
+)
+
+// DefaultBuckets are latency buckets in seconds, from 5ms to 10s
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// family is a named metric that writes its samples in the text exposition format
+type family interface {
+	name() string
+	write(ctx context.Context, w *bufio.Writer)
+}
+
+// Registry holds the metric families exposed by Handler
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.families {
+		if existing.name() == f.name() {
+			panic("metrics: duplicate metric " + f.name())
+		}
+	}
+	r.families = append(r.families, f)
+}
+
+// Handler serves every registered family in the Prometheus text format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		families := append([]family(nil), r.families...)
+		r.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+
+		buf := bufio.NewWriter(w)
+		for _, f := range families {
+			f.write(req.Context(), buf)
+		}
+		buf.Flush()
+	})
+}
+
+// CounterVec is a counter partitioned by label values
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+// NewCounterVec registers a counter with the given label names
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{metric: name, help: help, kind: KindCounter, labels: labels},
+		values: make(map[string]*counterValue),
+	}
+	r.register(c)
+	return c
+}
+
+// Add increases the counter for the label values by delta
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.values[key]
+	if !ok {
+		v = &counterValue{labels: append([]string(nil), labelValues...)}
+		c.values[key] = v
+	}
+	v.value += delta
+}
+
+// Inc increases the counter for the label values by one
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) write(_ context.Context, w *bufio.Writer) {
+	c.mu.Lock()
+	keys := sortedKeys(c.values)
+	samples := make([]counterValue, len(keys))
+	for i, key := range keys {
+		samples[i] = *c.values[key]
+	}
+	c.mu.Unlock()
+
+	c.header(w)
+	for _, s := range samples {
+		c.sample(w, "", s.labels, nil, s.value)
+	}
+}
+
+// HistogramVec is a histogram partitioned by label values
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec registers a histogram with the given upper bucket bounds and label names
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	h := &HistogramVec{
+		desc:    desc{metric: name, help: help, kind: KindHistogram, labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records one value for the label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{
+			labels: append([]string(nil), labelValues...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = v
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += value
+}
+
+func (h *HistogramVec) write(_ context.Context, w *bufio.Writer) {
+	h.mu.Lock()
+	keys := sortedKeys(h.values)
+	samples := make([]histogramValue, len(keys))
+	for i, key := range keys {
+		v := h.values[key]
+		samples[i] = histogramValue{
+			labels: v.labels,
+			counts: append([]uint64(nil), v.counts...),
+			count:  v.count,
+			sum:    v.sum,
+		}
+	}
+	h.mu.Unlock()
+
+	h.header(w)
+	for _, s := range samples {
+		for i, bound := range h.buckets {
+			h.sample(w, "_bucket", s.labels, []string{"le", formatFloat(bound)}, float64(s.counts[i]))
+		}
+		h.sample(w, "_bucket", s.labels, []string{"le", "+Inf"}, float64(s.count))
+		h.sample(w, "_sum", s.labels, nil, s.sum)
+		h.sample(w, "_count", s.labels, nil, float64(s.count))
+	}
+}
+
+// Emit records one sample of a collected metric
+type Emit func(value float64, labelValues ...string)
+
+// funcFamily reads its samples from a callback at scrape time
+type funcFamily struct {
+	desc
+	collect func(ctx context.Context, emit Emit)
+}
+
+// NewFunc registers a counter or gauge whose samples are read from collect on
+// every scrape. It suits values that already live elsewhere, such as pool statistics.
+func (r *Registry) NewFunc(name, help string, kind Kind, labels []string, collect func(ctx context.Context, emit Emit)) {
+	r.register(&funcFamily{
+		desc:    desc{metric: name, help: help, kind: kind, labels: labels},
+		collect: collect,
+	})
+}
+
+func (f *funcFamily) write(ctx context.Context, w *bufio.Writer) {
+	f.header(w)
+	f.collect(ctx, func(value float64, labelValues ...string) {
+		f.sample(w, "", labelValues, nil, value)
+	})
+}
+
+// desc holds what every family shares: name, help, type and label names
+type desc struct {
+	metric string
+	help   string
+	kind   Kind
+	labels []string
+}
+
+func (d *desc) name() string {
+	return d.metric
+}
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.metric, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.metric, d.kind)
+}
+
+// sample writes one line; extra is a trailing name/value label pair such as le
+func (d *desc) sample(w *bufio.Writer, suffix string, labelValues, extra []string, value float64) {
+	w.WriteString(d.metric)
+	w.WriteString(suffix)
+
+	if len(d.labels) > 0 || len(extra) > 0 {
+		w.WriteByte('{')
+		n := 0
+		writeLabel := func(name, value string) {
+			if n > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(name)
+			w.WriteString(`="`)
+			w.WriteString(escapeLabel(value))
+			w.WriteByte('"')
+			n++
+		}
+		for i, name := range d.labels {
+			value := ""
+			if i < len(labelValues) {
+				value = labelValues[i]
+			}
+			writeLabel(name, value)
+		}
+		if len(extra) == 2 {
+			writeLabel(extra[0], extra[1])
+		}
+		w.WriteByte('}')
+	}
+
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+// seriesKey identifies a label combination inside a family
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,262 @@
+// Package ownedstore keeps named records that users own, privately or shared
+// with their team, in memory and in a JSON file
+package ownedstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dbviewer-saas/pkg/auth"
+	"dbviewer-saas/pkg/database"
+	"dbviewer-saas/pkg/randid"
+)
+
+// Visibilities of a record
+const (
+	VisibilityPrivate = "private"
+	VisibilityTeam    = "team"
+)
+
+var (
+	// ErrNotFound is returned for records that do not exist or are not visible to the caller
+	ErrNotFound = errors.New("record not found")
+	// ErrNotOwner is returned when someone other than the owner changes a record
+	ErrNotOwner = errors.New("only the owner can change a record")
+)
+
+// Owned holds the fields every stored record has; record types embed it
+type Owned struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Owner      string    `json:"owner"`
+	Team       string    `json:"team,omitempty"`
+	Visibility string    `json:"visibility"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+func (o *Owned) owned() *Owned {
+	return o
+}
+
+// Normalize trims the name and defaults the visibility, returning the
+// problems with either
+func (o *Owned) Normalize() []database.FieldError {
+	var fields []database.FieldError
+	o.Name = strings.TrimSpace(o.Name)
+	if o.Name == "" {
+		fields = append(fields, database.FieldError{Field: "name", Code: "required", Message: "name is required"})
+	}
+
+	switch o.Visibility {
+	case "":
+		o.Visibility = VisibilityPrivate
+	case VisibilityPrivate, VisibilityTeam:
+	default:
+		fields = append(fields, database.FieldError{Field: "visibility", Code: "invalid_value", Message: "visibility must be private or team"})
+	}
+	return fields
+}
+
+// visibleTo reports whether id may see and use the record. Team records are
+// visible to members of the owner's team.
+func (o *Owned) visibleTo(id auth.Identity) bool {
+	if o.Owner == id.User {
+		return true
+	}
+	return o.Visibility == VisibilityTeam && o.Team != "" && o.Team == id.Team
+}
+
+// Record is a pointer to a type embedding Owned
+type Record[T any] interface {
+	*T
+	owned() *Owned
+}
+
+// Store keeps records of type T. Lookups take a match function that narrows
+// the records further, e.g. to a table; nil matches every record.
+type Store[T any, P Record[T]] struct {
+	mu      sync.RWMutex
+	path    string
+	what    string
+	records map[string]P
+}
+
+// Open loads the records in the file at path, which is created on the first
+// save. what names the records in errors, e.g. "saved queries".
+func Open[T any, P Record[T]](path, what string) (*Store[T, P], error) {
+	s := &Store[T, P]{path: path, what: what, records: make(map[string]P)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", what, err)
+	}
+
+	// Keep numbers exact, as when they were first decoded
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var records []P
+	if err := decoder.Decode(&records); err != nil {
+		return nil, fmt.Errorf("failed to parse %s %s: %w", what, path, err)
+	}
+	for _, r := range records {
+		s.records[r.owned().ID] = r
+	}
+	return s, nil
+}
+
+// List returns the records visible to id that match, sorted by name
+func (s *Store[T, P]) List(id auth.Identity, match func(P) bool) []T {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var found []P
+	for _, r := range s.records {
+		if r.owned().visibleTo(id) && (match == nil || match(r)) {
+			found = append(found, r)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		a, b := found[i].owned(), found[j].owned()
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	})
+
+	out := make([]T, 0, len(found))
+	for _, r := range found {
+		out = append(out, *r)
+	}
+	return out
+}
+
+// Get returns the record if it matches and id may see it
+func (s *Store[T, P]) Get(id auth.Identity, recordID string, match func(P) bool) (T, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, err := s.find(id, recordID, match)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return *r, nil
+}
+
+// Create saves r owned by id. It must already be normalized and validated.
+func (s *Store[T, P]) Create(id auth.Identity, r T) (T, error) {
+	o := P(&r).owned()
+	now := time.Now().UTC()
+	o.ID = randid.New()
+	o.Owner, o.Team = id.User, id.Team
+	o.CreatedAt, o.UpdatedAt = now, now
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[o.ID] = &r
+	if err := s.save(); err != nil {
+		delete(s.records, o.ID)
+		var zero T
+		return zero, err
+	}
+	return r, nil
+}
+
+// Update replaces a matching record owned by id with r, keeping its
+// identity, ownership and creation time
+func (s *Store[T, P]) Update(id auth.Identity, recordID string, r T, match func(P) bool) (T, error) {
+	var zero T
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.find(id, recordID, match)
+	if err != nil {
+		return zero, err
+	}
+	old := existing.owned()
+	if old.Owner != id.User {
+		return zero, ErrNotOwner
+	}
+
+	o := P(&r).owned()
+	o.ID, o.Owner, o.Team, o.CreatedAt = old.ID, old.Owner, old.Team, old.CreatedAt
+	o.UpdatedAt = time.Now().UTC()
+	s.records[recordID] = &r
+	if err := s.save(); err != nil {
+		s.records[recordID] = existing
+		return zero, err
+	}
+	return r, nil
+}
+
+// Delete removes a matching record owned by id
+func (s *Store[T, P]) Delete(id auth.Identity, recordID string, match func(P) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.find(id, recordID, match)
+	if err != nil {
+		return err
+	}
+	if existing.owned().Owner != id.User {
+		return ErrNotOwner
+	}
+
+	delete(s.records, recordID)
+	if err := s.save(); err != nil {
+		s.records[recordID] = existing
+		return err
+	}
+	return nil
+}
+
+// find returns the record if it matches and id may see it; s.mu must be held
+func (s *Store[T, P]) find(id auth.Identity, recordID string, match func(P) bool) (P, error) {
+	r, ok := s.records[recordID]
+	if !ok || !r.owned().visibleTo(id) || (match != nil && !match(r)) {
+		return nil, ErrNotFound
+	}
+	return r, nil
+}
+
+// save writes all records to a temporary file and moves it over the old one
+func (s *Store[T, P]) save() error {
+	records := make([]P, 0, len(s.records))
+	for _, r := range s.records {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].owned().CreatedAt.Before(records[j].owned().CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", s.what, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create %s directory: %w", s.what, err)
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.what, err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", s.what, err)
+	}
+	return nil
+}
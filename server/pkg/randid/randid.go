@@ -0,0 +1,14 @@
+// Package randid generates identifiers for stored records
+package randid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// New returns a random 16 character hex identifier
+func New() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
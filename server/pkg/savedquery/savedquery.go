@@ -0,0 +1,139 @@
+// Package savedquery stores named, parameterized SQL that users keep for
+// themselves or share with their team
+package savedquery
+
+import (
+	"errors"
+	"strings"
+
+	"dbviewer-saas/pkg/auth"
+	"dbviewer-saas/pkg/database"
+	"dbviewer-saas/pkg/ownedstore"
+)
+
+// Visibilities of a saved query
+const (
+	VisibilityPrivate = ownedstore.VisibilityPrivate
+	VisibilityTeam    = ownedstore.VisibilityTeam
+)
+
+var (
+	// ErrNotFound is returned for queries that do not exist or are not visible to the caller
+	ErrNotFound = ownedstore.ErrNotFound
+	// ErrNotOwner is returned when someone other than the owner changes a query
+	ErrNotOwner = ownedstore.ErrNotOwner
+)
+
+// Query is a saved statement with its :name parameter declarations
+type Query struct {
+	ownedstore.Owned
+	Description string                `json:"description,omitempty"`
+	Tags        []string              `json:"tags"`
+	SQL         string                `json:"sql"`
+	Params      []database.NamedParam `json:"params"`
+}
+
+// Filter narrows a listing; zero fields match everything
+type Filter struct {
+	Tag string
+	// Search matches the name, description and SQL case-insensitively
+	Search string
+}
+
+// Store keeps saved queries in memory and persists them to a JSON file
+type Store struct {
+	queries *ownedstore.Store[Query, *Query]
+}
+
+// Open loads the saved queries in the file at path, which is created on the first save
+func Open(path string) (*Store, error) {
+	queries, err := ownedstore.Open[Query](path, "saved queries")
+	if err != nil {
+		return nil, err
+	}
+	return &Store{queries: queries}, nil
+}
+
+// List returns the queries visible to id, sorted by name
+func (s *Store) List(id auth.Identity, f Filter) []Query {
+	search := strings.ToLower(f.Search)
+	return s.queries.List(id, func(q *Query) bool {
+		if f.Tag != "" && !hasTag(q.Tags, f.Tag) {
+			return false
+		}
+		return search == "" ||
+			strings.Contains(strings.ToLower(q.Name), search) ||
+			strings.Contains(strings.ToLower(q.Description), search) ||
+			strings.Contains(strings.ToLower(q.SQL), search)
+	})
+}
+
+// Get returns the query if id may see it
+func (s *Store) Get(id auth.Identity, queryID string) (Query, error) {
+	return s.queries.Get(id, queryID, nil)
+}
+
+// Create validates q and saves it owned by id
+func (s *Store) Create(id auth.Identity, q Query) (Query, error) {
+	if err := normalize(&q); err != nil {
+		return Query{}, err
+	}
+	return s.queries.Create(id, q)
+}
+
+// Update replaces the editable fields of a query owned by id
+func (s *Store) Update(id auth.Identity, queryID string, q Query) (Query, error) {
+	if err := normalize(&q); err != nil {
+		return Query{}, err
+	}
+	return s.queries.Update(id, queryID, q, nil)
+}
+
+// Delete removes a query owned by id
+func (s *Store) Delete(id auth.Identity, queryID string) error {
+	return s.queries.Delete(id, queryID, nil)
+}
+
+// normalize trims q and checks it, including its parameters against the SQL
+func normalize(q *Query) error {
+	verr := &database.ValidationError{Fields: q.Owned.Normalize()}
+
+	q.Description = strings.TrimSpace(q.Description)
+	q.SQL = strings.TrimRight(strings.TrimSpace(q.SQL), "; \t\r\n")
+	if q.SQL == "" {
+		verr.Fields = append(verr.Fields, database.FieldError{Field: "sql", Code: "required", Message: "sql is required"})
+	}
+
+	tags := make([]string, 0, len(q.Tags))
+	for _, tag := range q.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !hasTag(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	q.Tags = tags
+	if q.Params == nil {
+		q.Params = []database.NamedParam{}
+	}
+
+	if q.SQL != "" {
+		var paramErr *database.ValidationError
+		if err := database.ValidateNamedParams(q.SQL, q.Params); errors.As(err, &paramErr) {
+			verr.Fields = append(verr.Fields, paramErr.Fields...)
+		}
+	}
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
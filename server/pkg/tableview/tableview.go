@@ -0,0 +1,132 @@
+// Package tableview stores saved views of a table — filter, sort, visible
+// columns, column order and page size — that users keep for themselves or
+// share with their team
+package tableview
+
+import (
+	"fmt"
+
+	"dbviewer-saas/pkg/auth"
+	"dbviewer-saas/pkg/database"
+	"dbviewer-saas/pkg/ownedstore"
+)
+
+// Visibilities of a view
+const (
+	VisibilityPrivate = ownedstore.VisibilityPrivate
+	VisibilityTeam    = ownedstore.VisibilityTeam
+)
+
+// Largest page size a view can keep
+const maxPageSize = 1000
+
+var (
+	// ErrNotFound is returned for views that do not exist or are not visible to the caller
+	ErrNotFound = ownedstore.ErrNotFound
+	// ErrNotOwner is returned when someone other than the owner changes a view
+	ErrNotOwner = ownedstore.ErrNotOwner
+)
+
+// View is a saved way of looking at a table
+type View struct {
+	ownedstore.Owned
+	Table string `json:"table"`
+	// Connection is the profile (user@host/database) the view was saved against
+	Connection     string             `json:"connection"`
+	Filter         *database.Filter   `json:"filter,omitempty"`
+	Sort           []database.SortKey `json:"sort"`
+	VisibleColumns []string           `json:"visibleColumns"`
+	ColumnOrder    []string           `json:"columnOrder"`
+	PageSize       int                `json:"pageSize,omitempty"`
+}
+
+// of matches the views of table on connection
+func of(connection, table string) func(*View) bool {
+	return func(v *View) bool {
+		return v.Table == table && v.Connection == connection
+	}
+}
+
+// Store keeps views in memory and persists them to a JSON file
+type Store struct {
+	views *ownedstore.Store[View, *View]
+}
+
+// Open loads the views in the file at path, which is created on the first save
+func Open(path string) (*Store, error) {
+	views, err := ownedstore.Open[View](path, "table views")
+	if err != nil {
+		return nil, err
+	}
+	return &Store{views: views}, nil
+}
+
+// List returns the views of table on connection visible to id, sorted by name
+func (s *Store) List(id auth.Identity, connection, table string) []View {
+	return s.views.List(id, of(connection, table))
+}
+
+// Get returns the view of table on connection if id may see it
+func (s *Store) Get(id auth.Identity, connection, table, viewID string) (View, error) {
+	return s.views.Get(id, viewID, of(connection, table))
+}
+
+// Create validates v and saves it owned by id. The filter, sort and columns
+// must already have been checked against the table schema, and v.Connection
+// set to the connection they were checked on.
+func (s *Store) Create(id auth.Identity, v View) (View, error) {
+	if err := normalize(&v); err != nil {
+		return View{}, err
+	}
+	return s.views.Create(id, v)
+}
+
+// Update replaces the editable fields of a view of table on connection owned by id
+func (s *Store) Update(id auth.Identity, connection, table, viewID string, v View) (View, error) {
+	if err := normalize(&v); err != nil {
+		return View{}, err
+	}
+	v.Table, v.Connection = table, connection
+	return s.views.Update(id, viewID, v, of(connection, table))
+}
+
+// Delete removes a view of table on connection owned by id
+func (s *Store) Delete(id auth.Identity, connection, table, viewID string) error {
+	return s.views.Delete(id, viewID, of(connection, table))
+}
+
+// normalize trims v and checks the fields that do not depend on the table schema
+func normalize(v *View) error {
+	verr := &database.ValidationError{Fields: v.Owned.Normalize()}
+	invalid := func(field, code, message string) {
+		verr.Fields = append(verr.Fields, database.FieldError{Field: field, Code: code, Message: message})
+	}
+
+	if v.PageSize < 0 || v.PageSize > maxPageSize {
+		invalid("pageSize", "out_of_range", fmt.Sprintf("pageSize must be between 1 and %d", maxPageSize))
+	}
+
+	for _, list := range []struct {
+		field   string
+		columns *[]string
+	}{{"visibleColumns", &v.VisibleColumns}, {"columnOrder", &v.ColumnOrder}} {
+		seen := make(map[string]bool, len(*list.columns))
+		for _, column := range *list.columns {
+			if seen[column] {
+				invalid(list.field, "duplicate", fmt.Sprintf("column %q is listed twice", column))
+			}
+			seen[column] = true
+		}
+		if *list.columns == nil {
+			*list.columns = []string{}
+		}
+	}
+	if v.Sort == nil {
+		v.Sort = []database.SortKey{}
+	}
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}